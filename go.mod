@@ -1,3 +1,7 @@
 module raft
 
 go 1.19
+
+require go.etcd.io/bbolt v1.3.8
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -0,0 +1,96 @@
+package kvstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clientRetryInterval is how long a Client waits before trying all stores
+// again when none of them accepted a request, e.g. during an election.
+const clientRetryInterval = 50 * time.Millisecond
+
+// Client issues requests to a cluster of Stores, finding the leader among
+// them and retrying until a request succeeds. Its writes are deduplicated by
+// the stores, so a write that's retried after a leader change is still
+// applied exactly once.
+type Client struct {
+	mu     sync.Mutex
+	id     int64
+	stores []*Store
+
+	// seq is the sequence number of the client's last write, and leader the
+	// index in stores of the last store known to be the leader.
+	seq    int64
+	leader int
+}
+
+// NewClient creates a client for the cluster made of stores. id identifies
+// the client's session; it must be non-zero and unique among all clients of
+// the cluster.
+func NewClient(id int64, stores []*Store) *Client {
+	return &Client{id: id, stores: stores}
+}
+
+// Put sets key to value, retrying until the write is applied or ctx is done.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.write(ctx, Command{Kind: CommandPut, Key: key, Value: value})
+}
+
+// Delete removes key, retrying until the write is applied or ctx is done.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.write(ctx, Command{Kind: CommandDelete, Key: key})
+}
+
+// Get returns the value of key and whether key is set, retrying until the
+// read is served or ctx is done.
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := c.retry(ctx, func(s *Store) error {
+		var err error
+		value, ok, err = s.Get(ctx, key)
+		return err
+	})
+	return value, ok, err
+}
+
+// write issues cmd as the client's next write. Every attempt carries the same
+// sequence number, so the stores apply it once.
+func (c *Client) write(ctx context.Context, cmd Command) error {
+	c.mu.Lock()
+	c.seq++
+	cmd.ClientId = c.id
+	cmd.SequenceNum = c.seq
+	c.mu.Unlock()
+	return c.retry(ctx, func(s *Store) error {
+		return s.write(ctx, cmd)
+	})
+}
+
+// retry calls do on the stores, starting with the last known leader, until
+// it succeeds or ctx is done.
+func (c *Client) retry(ctx context.Context, do func(s *Store) error) error {
+	c.mu.Lock()
+	start := c.leader
+	c.mu.Unlock()
+	for {
+		for i := range c.stores {
+			n := (start + i) % len(c.stores)
+			if err := do(c.stores[n]); err == nil {
+				c.mu.Lock()
+				c.leader = n
+				c.mu.Unlock()
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-time.After(clientRetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
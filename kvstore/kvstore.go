@@ -0,0 +1,256 @@
+// Package kvstore is a simple replicated key-value store built on top of the
+// raft package. It shows how an application uses Raft: writes are submitted
+// to the leader and applied from the commit channel once committed, reads are
+// served locally after confirming leadership with ReadIndex, and the store
+// snapshots its state so the Raft log can be compacted.
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sync"
+
+	"raft/raft"
+)
+
+func init() {
+	gob.Register(Command{})
+}
+
+// ErrNotLeader is returned by the store's methods when called on a server
+// that isn't the leader; the client should retry on another server. It's
+// raft.ErrNotLeader, so errors from the store and from Raft match the same
+// sentinel.
+var ErrNotLeader = raft.ErrNotLeader
+
+// Raft is the part of a Raft server's API the store uses. *raft.Server
+// implements it.
+type Raft interface {
+	Submit(command interface{}) (index int, term int, isLeader bool)
+	ReadIndex() (int, error)
+	Snapshot(index int, snapshot []byte)
+}
+
+// CommandKind is the kind of a Command.
+type CommandKind int
+
+const (
+	CommandPut CommandKind = iota
+	CommandDelete
+)
+
+// Command is the command the store submits to Raft for every write.
+// Commands issued by a Client carry its id and a sequence number, so the
+// store applies each of them at most once even when the client retries;
+// commands with a zero ClientId aren't deduplicated.
+type Command struct {
+	Kind  CommandKind
+	Key   string
+	Value string
+
+	ClientId    int64
+	SequenceNum int64
+}
+
+// snapshot is the state of a Store as encoded in its snapshots. The session
+// table is part of it, so duplicates of commands the snapshot covers are
+// still detected after it's restored.
+type snapshot struct {
+	Data     map[string]string
+	Sessions *raft.Sessions
+}
+
+// Store is a key-value store replicated with Raft. Every server of the
+// cluster runs a Store on top of its raft.Server; clients call Put, Delete
+// and Get on the Store of the leader.
+type Store struct {
+	mu       sync.Mutex
+	raft     Raft
+	data     map[string]string
+	sessions *raft.Sessions
+
+	// lastApplied is the index of the last command applied to data.
+	lastApplied int
+
+	// appliedChan is closed, and replaced by a new channel, whenever a
+	// command is applied; waitApplied waits on it.
+	appliedChan chan struct{}
+
+	// pending maps the index of every write waiting in Put or Delete to a
+	// channel that receives the term of the entry applied at that index.
+	pending map[int]chan int
+}
+
+// NewStore creates a Store on top of r, which delivers committed entries on
+// commitChan. The Store applies them in a goroutine that runs for as long as
+// commitChan is open.
+func NewStore(r Raft, commitChan <-chan raft.CommitEntry) *Store {
+	s := &Store{
+		raft:        r,
+		data:        make(map[string]string),
+		sessions:    raft.NewSessions(),
+		lastApplied: -1,
+		appliedChan: make(chan struct{}),
+		pending:     make(map[int]chan int),
+	}
+	go s.applyCommits(commitChan)
+	return s
+}
+
+// Put sets key to value. It returns once the write is committed and applied
+// to this Store, or with an error if this server isn't the leader, if the
+// write was lost in a leader change, or if ctx is done first. After a lost
+// write or a ctx error, the write may or may not have been applied.
+func (s *Store) Put(ctx context.Context, key, value string) error {
+	return s.write(ctx, Command{Kind: CommandPut, Key: key, Value: value})
+}
+
+// Delete removes key. It returns like Put.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	return s.write(ctx, Command{Kind: CommandDelete, Key: key})
+}
+
+// Get returns the value of key, and whether key is set. The read is
+// linearizable: it reflects every write that completed before Get was called.
+// It's only served by the leader; the errors of ReadIndex are returned
+// wrapped, so they match ErrNotLeader on a follower, and raft.ErrLeaderNotReady
+// on a leader that just took office.
+func (s *Store) Get(ctx context.Context, key string) (string, bool, error) {
+	readIndex, err := s.raft.ReadIndex()
+	if err != nil {
+		return "", false, fmt.Errorf("read index: %w", err)
+	}
+	if err := s.waitApplied(ctx, readIndex); err != nil {
+		return "", false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.data[key]
+	return value, ok, nil
+}
+
+// Snapshot hands a snapshot of the store's state to Raft, which then
+// discards the log entries the snapshot covers.
+func (s *Store) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastApplied < 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot{Data: s.data, Sessions: s.sessions}); err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+	s.raft.Snapshot(s.lastApplied, buf.Bytes())
+	return nil
+}
+
+// LastApplied returns the index of the last command applied to the store.
+func (s *Store) LastApplied() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastApplied
+}
+
+// write submits cmd and waits for it to be applied.
+func (s *Store) write(ctx context.Context, cmd Command) error {
+	// s.mu is held across Submit so the write can't be applied before it's
+	// registered in s.pending.
+	s.mu.Lock()
+	index, term, isLeader := s.raft.Submit(cmd)
+	if !isLeader {
+		s.mu.Unlock()
+		return ErrNotLeader
+	}
+	appliedTerm := make(chan int, 1)
+	s.pending[index] = appliedTerm
+	s.mu.Unlock()
+
+	select {
+	case t := <-appliedTerm:
+		if t != term {
+			return fmt.Errorf("write at index %d was lost in a leader change", index)
+		}
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.pending, index)
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// waitApplied blocks until the command at index is applied, or ctx is done.
+func (s *Store) waitApplied(ctx context.Context, index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.lastApplied < index {
+		appliedChan := s.appliedChan
+		s.mu.Unlock()
+		select {
+		case <-appliedChan:
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	return nil
+}
+
+// applyCommand applies cmd to the store, unless it's a duplicate of a command
+// applied before.
+// Expects s.mu to be locked.
+func (s *Store) applyCommand(cmd Command) {
+	if cmd.ClientId != 0 {
+		if s.sessions.IsDuplicate(cmd.ClientId, cmd.SequenceNum) {
+			return
+		}
+		s.sessions.Applied(cmd.ClientId, cmd.SequenceNum)
+	}
+	switch cmd.Kind {
+	case CommandPut:
+		s.data[cmd.Key] = cmd.Value
+	case CommandDelete:
+		delete(s.data, cmd.Key)
+	}
+}
+
+// applyCommits applies the entries delivered on commitChan to the store.
+func (s *Store) applyCommits(commitChan <-chan raft.CommitEntry) {
+	for entry := range commitChan {
+		s.mu.Lock()
+		if entry.IsSnapshot {
+			snap := snapshot{Sessions: raft.NewSessions()}
+			if err := gob.NewDecoder(bytes.NewReader(entry.Snapshot)).Decode(&snap); err != nil {
+				panic(fmt.Sprintf("kvstore: decode snapshot at index %d: %v", entry.Index, err))
+			}
+			if snap.Data == nil {
+				snap.Data = make(map[string]string)
+			}
+			s.data = snap.Data
+			s.sessions = snap.Sessions
+		} else if cmd, ok := entry.Command.(Command); ok {
+			s.applyCommand(cmd)
+		}
+		s.lastApplied = entry.Index
+
+		// Writes at this index learn whether it's theirs; writes at earlier
+		// indices were covered by a snapshot, so whether they were applied
+		// is unknown.
+		for index, appliedTerm := range s.pending {
+			if index == entry.Index && !entry.IsSnapshot {
+				appliedTerm <- entry.Term
+				delete(s.pending, index)
+			} else if index <= entry.Index {
+				appliedTerm <- -1
+				delete(s.pending, index)
+			}
+		}
+		close(s.appliedChan)
+		s.appliedChan = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
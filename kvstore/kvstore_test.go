@@ -0,0 +1,188 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"raft/raft"
+)
+
+// fakeRaft is a Raft for a single server, which commits every command as soon
+// as it's submitted. It's the leader unless follower is set; a leader with
+// notReady set hasn't committed an entry in its term yet.
+type fakeRaft struct {
+	mu         sync.Mutex
+	follower   bool
+	notReady   bool
+	lastIndex  int
+	commitChan chan raft.CommitEntry
+}
+
+func newFakeRaft() *fakeRaft {
+	return &fakeRaft{lastIndex: -1, commitChan: make(chan raft.CommitEntry, 16)}
+}
+
+func (r *fakeRaft) Submit(command interface{}) (int, int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.follower {
+		return -1, -1, false
+	}
+	r.lastIndex++
+	r.commitChan <- raft.CommitEntry{Command: command, Index: r.lastIndex, Term: 1}
+	return r.lastIndex, 1, true
+}
+
+func (r *fakeRaft) ReadIndex() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.follower {
+		return -1, fmt.Errorf("server 0 is %w", raft.ErrNotLeader)
+	}
+	if r.notReady {
+		return -1, fmt.Errorf("leader 0 in term 1: %w", raft.ErrLeaderNotReady)
+	}
+	return r.lastIndex, nil
+}
+
+func (r *fakeRaft) Snapshot(index int, snapshot []byte) {}
+
+func TestStoreNotLeader(t *testing.T) {
+	r := newFakeRaft()
+	r.follower = true
+	s := NewStore(r, r.commitChan)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The store's ErrNotLeader is Raft's, so callers can match either.
+	if err := s.Put(ctx, "a", "1"); !errors.Is(err, raft.ErrNotLeader) {
+		t.Errorf("Put on a follower: got %v; want raft.ErrNotLeader", err)
+	}
+	if _, _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotLeader) || !errors.Is(err, raft.ErrNotLeader) {
+		t.Errorf("Get on a follower: got %v; want ErrNotLeader", err)
+	}
+}
+
+func TestStoreLeaderNotReady(t *testing.T) {
+	r := newFakeRaft()
+	r.notReady = true
+	s := NewStore(r, r.commitChan)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A leader that just took office can't serve reads yet, but it's still
+	// the leader.
+	if _, _, err := s.Get(ctx, "a"); !errors.Is(err, raft.ErrLeaderNotReady) || errors.Is(err, ErrNotLeader) {
+		t.Errorf("Get on a new leader: got %v; want raft.ErrLeaderNotReady", err)
+	}
+}
+
+// TestStoreCluster runs stores on a 3-server Raft cluster: writes are
+// submitted to the leader and applied by all servers from their commit
+// channels, and a server that fell behind the leader's snapshot is restored
+// from it.
+func TestStoreCluster(t *testing.T) {
+	const n = 3
+	network := raft.NewInmemNetwork()
+	config := raft.DefaultConfig()
+	config.Logger = raft.NopLogger{}
+	// The cut-off server mustn't depose the leader when it's back.
+	config.PreVote = true
+	servers := make([]*raft.Server, n)
+	stores := make([]*Store, n)
+	var snapshotsMu sync.Mutex
+	snapshots := make([]int, n)
+	ready := make(chan interface{})
+	for i := 0; i < n; i++ {
+		var peerIds []int
+		for p := 0; p < n; p++ {
+			if p != i {
+				peerIds = append(peerIds, p)
+			}
+		}
+		commitChan := make(chan raft.CommitEntry, 16)
+		servers[i] = raft.NewServerWithTransport(i, peerIds, raft.NewMapStorage(), ready, commitChan, config, network.Transport(i))
+		if err := servers[i].Serve(); err != nil {
+			t.Fatal(err)
+		}
+		defer servers[i].Shutdown()
+
+		// Count the snapshots every store is restored from on the way.
+		storeChan := make(chan raft.CommitEntry)
+		go func(i int) {
+			for entry := range commitChan {
+				if entry.IsSnapshot {
+					snapshotsMu.Lock()
+					snapshots[i]++
+					snapshotsMu.Unlock()
+				}
+				storeChan <- entry
+			}
+		}(i)
+		stores[i] = NewStore(servers[i], storeChan)
+	}
+	close(ready)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := NewClient(1, stores)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		if err := client.Put(ctx, kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := client.Get(ctx, "a"); err != nil || !ok || value != "1" {
+		t.Errorf("Get(a) = %q, %v, %v; want 1", value, ok, err)
+	}
+	if _, ok, err := client.Get(ctx, "b"); err != nil || ok {
+		t.Errorf("Get(b) = %v, %v; want it deleted", ok, err)
+	}
+
+	// A server cut off from the others misses a write, which the leader
+	// then compacts into a snapshot.
+	leaderId := -1
+	for i, s := range servers {
+		if s.IsLeader() {
+			leaderId = i
+		}
+	}
+	lagging := (leaderId + 1) % n
+	network.Partition(lagging)
+	if err := client.Put(ctx, "d", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[leaderId].Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	network.Heal()
+
+	// Every store ends up with the same data, the lagging one by restoring
+	// the leader's snapshot.
+	want := map[string]string{"a": "1", "c": "3", "d": "4"}
+	lastApplied := stores[leaderId].LastApplied()
+	for i, s := range stores {
+		for s.LastApplied() < lastApplied {
+			if ctx.Err() != nil {
+				t.Fatalf("store %d applied up to %d; want %d", i, s.LastApplied(), lastApplied)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		s.mu.Lock()
+		if fmt.Sprint(s.data) != fmt.Sprint(want) {
+			t.Errorf("store %d has %v; want %v", i, s.data, want)
+		}
+		s.mu.Unlock()
+	}
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	if snapshots[lagging] != 1 {
+		t.Errorf("lagging store %d restored %d snapshots; want 1", lagging, snapshots[lagging])
+	}
+}
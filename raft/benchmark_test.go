@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkCommit measures commit throughput and latency end to end, through
+// Submit, replication and commit, on a 3-server cluster connected by an
+// InmemNetwork, for several entry sizes and numbers of concurrent clients.
+// Every client waits for its command to commit before submitting the next
+// one. Besides ns/op, it reports commits/s and the p50 and p99 latency from
+// Submit to commit on the leader. MapStorage encodes the whole log on every
+// Submit, so compare runs at the same -benchtime, e.g. -benchtime=2000x.
+func BenchmarkCommit(b *testing.B) {
+	for _, entrySize := range []int{128, 4096} {
+		for _, concurrency := range []int{1, 16} {
+			b.Run(fmt.Sprintf("EntrySize=%d/Concurrency=%d", entrySize, concurrency), func(b *testing.B) {
+				benchmarkCommit(b, entrySize, concurrency)
+			})
+		}
+	}
+}
+
+func benchmarkCommit(b *testing.B, entrySize, concurrency int) {
+	config := DefaultConfig()
+	config.Logger = NopLogger{}
+	h := NewHarnessWithNetwork(b, 3, config, NewInmemNetwork())
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	cm := h.cluster[leaderId].cm
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	command := make([]byte, entrySize)
+	var mu sync.Mutex
+	latencies := make([]time.Duration, 0, b.N)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for c := 0; c < concurrency; c++ {
+		count := b.N / concurrency
+		if c < b.N%concurrency {
+			count++
+		}
+		wg.Add(1)
+		go func(count int) {
+			defer wg.Done()
+			for k := 0; k < count; k++ {
+				submitted := time.Now()
+				index, _, isLeader := cm.Submit(command)
+				if !isLeader {
+					b.Errorf("server %d lost leadership", leaderId)
+					return
+				}
+				if err := cm.WaitForCommit(ctx, index); err != nil {
+					b.Error(err)
+					return
+				}
+				mu.Lock()
+				latencies = append(latencies, time.Since(submitted))
+				mu.Unlock()
+			}
+		}(count)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) float64 {
+		return float64(latencies[(len(latencies)-1)*p/100].Nanoseconds())
+	}
+	b.ReportMetric(float64(len(latencies))/b.Elapsed().Seconds(), "commits/s")
+	b.ReportMetric(percentile(50), "p50-ns")
+	b.ReportMetric(percentile(99), "p99-ns")
+}
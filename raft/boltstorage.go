@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"fmt"
+	"log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket holding all of a BoltStorage's keys.
+var boltBucket = []byte("raft")
+
+// BoltStorage is a Storage backed by a bbolt database file, so the CM's
+// persistent state survives restarts. Every Set is its own transaction, which
+// bbolt fsyncs before Set returns, unless syncing is turned off with SetSync.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens the bbolt database at path, creating it if it doesn't
+// exist yet; a newly created database has no data.
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open bolt storage %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bucket in bolt storage %s: %w", path, err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// Close closes the underlying database. The BoltStorage can't be used after
+// Close.
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// SetSync sets whether writes are fsynced before they return; they are by
+// default. Without syncing, a write that returned stays in the OS page cache
+// until the OS flushes it, usually within 30 seconds on Linux: writes within
+// that window survive a crash of the process, but are lost if the machine
+// crashes or loses power. It must not be called concurrently with writes.
+func (bs *BoltStorage) SetSync(sync bool) {
+	bs.db.NoSync = !sync
+}
+
+func (bs *BoltStorage) Get(key string) ([]byte, bool) {
+	var value []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		// Values returned by bbolt are only valid within the transaction.
+		if v := tx.Bucket(boltBucket).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("bolt storage get %q: %v", key, err)
+	}
+	return value, value != nil
+}
+
+// Set stores value under key. Storage has no way to report errors, and the CM
+// can't go on safely when its state isn't persisted, so a failed write is
+// fatal.
+func (bs *BoltStorage) Set(key string, value []byte) {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+	if err != nil {
+		log.Fatalf("bolt storage set %q: %v", key, err)
+	}
+}
+
+func (bs *BoltStorage) HasData() bool {
+	hasData := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(boltBucket).Cursor().First()
+		hasData = k != nil
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("bolt storage: %v", err)
+	}
+	return hasData
+}
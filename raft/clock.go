@@ -0,0 +1,143 @@
+package raft
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a ConsensusModule. All of the CM's timing
+// (election timeouts, heartbeats, leases) goes through its Clock, so tests
+// can substitute a FakeClock and drive time manually.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the subset of *time.Ticker used by a ConsensusModule.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is a Clock backed by the time package.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (rt realTicker) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTicker) Stop() {
+	rt.t.Stop()
+}
+
+// FakeClock is a Clock whose time only moves when Advance is called. Timers
+// and tickers created from it fire during Advance, in deadline order.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a pending After channel or Ticker of a FakeClock. period is
+// zero for one-shot timers.
+type fakeTimer struct {
+	deadline time.Time
+	period   time.Duration
+	ch       chan time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{deadline: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t.ch
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{deadline: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return &fakeTicker{clock: c, timer: t}
+}
+
+// Advance moves the clock forward by d, firing all timers and ticks that
+// become due on the way. Like a *time.Ticker, a fake ticker drops ticks if
+// its channel wasn't drained.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			return c.timers[i].deadline.Before(c.timers[j].deadline)
+		})
+		if len(c.timers) == 0 || c.timers[0].deadline.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.now = t.deadline
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			t.deadline = t.deadline.Add(t.period)
+		} else {
+			c.timers = c.timers[1:]
+		}
+	}
+	c.now = end
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	timer *fakeTimer
+}
+
+func (ft *fakeTicker) C() <-chan time.Time {
+	return ft.timer.ch
+}
+
+func (ft *fakeTicker) Stop() {
+	ft.clock.mu.Lock()
+	defer ft.clock.mu.Unlock()
+	for i, t := range ft.clock.timers {
+		if t == ft.timer {
+			ft.clock.timers = append(ft.clock.timers[:i], ft.clock.timers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// Codec serializes the commands clients submit, see Config.Codec.
+// Implementations must be safe for concurrent use.
+type Codec interface {
+	Encode(command interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// encodedCommand is a client command serialized by the configured Codec. It's
+// what the log holds in place of the command, so storages and transports
+// only ever see bytes; commands are decoded again just before they're
+// delivered on the commit channel.
+type encodedCommand struct {
+	Data []byte
+}
+
+func init() {
+	gob.Register(encodedCommand{})
+}
+
+// encodeCommand returns what the log holds for command: command itself
+// without a Codec, and for Raft's own commands, otherwise command encoded
+// into an encodedCommand.
+func (cm *ConsensusModule) encodeCommand(command interface{}) (interface{}, error) {
+	if cm.config.Codec == nil || isInternalCommand(command) {
+		return command, nil
+	}
+	if _, ok := command.(encodedCommand); ok {
+		// Already encoded by the follower that forwarded it.
+		return command, nil
+	}
+	data, err := cm.config.Codec.Encode(command)
+	if err != nil {
+		return nil, err
+	}
+	return encodedCommand{Data: data}, nil
+}
+
+// decodeCommand undoes encodeCommand. Commands that aren't encoded, for
+// example from a log written before a Codec was configured, are returned as
+// is.
+func (cm *ConsensusModule) decodeCommand(command interface{}) (interface{}, error) {
+	ec, ok := command.(encodedCommand)
+	if !ok {
+		return command, nil
+	}
+	if cm.config.Codec == nil {
+		return nil, fmt.Errorf("command encoded with a Codec, but none is configured")
+	}
+	return cm.config.Codec.Decode(ec.Data)
+}
@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// jsonCodec is a Codec that serializes commands as JSON; they come back as
+// the generic types encoding/json decodes into.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var command interface{}
+	err := json.Unmarshal(data, &command)
+	return command, err
+}
+
+// setCommand is a command type that is not registered with gob.
+type setCommand struct {
+	Key   string
+	Value int
+}
+
+func TestCodec(t *testing.T) {
+	config := DefaultConfig()
+	config.Codec = jsonCodec{}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	// One command goes straight to the leader, the other is forwarded to it
+	// by a follower.
+	leaderId, _ := h.CheckSingleLeader()
+	if _, _, err := h.cluster[leaderId].Propose(setCommand{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.cluster[(leaderId+1)%3].Propose(setCommand{"b", 2}); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(250)
+
+	want := []interface{}{
+		map[string]interface{}{"Key": "a", "Value": 1.0},
+		map[string]interface{}{"Key": "b", "Value": 2.0},
+	}
+	for i := 0; i < 3; i++ {
+		var got []interface{}
+		for _, commit := range h.Commits(i) {
+			got = append(got, commit.Command)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("server %d committed %v; want %v", i, got, want)
+		}
+
+		// The log only holds the encoded commands.
+		cm := h.cluster[i].cm
+		cm.mu.Lock()
+		for _, entry := range cm.log {
+			if _, ok := entry.Command.(setCommand); ok {
+				t.Errorf("server %d: log holds %#v unencoded", i, entry.Command)
+			}
+		}
+		cm.mu.Unlock()
+	}
+}
@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrSnapshotChecksum is returned when a snapshot is corrupt, because it was
+// damaged on disk or in transfer: its header is malformed, or the snapshot
+// doesn't match the checksum in it.
+var ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// SnapshotCompressor compresses snapshots before they're stored and sent to
+// followers. The id of the compressor is stored along with every snapshot it
+// compressed, so a server can decode snapshots made with any compressor it
+// knows of: GzipCompressor, and the one in its own Config.
+type SnapshotCompressor interface {
+	// ID identifies the compression algorithm. IDs below 16 are reserved for
+	// the compressors of this package.
+	ID() byte
+
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Compression algorithm ids. compressionNone is for snapshots stored as is.
+const (
+	compressionNone byte = 0
+	compressionGzip byte = 1
+)
+
+// GzipCompressor is a SnapshotCompressor using gzip. Level is a gzip
+// compression level; zero selects gzip.DefaultCompression.
+type GzipCompressor struct {
+	Level int
+}
+
+func (GzipCompressor) ID() byte { return compressionGzip }
+
+func (c GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// snapshotMagic starts the header of every snapshot the CM stores or sends,
+// followed by the header version, the id of the compression algorithm and the
+// CRC32 (IEEE) of the first 6 bytes of the header and of the rest of the
+// snapshot.
+var snapshotMagic = []byte("RSNP")
+
+const (
+	snapshotHeaderVersion = 2
+	snapshotHeaderSize    = 10
+)
+
+// encodeSnapshot prepends the snapshot header to the client's snapshot, and
+// compresses it with the configured compressor, if any. If compression fails,
+// the snapshot is stored uncompressed.
+func (cm *ConsensusModule) encodeSnapshot(snapshot []byte) []byte {
+	algorithm := compressionNone
+	payload := snapshot
+	if c := cm.config.SnapshotCompressor; c != nil {
+		if compressed, err := c.Compress(snapshot); err == nil {
+			algorithm = c.ID()
+			payload = compressed
+		} else {
+			cm.wlog("compressing snapshot, storing it uncompressed: %v", err)
+		}
+	}
+	blob := make([]byte, 0, snapshotHeaderSize+len(payload))
+	blob = append(blob, snapshotMagic...)
+	blob = append(blob, snapshotHeaderVersion, algorithm)
+	blob = binary.BigEndian.AppendUint32(blob, snapshotChecksum(blob, payload))
+	return append(blob, payload...)
+}
+
+// snapshotChecksum returns the checksum of a snapshot with the given header,
+// up to the checksum, and payload.
+func snapshotChecksum(header, payload []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, payload)
+}
+
+// decodeSnapshot returns the client's snapshot from a snapshot made by
+// encodeSnapshot, on this server or another one. It returns an error matching
+// ErrSnapshotChecksum if the snapshot is corrupt; a header of another version
+// counts as corrupt, since the checksum can't be verified.
+func (cm *ConsensusModule) decodeSnapshot(blob []byte) ([]byte, error) {
+	if len(blob) < snapshotHeaderSize {
+		return nil, fmt.Errorf("%w: truncated header", ErrSnapshotChecksum)
+	}
+	if !bytes.Equal(blob[:len(snapshotMagic)], snapshotMagic) {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrSnapshotChecksum, blob[:len(snapshotMagic)])
+	}
+	if version := blob[4]; version != snapshotHeaderVersion {
+		return nil, fmt.Errorf("%w: unknown header version %d", ErrSnapshotChecksum, version)
+	}
+	algorithm := blob[5]
+	payload := blob[snapshotHeaderSize:]
+	if want, got := binary.BigEndian.Uint32(blob[6:snapshotHeaderSize]), snapshotChecksum(blob[:6], payload); want != got {
+		return nil, fmt.Errorf("%w: header has %08x, data has %08x", ErrSnapshotChecksum, want, got)
+	}
+	switch {
+	case algorithm == compressionNone:
+		return payload, nil
+	case cm.config.SnapshotCompressor != nil && algorithm == cm.config.SnapshotCompressor.ID():
+		return cm.config.SnapshotCompressor.Decompress(payload)
+	case algorithm == compressionGzip:
+		return GzipCompressor{}.Decompress(payload)
+	}
+	return nil, fmt.Errorf("unknown snapshot compression algorithm %d", algorithm)
+}
@@ -0,0 +1,179 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// reverseCompressor is a SnapshotCompressor that "compresses" by reversing
+// the data.
+type reverseCompressor struct{}
+
+func (reverseCompressor) ID() byte { return 100 }
+
+func (reverseCompressor) Compress(data []byte) ([]byte, error) {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed, nil
+}
+
+func (c reverseCompressor) Decompress(data []byte) ([]byte, error) {
+	return c.Compress(data)
+}
+
+func TestSnapshotCompression(t *testing.T) {
+	snapshot := bytes.Repeat([]byte("key=value;"), 1000)
+	plain := newIdleCM(t, nil)
+	config := DefaultConfig()
+	config.SnapshotCompressor = GzipCompressor{}
+	gzipped := newIdleCM(t, config)
+	config = DefaultConfig()
+	config.SnapshotCompressor = reverseCompressor{}
+	reversed := newIdleCM(t, config)
+
+	plainBlob := plain.encodeSnapshot(snapshot)
+	gzipBlob := gzipped.encodeSnapshot(snapshot)
+	reverseBlob := reversed.encodeSnapshot(snapshot)
+	if len(gzipBlob) >= len(snapshot)/10 {
+		t.Errorf("gzipped snapshot has %d bytes, of %d", len(gzipBlob), len(snapshot))
+	}
+
+	// Every server decodes snapshots stored as is and gzipped; the others only
+	// the ones made with the compressor in their config.
+	var tests = []struct {
+		cm     *ConsensusModule
+		blob   []byte
+		wantOK bool
+	}{
+		{plain, plainBlob, true},
+		{plain, gzipBlob, true},
+		{plain, reverseBlob, false},
+		{gzipped, plainBlob, true},
+		{reversed, gzipBlob, true},
+		{reversed, reverseBlob, true},
+	}
+	for i, tt := range tests {
+		data, err := tt.cm.decodeSnapshot(tt.blob)
+		if tt.wantOK && (err != nil || !bytes.Equal(data, snapshot)) {
+			t.Errorf("%d: decoding failed: %v", i, err)
+		}
+		if !tt.wantOK && err == nil {
+			t.Errorf("%d: decoding succeeded; want an error", i)
+		}
+	}
+}
+
+func TestCompressedSnapshotInstall(t *testing.T) {
+	config := DefaultConfig()
+	config.SnapshotCompressor = GzipCompressor{}
+	config.PreVote = true
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	data := bytes.Repeat([]byte("1,2,3,4,5;"), 1000)
+	lagging, index := installLagging(h, data)
+	sleepMs(500)
+
+	commits := h.Commits(lagging)
+	if len(commits) != 1 || !commits[0].IsSnapshot || commits[0].Index != index || !bytes.Equal(commits[0].Snapshot, data) {
+		t.Fatalf("lagging follower committed %v; want the snapshot at %d", commits, index)
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	snapshot := []byte("hello world")
+	blob := cm.encodeSnapshot(snapshot)
+	if data, err := cm.decodeSnapshot(blob); err != nil || !bytes.Equal(data, snapshot) {
+		t.Fatalf("decodeSnapshot = %q, %v; want %q", data, err, snapshot)
+	}
+
+	// Damage anywhere is detected, in the header as well as in the data.
+	var tests = []struct {
+		name    string
+		corrupt func(blob []byte) []byte
+	}{
+		{"magic", func(blob []byte) []byte { blob[0] = 'X'; return blob }},
+		{"version", func(blob []byte) []byte { blob[4] = 1; return blob }},
+		{"compression algorithm", func(blob []byte) []byte { blob[5] = compressionGzip; return blob }},
+		{"checksum", func(blob []byte) []byte { blob[7] ^= 1; return blob }},
+		{"data", func(blob []byte) []byte { blob[len(blob)-1] ^= 1; return blob }},
+		{"truncated header", func(blob []byte) []byte { return blob[:8] }},
+		{"truncated data", func(blob []byte) []byte { return blob[:len(blob)-1] }},
+	}
+	for _, tt := range tests {
+		corrupt := tt.corrupt(append([]byte(nil), blob...))
+		if _, err := cm.decodeSnapshot(corrupt); !errors.Is(err, ErrSnapshotChecksum) {
+			t.Errorf("%s: got error %v; want ErrSnapshotChecksum", tt.name, err)
+		}
+	}
+
+	// There's no format without a checksum: the client's snapshot as is is
+	// corrupt too.
+	if _, err := cm.decodeSnapshot(snapshot); !errors.Is(err, ErrSnapshotChecksum) {
+		t.Errorf("snapshot without header: got error %v; want ErrSnapshotChecksum", err)
+	}
+}
+
+func TestRestoreCorruptSnapshot(t *testing.T) {
+	storage := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.mu.Lock()
+	cm.lastIncludedIndex, cm.lastIncludedTerm = 3, 1
+	cm.snapshot = cm.encodeSnapshot([]byte("state"))
+	cm.persistSnapshot()
+	cm.persistLog()
+	cm.mu.Unlock()
+	cm.Stop()
+
+	commitChan := make(chan CommitEntry, 16)
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Stop()
+	if entry := <-commitChan; !entry.IsSnapshot || !bytes.Equal(entry.Snapshot, []byte("state")) {
+		t.Errorf("restored %+v; want the snapshot", entry)
+	}
+
+	// A stored snapshot with another header version, or without a header,
+	// can't be checked, and isn't restored.
+	blob, _ := storage.Get("snapshot")
+	otherVersion := append([]byte(nil), blob...)
+	otherVersion[4] = 1
+	for _, corrupt := range [][]byte{otherVersion, []byte("state")} {
+		storage.Set("snapshot", corrupt)
+		if _, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil); !errors.Is(err, ErrCorruptStorage) {
+			t.Errorf("snapshot %q: got error %v; want ErrCorruptStorage", corrupt, err)
+		}
+	}
+}
+
+func TestInstallCorruptSnapshot(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	blob := cm.encodeSnapshot([]byte("state"))
+	blob[len(blob)-1] ^= 1
+	args := InstallSnapshotArgs{
+		Term:              1,
+		LeaderId:          1,
+		LastIncludedIndex: 4,
+		LastIncludedTerm:  1,
+		Data:              blob,
+		Done:              true,
+	}
+	var reply InstallSnapshotReply
+	if err := cm.InstallSnapshot(args, &reply); err != nil || !reply.Restart {
+		t.Fatalf("InstallSnapshot: %v, %+v; want a restart", err, reply)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.lastIncludedIndex != -1 {
+		t.Errorf("corrupt snapshot installed at %d", cm.lastIncludedIndex)
+	}
+}
@@ -0,0 +1,366 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config holds the tunable parameters of a ConsensusModule. A zero value in
+// any field selects the default for that field.
+type Config struct {
+	// ElectionTimeoutMin and ElectionTimeoutMax bound the randomized election
+	// timeout: a follower that doesn't hear from a leader for a duration drawn
+	// from [ElectionTimeoutMin, ElectionTimeoutMax) starts an election.
+	// Defaults are 150ms and 300ms.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	// ScaleElectionTimeout widens the spread of the election timeout in
+	// clusters of more than 3 voting servers, in proportion to their number
+	// plus one: with 7 servers, the timeout is drawn from [ElectionTimeoutMin,
+	// ElectionTimeoutMin + 2*(ElectionTimeoutMax-ElectionTimeoutMin)). The
+	// more servers there are, the likelier some of them time out within an
+	// RPC round trip of each other when the leader fails, and split the
+	// vote; widening the spread keeps the expected gap between the first two
+	// timeouts constant, so split votes stay as rare as in a 3-server
+	// cluster. The price is a slightly slower failover when there's no split
+	// vote, as the earliest timeout comes later on average.
+	ScaleElectionTimeout bool
+
+	// Priorities makes servers with a higher priority win elections: it maps
+	// server ids to priorities, and should be the same on every server. A
+	// server whose priority is n below the highest one adds n times the
+	// spread of the election timeout to its election timeouts, so whenever a
+	// server of higher priority is up and eligible, it times out first and
+	// takes over. If it's down, or its log is behind, the others elect a
+	// leader among themselves after these longer timeouts. Servers that
+	// aren't listed have priority 0. Defaults to nil, for no preference.
+	Priorities map[int]int
+
+	// HeartbeatInterval is how often a leader sends heartbeats to followers.
+	// It has to be well below ElectionTimeoutMin (at most a third of it), so
+	// followers don't time out on a healthy leader. Defaults to 50ms.
+	HeartbeatInterval time.Duration
+
+	// RPCTimeout is how long the CM waits for the reply to a RequestVote,
+	// AppendEntries or other RPC to a peer before giving up on it, so a hung
+	// peer doesn't hold up elections or replication. It must be below
+	// ElectionTimeoutMin: a candidate that waits longer for votes than its
+	// election timeout times out before counting them. Defaults to twice
+	// HeartbeatInterval, by when a new round of heartbeats supersedes the
+	// attempt anyway.
+	RPCTimeout time.Duration
+
+	// SnapshotRPCTimeout is like RPCTimeout, for each InstallSnapshot RPC,
+	// which carries a chunk of up to SnapshotChunkSize bytes and may take
+	// much longer. Defaults to 5s.
+	SnapshotRPCTimeout time.Duration
+
+	// MaxEntriesPerAppend bounds the number of log entries a leader sends to
+	// a follower in a single AppendEntries RPC. Defaults to 256.
+	MaxEntriesPerAppend int
+
+	// LogCapacity is the number of entries the CM preallocates room for in
+	// its in-memory log, when it starts and whenever a snapshot compacts the
+	// log, so appending entries doesn't keep growing the backing array. Set
+	// it to about the number of entries expected between two snapshots, e.g.
+	// SnapshotThreshold. Defaults to 0, which allocates as entries come.
+	LogCapacity int
+
+	// MaxLogEntries bounds the number of uncommitted entries in a leader's
+	// log: once it has that many, Submit refuses new commands, and
+	// Server.Propose returns ErrLogFull, until entries commit. This makes
+	// clients back off when the followers can't keep up, instead of the
+	// leader's log growing without bound. Defaults to 0, for no limit.
+	MaxLogEntries int
+
+	// MaxInflightAppends bounds the number of AppendEntries RPCs a leader has
+	// outstanding to a single follower; while a follower has that many
+	// unanswered, rounds of heartbeats skip it. This keeps a slow follower
+	// from piling up goroutines and memory on the leader, which matters most
+	// with Pipeline. Snapshots are always sent to a follower one at a time.
+	// Defaults to 8.
+	MaxInflightAppends int
+
+	// SnapshotChunkSize bounds the size of the chunks a leader sends its
+	// snapshot to a follower in, one InstallSnapshot RPC per chunk. Defaults
+	// to 1MiB.
+	SnapshotChunkSize int
+
+	// SnapshotThreshold and SnapshotFunc make the CM take snapshots by
+	// itself: whenever more than SnapshotThreshold entries were applied
+	// since the latest snapshot, it calls SnapshotFunc with the index of the
+	// latest applied entry (see AckApplied), and compacts its log with the
+	// snapshot it returns, as if the client had called Snapshot. The
+	// snapshot must cover all entries up to that index, and no more; no
+	// entries are delivered until SnapshotFunc returns. If it returns an
+	// error, the CM logs it and tries again after the next delivery. Both
+	// default to off.
+	SnapshotThreshold int
+	SnapshotFunc      func(appliedIndex int) ([]byte, error)
+
+	// AckApplied tells the CM that the client reports the entries it applied
+	// to its state machine with SetLastApplied; the client must then call it
+	// after processing each CommitEntry, including snapshots. Automatic
+	// snapshots, LinearizableRead, Barrier and Health go by the reported
+	// index, so they work with clients that apply entries asynchronously.
+	// Defaults to false, where entries count as applied once they're
+	// delivered on the commit channel.
+	AckApplied bool
+
+	// SnapshotCompressor compresses snapshots before they're stored and sent
+	// to followers. Defaults to none; GzipCompressor is a good choice for
+	// large snapshots.
+	SnapshotCompressor SnapshotCompressor
+
+	// Pipeline lets a leader send further AppendEntries to a follower
+	// without waiting for the replies to earlier ones, which cuts replication
+	// latency on high-latency links. nextIndex is advanced when entries are
+	// sent and moved back if the follower rejects them.
+	Pipeline bool
+
+	// NoSync turns off fsync of storage writes, for storages that support it
+	// (BoltStorage and WALStorage), trading durability for write throughput.
+	// Writes then reach the disk only when the OS flushes them, usually
+	// within 30 seconds on Linux; a machine crash or power loss within that
+	// window loses them, and the server may forget votes it cast and entries
+	// it acknowledged, which breaks Raft's safety guarantees. A crash of just
+	// the process loses nothing. Leave it off unless that's acceptable.
+	NoSync bool
+
+	// Codec serializes the commands clients submit. With a Codec, the leader
+	// encodes every command on Submit, the log holds the encoded bytes in
+	// storage and in RPCs to followers, and every server decodes the command
+	// just before delivering it on the commit channel. This lets clients use
+	// for example JSON or protobuf commands, which don't need to be
+	// registered with gob. All servers of a cluster must use the same Codec.
+	// Snapshots are opaque bytes made by the client, so they're unaffected.
+	// Defaults to none: commands are stored and sent with gob, along with the
+	// rest of the entry.
+	Codec Codec
+
+	// Logger receives the CM's log messages. Defaults to a StdLogger with
+	// debug messages enabled; use NopLogger to silence all logging.
+	Logger Logger
+
+	// CommitStallWarning makes the CM log a warning whenever the commit
+	// channel has been full for that long, which usually means the client's
+	// state machine is stuck. Zero (the default) disables the warning.
+	CommitStallWarning time.Duration
+
+	// EventLogSize is the number of events, such as state and term changes,
+	// the CM keeps in its event log for Events; older events are dropped.
+	// Zero (the default) turns the event log off.
+	EventLogSize int
+
+	// LogEvents makes the CM also log every event of its event log, at info
+	// level. It has no effect if EventLogSize is zero.
+	LogEvents bool
+
+	// OnStateChange, if set, is called whenever the CM's state changes, with
+	// the old and the new state and the term of the change, once per change
+	// and in order; the last call is the change to Dead on Stop. It's called
+	// from a goroutine of its own, without the CM's mutex held, so it may
+	// call back into the CM; by then, the CM may have changed state again.
+	// Defaults to nil.
+	OnStateChange func(old, new CMState, term int)
+
+	// MaxHealthyApplyLag is the number of committed entries a server may
+	// have yet to deliver on the commit channel before Server.Health reports
+	// it unhealthy. Defaults to 1000.
+	MaxHealthyApplyLag int
+
+	// OnRPCSend and OnRPCRecv, if set, are called with every RPC the server
+	// sends to a peer, before it's sent, and with every RPC it receives,
+	// before it's handled; serviceMethod is e.g.
+	// "ConsensusModule.AppendEntries". They're hooks for custom tracing or
+	// record/replay tools. They're called concurrently and with the RPC on
+	// its critical path, so they must be safe for concurrent use, return
+	// quickly and not modify args. Both default to nil.
+	OnRPCSend func(peerId int, serviceMethod string, args interface{})
+	OnRPCRecv func(serviceMethod string, args interface{})
+
+	// Metrics receives the CM's metrics. Defaults to NopMetrics; use a
+	// PrometheusMetrics to expose them to Prometheus.
+	Metrics Metrics
+
+	// Tracer creates tracing spans for commands submitted with
+	// SubmitContext. Defaults to NopTracer, which turns tracing off.
+	Tracer Tracer
+
+	// Clock is the source of time for the CM. Defaults to RealClock; tests may
+	// use a FakeClock to drive time manually.
+	Clock Clock
+
+	// RandSeed seeds the CM's source of randomness for election timeouts, so
+	// tests can reproduce a specific election ordering. The seed is combined
+	// with the CM's id, so servers sharing a Config don't all time out at
+	// once. Zero (the default) seeds it from the current time.
+	RandSeed int64
+
+	// Learner starts the CM as a non-voting learner, with the voting members
+	// passed to the constructor as its peers. It receives log entries but
+	// doesn't campaign until a configuration entry makes it a voter; use it
+	// for servers that will be added with AddLearner.
+	Learner bool
+
+	// CatchUpThreshold is how many entries a learner's log may lag behind the
+	// leader's for PromoteLearner to accept it as caught up. Defaults to 16.
+	CatchUpThreshold int
+
+	// CatchUpRounds bounds how long AddServer replicates the log to a new
+	// server before giving up, in rounds of the maximal election timeout.
+	// Defaults to 10.
+	CatchUpRounds int
+
+	// CheckQuorum makes a leader step down when it doesn't hear from a
+	// majority of the cluster within an election timeout, so a leader stuck
+	// on the minority side of a partition doesn't keep acting as leader. This
+	// makes lease reads safe, at the cost of an occasional needless election
+	// when acknowledgements are slow.
+	CheckQuorum bool
+
+	// GracefulShutdown makes Server.Shutdown of a leader first wait, for at
+	// most a maximal election timeout, until the entries submitted to it are
+	// committed and delivered on its commit channel, and then hand its
+	// leadership over to the most caught-up peer with StepDown, so the
+	// cluster doesn't go without a leader for an election timeout. The
+	// handoff takes at most two maximal election timeouts; if it fails,
+	// Shutdown proceeds anyway. Leave it off for abrupt shutdowns in tests.
+	GracefulShutdown bool
+
+	// PreVote enables the PreVote extension: before starting an election, the
+	// CM checks that a majority of peers would vote for it, without bumping
+	// its term.
+	PreVote bool
+}
+
+// DefaultConfig returns a Config with all fields set to their defaults.
+func DefaultConfig() *Config {
+	const heartbeatInterval = 50 * time.Millisecond
+	return &Config{
+		ElectionTimeoutMin:  150 * time.Millisecond,
+		ElectionTimeoutMax:  300 * time.Millisecond,
+		HeartbeatInterval:   heartbeatInterval,
+		RPCTimeout:          2 * heartbeatInterval,
+		SnapshotRPCTimeout:  5 * time.Second,
+		MaxEntriesPerAppend: 256,
+		MaxInflightAppends:  8,
+		SnapshotChunkSize:   1 << 20,
+		MaxHealthyApplyLag:  1000,
+		CatchUpThreshold:    16,
+		CatchUpRounds:       10,
+		Logger:              NewStdLogger(true),
+		Metrics:             NopMetrics{},
+		Tracer:              NopTracer{},
+		Clock:               RealClock{},
+	}
+}
+
+// withDefaults returns a copy of config with zero fields replaced by their
+// defaults; a nil config yields DefaultConfig.
+func (config *Config) withDefaults() Config {
+	d := DefaultConfig()
+	if config == nil {
+		return *d
+	}
+	c := *config
+	if c.ElectionTimeoutMin == 0 {
+		c.ElectionTimeoutMin = d.ElectionTimeoutMin
+	}
+	if c.ElectionTimeoutMax == 0 {
+		c.ElectionTimeoutMax = d.ElectionTimeoutMax
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = d.HeartbeatInterval
+	}
+	if c.RPCTimeout == 0 {
+		c.RPCTimeout = 2 * c.HeartbeatInterval
+	}
+	if c.SnapshotRPCTimeout == 0 {
+		c.SnapshotRPCTimeout = d.SnapshotRPCTimeout
+	}
+	if c.MaxEntriesPerAppend == 0 {
+		c.MaxEntriesPerAppend = d.MaxEntriesPerAppend
+	}
+	if c.MaxInflightAppends == 0 {
+		c.MaxInflightAppends = d.MaxInflightAppends
+	}
+	if c.SnapshotChunkSize == 0 {
+		c.SnapshotChunkSize = d.SnapshotChunkSize
+	}
+	if c.MaxHealthyApplyLag == 0 {
+		c.MaxHealthyApplyLag = d.MaxHealthyApplyLag
+	}
+	if c.CatchUpThreshold == 0 {
+		c.CatchUpThreshold = d.CatchUpThreshold
+	}
+	if c.CatchUpRounds == 0 {
+		c.CatchUpRounds = d.CatchUpRounds
+	}
+	if c.Logger == nil {
+		c.Logger = d.Logger
+	}
+	if c.Metrics == nil {
+		c.Metrics = d.Metrics
+	}
+	if c.Tracer == nil {
+		c.Tracer = d.Tracer
+	}
+	if c.Clock == nil {
+		c.Clock = d.Clock
+	}
+	return c
+}
+
+// validate checks that the timing parameters are consistent.
+func (c *Config) validate() error {
+	if c.ElectionTimeoutMin <= 0 || c.ElectionTimeoutMin >= c.ElectionTimeoutMax {
+		return fmt.Errorf("invalid election timeout range [%v, %v)", c.ElectionTimeoutMin, c.ElectionTimeoutMax)
+	}
+	if c.HeartbeatInterval <= 0 || c.HeartbeatInterval*3 > c.ElectionTimeoutMin {
+		return fmt.Errorf("heartbeat interval %v must be positive and at most a third of the minimal election timeout %v", c.HeartbeatInterval, c.ElectionTimeoutMin)
+	}
+	if c.RPCTimeout < 0 || c.SnapshotRPCTimeout < 0 {
+		return fmt.Errorf("invalid RPC timeouts %v, %v", c.RPCTimeout, c.SnapshotRPCTimeout)
+	}
+	if c.RPCTimeout >= c.ElectionTimeoutMin {
+		return fmt.Errorf("RPC timeout %v must be below the minimal election timeout %v", c.RPCTimeout, c.ElectionTimeoutMin)
+	}
+	if c.MaxEntriesPerAppend < 0 {
+		return fmt.Errorf("invalid MaxEntriesPerAppend %d", c.MaxEntriesPerAppend)
+	}
+	for id, priority := range c.Priorities {
+		if priority < 0 {
+			return fmt.Errorf("invalid priority %d of server %d", priority, id)
+		}
+	}
+	if c.MaxLogEntries < 0 {
+		return fmt.Errorf("invalid MaxLogEntries %d", c.MaxLogEntries)
+	}
+	if c.LogCapacity < 0 {
+		return fmt.Errorf("invalid LogCapacity %d", c.LogCapacity)
+	}
+	if c.MaxInflightAppends < 0 {
+		return fmt.Errorf("invalid MaxInflightAppends %d", c.MaxInflightAppends)
+	}
+	if c.SnapshotChunkSize < 0 {
+		return fmt.Errorf("invalid SnapshotChunkSize %d", c.SnapshotChunkSize)
+	}
+	if c.SnapshotThreshold < 0 {
+		return fmt.Errorf("invalid SnapshotThreshold %d", c.SnapshotThreshold)
+	}
+	if c.MaxHealthyApplyLag < 0 {
+		return fmt.Errorf("invalid MaxHealthyApplyLag %d", c.MaxHealthyApplyLag)
+	}
+	if c.CatchUpThreshold < 0 {
+		return fmt.Errorf("invalid CatchUpThreshold %d", c.CatchUpThreshold)
+	}
+	if c.CatchUpRounds < 0 {
+		return fmt.Errorf("invalid CatchUpRounds %d", c.CatchUpRounds)
+	}
+	if c.EventLogSize < 0 {
+		return fmt.Errorf("invalid EventLogSize %d", c.EventLogSize)
+	}
+	return nil
+}
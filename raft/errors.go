@@ -0,0 +1,50 @@
+package raft
+
+import "errors"
+
+// Errors returned by the public API, wrapped with more context; match them
+// with errors.Is to decide whether to retry, redirect or give up.
+var (
+	// ErrNotLeader is returned when a server that isn't the leader is asked
+	// to do what only the leader can, or stopped being the leader before
+	// it was done. The client should retry on the leader, see LeaderId.
+	ErrNotLeader = errors.New("not the leader")
+
+	// ErrNoLeader is returned by Server.Propose when no leader is known to
+	// forward the proposal to, e.g. during an election. The client should
+	// retry later.
+	ErrNoLeader = errors.New("no known leader")
+
+	// ErrShutdown is returned when a server, or its connection to the
+	// cluster, was shut down; retrying on the same server won't help. The
+	// methods of a Server also return it before Serve is called.
+	ErrShutdown = errors.New("server is shut down")
+
+	// ErrTimeout is returned when a peer didn't answer an RPC, or the
+	// cluster didn't complete an operation, in time. Retrying may help.
+	ErrTimeout = errors.New("timed out")
+
+	// ErrLogFull is returned by Server.Propose when the leader has
+	// Config.MaxLogEntries uncommitted entries. The client should back off
+	// and retry once entries commit.
+	ErrLogFull = errors.New("log is full")
+
+	// ErrLeaderNotReady is returned by ReadIndex and LeaseRead on a leader
+	// that hasn't committed an entry of its current term yet, so its commit
+	// index may be stale. It resolves within a heartbeat or two of taking
+	// office; the client should retry shortly.
+	ErrLeaderNotReady = errors.New("leader hasn't committed an entry in its term")
+
+	// ErrLeaseExpired is returned by LeaseRead when the leader doesn't hold
+	// a valid lease. The client may retry with ReadIndex.
+	ErrLeaseExpired = errors.New("leader lease expired")
+
+	// ErrConfigChangeInProgress is returned by membership changes while the
+	// previous change isn't committed yet, or the leader has yet to commit
+	// an entry of its own term. The client should retry once it did.
+	ErrConfigChangeInProgress = errors.New("configuration change in progress")
+
+	// ErrPeerClosed is returned by Call when there's no connection to the
+	// peer, because none was made or it was closed.
+	ErrPeerClosed = errors.New("peer connection closed")
+)
@@ -0,0 +1,126 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventStateChange is a change of the CM's state; From and To are the
+	// old and the new state. Becoming leader, and stepping down from it, are
+	// state changes to and from Leader.
+	EventStateChange EventType = iota
+
+	// EventTermChange is a bump of the CM's current term to Term.
+	EventTermChange
+
+	// EventVoteGranted is a vote the CM granted to candidate Peer in Term.
+	EventVoteGranted
+)
+
+// Event is an entry of the CM's event log, see Config.EventLogSize.
+type Event struct {
+	Time time.Time
+	Type EventType
+
+	// Term is the CM's current term after the event.
+	Term int
+
+	// From and To are set for EventStateChange.
+	From CMState
+	To   CMState
+
+	// Peer is set for EventVoteGranted.
+	Peer int
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case EventStateChange:
+		return fmt.Sprintf("%s term=%d state %v -> %v", e.Time.Format(time.RFC3339Nano), e.Term, e.From, e.To)
+	case EventTermChange:
+		return fmt.Sprintf("%s term=%d term change", e.Time.Format(time.RFC3339Nano), e.Term)
+	case EventVoteGranted:
+		return fmt.Sprintf("%s term=%d vote granted to %d", e.Time.Format(time.RFC3339Nano), e.Term, e.Peer)
+	}
+	return fmt.Sprintf("%s term=%d event %d", e.Time.Format(time.RFC3339Nano), e.Term, e.Type)
+}
+
+// Events returns the CM's event log, oldest event first: the latest
+// Config.EventLogSize state changes, term changes and granted votes. Unlike
+// metrics, it keeps the order of what happened, for post-mortems of specific
+// incidents such as a flaky election. It's empty if the event log is off.
+func (cm *ConsensusModule) Events() []Event {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	events := make([]Event, 0, len(cm.events))
+	events = append(events, cm.events[cm.eventsNext:]...)
+	return append(events, cm.events[:cm.eventsNext]...)
+}
+
+// recordEvent adds e to the event log, overwriting the oldest event once the
+// log is full, and logs it if Config.LogEvents is set.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordEvent(e Event) {
+	cm.assertLocked()
+	if cm.config.EventLogSize == 0 {
+		return
+	}
+	e.Time = cm.clock.Now()
+	e.Term = cm.getTerm()
+	if cm.config.LogEvents {
+		cm.ilog("event: %v", e)
+	}
+	if len(cm.events) < cm.config.EventLogSize {
+		cm.events = append(cm.events, e)
+		return
+	}
+	cm.events[cm.eventsNext] = e
+	cm.eventsNext = (cm.eventsNext + 1) % len(cm.events)
+}
+
+// recordStateChange records a change of cm.state from from, and queues it for
+// Config.OnStateChange.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordStateChange(from CMState) {
+	cm.assertLocked()
+	if from == cm.getState() {
+		return
+	}
+	cm.recordEvent(Event{Type: EventStateChange, From: from, To: cm.getState()})
+	if cm.config.OnStateChange != nil {
+		cm.stateChanges = append(cm.stateChanges, stateChange{from: from, to: cm.getState(), term: cm.getTerm()})
+		select {
+		case cm.stateChangeReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stateChange is a state change queued for Config.OnStateChange.
+type stateChange struct {
+	from, to CMState
+	term     int
+}
+
+// stateChangeSender reports the queued state changes to
+// Config.OnStateChange, without holding cm.mu, until it reported the change to
+// Dead. It runs in its own goroutine when OnStateChange is set.
+func (cm *ConsensusModule) stateChangeSender() {
+	for range cm.stateChangeReady {
+		cm.mu.Lock()
+		changes := cm.stateChanges
+		cm.stateChanges = nil
+		cm.mu.Unlock()
+
+		for _, c := range changes {
+			cm.config.OnStateChange(c.from, c.to, c.term)
+			if c.to == Dead {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// logExportVersion is the version of the format ExportLog writes.
+const logExportVersion = 1
+
+// logExportHeader starts every log export. It's followed by the log entries
+// that follow the snapshot, as a []LogEntry.
+type logExportHeader struct {
+	Version int
+
+	// LastIncludedIndex and LastIncludedTerm describe the snapshot the log
+	// follows; both are -1 if there's none. Snapshot is the client's
+	// snapshot, decoded.
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Snapshot          []byte
+
+	// CommitIndex is the commit index of the exporting server; entries past
+	// it may never commit.
+	CommitIndex int
+}
+
+// ExportLog writes this CM's log to w, along with its snapshot and commit
+// index, for offline debugging with ReplayLog. It's a consistent copy of the
+// log at the time of the call; the CM keeps running meanwhile.
+func (cm *ConsensusModule) ExportLog(w io.Writer) error {
+	cm.mu.Lock()
+	header := logExportHeader{
+		Version:           logExportVersion,
+		LastIncludedIndex: cm.lastIncludedIndex,
+		LastIncludedTerm:  cm.lastIncludedTerm,
+		CommitIndex:       cm.getCommitIndex(),
+	}
+	snapshot := cm.snapshot
+	entries := append([]LogEntry(nil), cm.log...)
+	cm.mu.Unlock()
+
+	if header.LastIncludedIndex >= 0 {
+		data, err := cm.decodeSnapshot(snapshot)
+		if err != nil {
+			return fmt.Errorf("decode snapshot: %w", err)
+		}
+		header.Snapshot = data
+	}
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return fmt.Errorf("encode log header: %w", err)
+	}
+	if err := enc.Encode(entries); err != nil {
+		return fmt.Errorf("encode log entries: %w", err)
+	}
+	return nil
+}
+
+// ReplayLog reads a log written by ExportLog from r and feeds what the
+// exporting server had committed to apply, as a commit channel would: first
+// the snapshot, if there's one, then the committed entries that follow it,
+// without Raft's own entries. It stops at the first error apply returns, and
+// returns it. Commands encoded with a Codec are passed to apply as the
+// encoded []byte, since ReplayLog doesn't know the Codec; all other commands
+// have to be registered with gob, as for running the cluster.
+func ReplayLog(r io.Reader, apply func(CommitEntry) error) error {
+	dec := gob.NewDecoder(r)
+	var header logExportHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("decode log header: %w", err)
+	}
+	if header.Version != logExportVersion {
+		return fmt.Errorf("unknown log export version %d", header.Version)
+	}
+	var entries []LogEntry
+	if err := dec.Decode(&entries); err != nil {
+		return fmt.Errorf("decode log entries: %w", err)
+	}
+
+	if header.LastIncludedIndex >= 0 {
+		err := apply(CommitEntry{
+			Index:      header.LastIncludedIndex,
+			Term:       header.LastIncludedTerm,
+			IsSnapshot: true,
+			Snapshot:   header.Snapshot,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i, entry := range entries {
+		index := header.LastIncludedIndex + 1 + i
+		if index > header.CommitIndex {
+			break
+		}
+		if isInternalCommand(entry.Command) {
+			continue
+		}
+		command := entry.Command
+		if ec, ok := command.(encodedCommand); ok {
+			command = ec.Data
+		}
+		if err := apply(CommitEntry{Command: command, Index: index, Term: entry.Term}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestExportReplayLog(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// The leader compacts the first commands into a snapshot, commits more,
+	// and then has one that doesn't commit, with its followers cut off.
+	leaderId, _ := h.CheckSingleLeader()
+	for v := 1; v <= 5; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	snapshotIndex := h.Commits(leaderId)[4].Index
+	h.cluster[leaderId].Snapshot(snapshotIndex, []byte("state"))
+	for v := 6; v <= 8; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	h.DisconnectPeer((leaderId + 1) % 3)
+	h.DisconnectPeer((leaderId + 2) % 3)
+	h.cluster[leaderId].Submit(99)
+	sleepMs(100)
+
+	var buf bytes.Buffer
+	if err := h.cluster[leaderId].cm.ExportLog(&buf); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.Bytes()
+
+	// The replay has the snapshot, then the committed commands after it, as
+	// delivered on the leader's commit channel.
+	var replayed []CommitEntry
+	if err := ReplayLog(bytes.NewReader(export), func(entry CommitEntry) error {
+		replayed = append(replayed, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []CommitEntry{{Index: snapshotIndex, Term: h.Commits(leaderId)[4].Term, IsSnapshot: true, Snapshot: []byte("state")}}
+	want = append(want, h.Commits(leaderId)[5:]...)
+	if len(replayed) != len(want) {
+		t.Fatalf("replayed %v; want %v", replayed, want)
+	}
+	for i := range want {
+		got := replayed[i]
+		if got.Index != want[i].Index || got.Term != want[i].Term || got.Command != want[i].Command ||
+			got.IsSnapshot != want[i].IsSnapshot || !bytes.Equal(got.Snapshot, want[i].Snapshot) {
+			t.Errorf("replayed entry %d is %+v; want %+v", i, got, want[i])
+		}
+	}
+
+	// The first error of apply stops the replay.
+	errStop := errors.New("stop")
+	n := 0
+	err := ReplayLog(bytes.NewReader(export), func(entry CommitEntry) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Errorf("ReplayLog returned %v after %d entries; want the error of apply after 1", err, n)
+	}
+}
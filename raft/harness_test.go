@@ -0,0 +1,447 @@
+package raft
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkLeaderTimeout bounds how long the Harness waits for a single leader to
+// emerge, and checkLeaderInterval is how often it polls the cluster meanwhile.
+const (
+	checkLeaderTimeout  = 2 * time.Second
+	checkLeaderInterval = 150 * time.Millisecond
+)
+
+// Harness runs a cluster of Servers connected into a full mesh, for tests.
+// Every server has its own MapStorage, which survives CrashPeer, and the
+// harness collects all it commits.
+type Harness struct {
+	mu sync.Mutex
+
+	// cluster is a list of all the raft servers participating in a cluster.
+	cluster []*Server
+	storage []*MapStorage
+	config  *Config
+
+	// tlsConfig, if not nil, returns the TLS config of every server.
+	tlsConfig func(id int) *tls.Config
+
+	// network, if not nil, connects the servers instead of TCP; see
+	// NewHarnessWithNetwork.
+	network *InmemNetwork
+
+	// commitChans has a channel per server in cluster with the commit channel
+	// for that server, and commits the entries received on it so far.
+	commitChans []chan CommitEntry
+	commits     [][]CommitEntry
+
+	// connected has a bool per server in cluster, specifying whether this
+	// server is currently connected to peers (if false, it's partitioned and
+	// no messages will pass to or from it). alive is false for servers that
+	// were crashed with CrashPeer.
+	connected []bool
+	alive     []bool
+
+	// quit is closed on Shutdown to stop collecting commits.
+	quit chan struct{}
+
+	n int
+	t testing.TB
+}
+
+// NewHarness creates a new test Harness, initialized with n servers connected
+// to each other.
+func NewHarness(t testing.TB, n int) *Harness {
+	return NewHarnessWithConfig(t, n, nil)
+}
+
+// NewHarnessWithConfig is like NewHarness, but creates all servers with
+// config; nil uses the defaults.
+func NewHarnessWithConfig(t testing.TB, n int, config *Config) *Harness {
+	return newHarness(t, n, harnessOptions{config: config})
+}
+
+// NewHarnessWithStorage is like NewHarnessWithConfig, but starts server i on
+// storage[i] instead of an empty MapStorage, e.g. one set up with
+// BootstrapCluster.
+func NewHarnessWithStorage(t testing.TB, storage []*MapStorage, config *Config) *Harness {
+	return newHarness(t, len(storage), harnessOptions{config: config, storage: storage})
+}
+
+// NewHarnessWithTLS is like NewHarness, but the servers talk to each other
+// over TLS, server id with tlsConfig(id).
+func NewHarnessWithTLS(t testing.TB, n int, tlsConfig func(id int) *tls.Config) *Harness {
+	return newHarness(t, n, harnessOptions{tlsConfig: tlsConfig})
+}
+
+// NewHarnessWithNetwork is like NewHarnessWithConfig, but the servers talk to
+// each other over network. The checks and SubmitToLeader work as usual, but
+// DisconnectPeer, ReconnectPeer and CrashPeer don't; partition network
+// instead.
+func NewHarnessWithNetwork(t testing.TB, n int, config *Config, network *InmemNetwork) *Harness {
+	return newHarness(t, n, harnessOptions{config: config, network: network})
+}
+
+// harnessOptions are the optional settings of newHarness; storage, if not
+// nil, has the storage of every server.
+type harnessOptions struct {
+	config    *Config
+	tlsConfig func(id int) *tls.Config
+	network   *InmemNetwork
+	storage   []*MapStorage
+}
+
+func newHarness(t testing.TB, n int, opts harnessOptions) *Harness {
+	h := &Harness{
+		cluster:     make([]*Server, n),
+		storage:     make([]*MapStorage, n),
+		config:      opts.config,
+		tlsConfig:   opts.tlsConfig,
+		network:     opts.network,
+		commitChans: make([]chan CommitEntry, n),
+		commits:     make([][]CommitEntry, n),
+		connected:   make([]bool, n),
+		alive:       make([]bool, n),
+		quit:        make(chan struct{}),
+		n:           n,
+		t:           t,
+	}
+	ready := make(chan interface{})
+
+	// Create all Servers in this cluster, assign ids and peer ids.
+	for i := 0; i < n; i++ {
+		if opts.storage != nil {
+			h.storage[i] = opts.storage[i]
+		} else {
+			h.storage[i] = NewMapStorage()
+		}
+		h.startServer(i, ready)
+	}
+
+	// Connect all peers to each other.
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i != j && h.network == nil {
+				if err := h.cluster[i].ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+					t.Fatalf("server %d: connect to peer %d: %v", i, j, err)
+				}
+			}
+		}
+		h.connected[i] = true
+	}
+	close(ready)
+	return h
+}
+
+// startServer creates and starts server id on its storage, with a fresh
+// commit channel.
+func (h *Harness) startServer(id int, ready <-chan interface{}) {
+	peerIds := make([]int, 0)
+	for p := 0; p < h.n; p++ {
+		if p != id {
+			peerIds = append(peerIds, p)
+		}
+	}
+	commitChan := make(chan CommitEntry)
+	h.mu.Lock()
+	h.commitChans[id] = commitChan
+	h.commits[id] = nil
+	h.mu.Unlock()
+
+	if h.network != nil {
+		h.cluster[id] = NewServerWithTransport(id, peerIds, h.storage[id], ready, commitChan, h.config, h.network.Transport(id))
+	} else {
+		h.cluster[id] = NewServer(id, peerIds, h.storage[id], ready, commitChan, h.config)
+	}
+	if h.tlsConfig != nil {
+		h.cluster[id].SetTLSConfig(h.tlsConfig(id))
+	}
+	if err := h.cluster[id].Serve(); err != nil {
+		h.t.Fatalf("server %d: serve: %v", id, err)
+	}
+	h.alive[id] = true
+	go h.collectCommits(id, commitChan)
+}
+
+// Shutdown shuts down all the servers in the harness and waits for them to
+// stop running.
+func (h *Harness) Shutdown() {
+	for i := 0; i < h.n; i++ {
+		h.disconnectAll(i)
+		h.connected[i] = false
+	}
+	for i := 0; i < h.n; i++ {
+		if h.alive[i] {
+			h.alive[i] = false
+			h.cluster[i].Shutdown()
+		}
+	}
+	close(h.quit)
+}
+
+// DisconnectPeer disconnects a server from all other servers in the cluster.
+func (h *Harness) DisconnectPeer(id int) {
+	h.t.Logf("Disconnect %d", id)
+	h.disconnectAll(id)
+	for j := 0; j < h.n; j++ {
+		if j != id {
+			h.cluster[j].DisconnectPeer(id)
+		}
+	}
+	h.connected[id] = false
+}
+
+// disconnectAll closes the connections of server id to all its peers.
+func (h *Harness) disconnectAll(id int) {
+	for j := 0; j < h.n; j++ {
+		if j != id {
+			h.cluster[id].DisconnectPeer(j)
+		}
+	}
+}
+
+// ReconnectPeer connects a server to all other connected servers in the
+// cluster; servers that are disconnected themselves stay cut off from it.
+func (h *Harness) ReconnectPeer(id int) {
+	h.t.Logf("Reconnect %d", id)
+	for j := 0; j < h.n; j++ {
+		if j != id && h.alive[j] && h.connected[j] {
+			if err := h.cluster[id].ReconnectPeer(j); err != nil {
+				h.t.Fatal(err)
+			}
+			if err := h.cluster[j].ReconnectPeer(id); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+	}
+	h.connected[id] = true
+}
+
+// CrashPeer disconnects server id and shuts it down, as if it crashed; its
+// storage is kept for RestartPeer.
+func (h *Harness) CrashPeer(id int) {
+	h.t.Logf("Crash %d", id)
+	h.DisconnectPeer(id)
+	h.alive[id] = false
+	h.cluster[id].Shutdown()
+}
+
+// RestartPeer restarts a crashed server on its storage, and connects it to the
+// other live, connected servers. Its commits are collected anew, as it
+// delivers all committed entries again.
+func (h *Harness) RestartPeer(id int) {
+	if h.alive[id] {
+		h.t.Fatalf("server %d is alive in RestartPeer", id)
+	}
+	h.t.Logf("Restart %d", id)
+	ready := make(chan interface{})
+	h.startServer(id, ready)
+	for j := 0; j < h.n; j++ {
+		if j != id && h.alive[j] && h.connected[j] {
+			if err := h.cluster[id].ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+				h.t.Fatal(err)
+			}
+			if err := h.cluster[j].ConnectToPeer(id, h.cluster[id].GetListenAddr()); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+	}
+	close(ready)
+	h.connected[id] = true
+	sleepMs(20)
+}
+
+// CheckSingleLeader checks that only a single server thinks it's the leader.
+// Returns the leader's id and term. It retries several times if no leader is
+// identified yet, and fails the test if none emerges within
+// checkLeaderTimeout.
+func (h *Harness) CheckSingleLeader() (int, int) {
+	for deadline := time.Now().Add(checkLeaderTimeout); time.Now().Before(deadline); {
+		leaderId := -1
+		leaderTerm := -1
+		for i := 0; i < h.n; i++ {
+			if h.connected[i] {
+				term, isLeader := h.cluster[i].GetState()
+				if isLeader {
+					if leaderId < 0 {
+						leaderId = i
+						leaderTerm = term
+					} else {
+						h.t.Fatalf("both %d and %d think they're leaders", leaderId, i)
+					}
+				}
+			}
+		}
+		if leaderId >= 0 {
+			return leaderId, leaderTerm
+		}
+		time.Sleep(checkLeaderInterval)
+	}
+
+	h.t.Fatalf("leader not found")
+	return -1, -1
+}
+
+// ElectLeader makes server id start an election with CampaignNow, and waits
+// for it to become the single leader; it fails the test if another server
+// wins instead.
+func (h *Harness) ElectLeader(id int) int {
+	if err := h.cluster[id].CampaignNow(); err != nil {
+		h.t.Fatalf("campaign on %d: %v", id, err)
+	}
+	for deadline := time.Now().Add(checkLeaderTimeout); time.Now().Before(deadline); {
+		if term, isLeader := h.cluster[id].GetState(); isLeader {
+			if leaderId, _ := h.CheckSingleLeader(); leaderId != id {
+				h.t.Fatalf("leader is %d; want %d", leaderId, id)
+			}
+			return term
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.t.Fatalf("server %d didn't become leader", id)
+	return -1
+}
+
+// CheckNoLeader checks that no connected server considers itself the leader.
+func (h *Harness) CheckNoLeader() {
+	for i := 0; i < h.n; i++ {
+		if h.connected[i] {
+			if _, isLeader := h.cluster[i].GetState(); isLeader {
+				h.t.Fatalf("server %d leader; want none", i)
+			}
+		}
+	}
+}
+
+// SubmitToLeader waits for a single leader and submits cmd to it. It returns
+// the leader's id and the index cmd was appended at, or fails the test if the
+// leader lost its leadership in the meantime.
+func (h *Harness) SubmitToLeader(cmd interface{}) (int, int) {
+	leaderId, _ := h.CheckSingleLeader()
+	index, _, isLeader := h.cluster[leaderId].Submit(cmd)
+	if !isLeader {
+		h.t.Fatalf("submit %v: server %d is no longer the leader", cmd, leaderId)
+	}
+	return leaderId, index
+}
+
+// Commits returns the entries committed by server id so far.
+func (h *Harness) Commits(id int) []CommitEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]CommitEntry(nil), h.commits[id]...)
+}
+
+// CheckCommitted verifies that all connected servers have cmd committed at
+// the same index, and that they agree on all the entries committed before it.
+// It returns the number of servers that have it and its index, or fails the
+// test.
+func (h *Harness) CheckCommitted(cmd interface{}) (nc int, index int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Find the length of the commits slice for connected servers.
+	commitsLen := -1
+	for i := 0; i < h.n; i++ {
+		if h.connected[i] {
+			if commitsLen >= 0 {
+				// If this was set already, expect the new length to be the same.
+				if len(h.commits[i]) != commitsLen {
+					h.t.Fatalf("commits[%d] = %v, commitsLen = %d", i, h.commits[i], commitsLen)
+				}
+			} else {
+				commitsLen = len(h.commits[i])
+			}
+		}
+	}
+
+	// Check consistency of commits from the start and to the command we're
+	// asked about. This loop will return once a command=cmd is found.
+	for c := 0; c < commitsLen; c++ {
+		cmdAtC := interface{}(nil)
+		for i := 0; i < h.n; i++ {
+			if h.connected[i] {
+				cmdOfN := h.commits[i][c].Command
+				if cmdAtC != nil {
+					if cmdOfN != cmdAtC {
+						h.t.Errorf("got %v, want %v at h.commits[%d][%d]", cmdOfN, cmdAtC, i, c)
+					}
+				} else {
+					cmdAtC = cmdOfN
+				}
+			}
+		}
+		if cmdAtC == cmd {
+			// Check consistency of Index.
+			index := -1
+			nc := 0
+			for i := 0; i < h.n; i++ {
+				if h.connected[i] {
+					if index >= 0 && h.commits[i][c].Index != index {
+						h.t.Errorf("got Index=%d, want %d at h.commits[%d][%d]", h.commits[i][c].Index, index, i, c)
+					} else {
+						index = h.commits[i][c].Index
+					}
+					nc++
+				}
+			}
+			return nc, index
+		}
+	}
+
+	// If there's no early return, we haven't found the command we were
+	// looking for.
+	h.t.Errorf("cmd=%v not found in commits", cmd)
+	return -1, -1
+}
+
+// CheckCommittedN verifies that cmd was committed by exactly n connected
+// servers.
+func (h *Harness) CheckCommittedN(cmd interface{}, n int) {
+	nc, _ := h.CheckCommitted(cmd)
+	if nc != n {
+		h.t.Errorf("CheckCommittedN got nc=%d, want %d", nc, n)
+	}
+}
+
+// CheckNotCommitted verifies that no command equal to cmd has been committed
+// by any of the connected servers.
+func (h *Harness) CheckNotCommitted(cmd interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := 0; i < h.n; i++ {
+		if h.connected[i] {
+			for c := 0; c < len(h.commits[i]); c++ {
+				if h.commits[i][c].Command == cmd {
+					h.t.Errorf("found %v at commits[%d][%d], expected none", cmd, i, c)
+				}
+			}
+		}
+	}
+}
+
+// collectCommits reads commitChan of server i and adds all received entries
+// to the corresponding commits[i]. It's blocking and should be run in a
+// separate goroutine. Entries of an instance of the server that crashed since
+// are dropped. It returns when the harness is shut down.
+func (h *Harness) collectCommits(i int, commitChan chan CommitEntry) {
+	for {
+		select {
+		case c := <-commitChan:
+			h.mu.Lock()
+			if h.commitChans[i] == commitChan {
+				h.commits[i] = append(h.commits[i], c)
+			}
+			h.mu.Unlock()
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+func sleepMs(n int) {
+	time.Sleep(time.Duration(n) * time.Millisecond)
+}
@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthStatus is the health of a Server, as reported by Health.
+type HealthStatus struct {
+	// Role is "follower", "candidate", "leader" or "dead".
+	Role string `json:"role"`
+	Term int    `json:"term"`
+
+	// CommitIndex is the index of the latest entry known to be committed,
+	// and LastApplied that of the latest entry the client applied, see
+	// ConsensusModule.LastApplied. ApplyLag is the difference.
+	CommitIndex int `json:"commit_index"`
+	LastApplied int `json:"last_applied"`
+	ApplyLag    int `json:"apply_lag"`
+
+	// Healthy is false if the server is dead, or if its ApplyLag exceeds
+	// Config.MaxHealthyApplyLag, in which case it shouldn't serve reads.
+	Healthy bool `json:"healthy"`
+}
+
+// Health reports the health of this server, for readiness checks. Before
+// Serve, the server is reported as dead.
+func (s *Server) Health() HealthStatus {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return HealthStatus{Role: roleName(Dead), CommitIndex: -1, LastApplied: -1}
+	}
+	return cm.health()
+}
+
+// health implements Server.Health.
+func (cm *ConsensusModule) health() HealthStatus {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	status := HealthStatus{
+		Role:        roleName(cm.getState()),
+		Term:        cm.getTerm(),
+		CommitIndex: cm.getCommitIndex(),
+		LastApplied: cm.appliedIndex(),
+		ApplyLag:    cm.getCommitIndex() - cm.appliedIndex(),
+	}
+	status.Healthy = cm.getState() != Dead && status.ApplyLag <= cm.config.MaxHealthyApplyLag
+	return status
+}
+
+// PeerStatus is the replication progress of a peer, as seen by the leader and
+// reported by PeerProgress.
+type PeerStatus struct {
+	NextIndex  int `json:"next_index"`
+	MatchIndex int `json:"match_index"`
+
+	// SinceAck is the time since the latest RPC the peer acknowledged was
+	// sent, or -1 if it hasn't acknowledged any in the current term.
+	SinceAck time.Duration `json:"since_ack"`
+}
+
+// PeerProgress returns the replication progress of every peer, learners
+// included, by id, to tell how far behind each one is. It's only meaningful
+// on the leader; the map is empty on other servers.
+func (cm *ConsensusModule) PeerProgress() map[int]PeerStatus {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	progress := make(map[int]PeerStatus)
+	if cm.getState() != Leader {
+		return progress
+	}
+	now := cm.clock.Now()
+	for _, peerId := range cm.replicationTargets() {
+		status := PeerStatus{
+			NextIndex:  cm.nextIndex[peerId],
+			MatchIndex: cm.matchIndex[peerId],
+			SinceAck:   -1,
+		}
+		if ackTime := cm.peerAckTime[peerId]; !ackTime.IsZero() {
+			status.SinceAck = now.Sub(ackTime)
+		}
+		progress[peerId] = status
+	}
+	return progress
+}
+
+// roleName returns the name of state used in HealthStatus.Role.
+func roleName(state CMState) string {
+	for _, s := range stateLabels {
+		if s.state == state {
+			return s.label
+		}
+	}
+	return "unknown"
+}
+
+// HealthHandler returns an http.Handler serving the Health of s as JSON, with
+// status 200 if it's healthy and 503 otherwise, so load balancers can use it
+// as is; register it on e.g. /health:
+//
+//	http.Handle("/health", raft.HealthHandler(server))
+func HealthHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := s.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
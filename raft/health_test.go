@@ -0,0 +1,55 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getHealth serves a GET /health on s with HealthHandler, and returns the
+// status code and the decoded HealthStatus.
+func getHealth(t *testing.T, s *Server) (int, HealthStatus) {
+	rec := httptest.NewRecorder()
+	HealthHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var status HealthStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, status
+}
+
+func TestHealth(t *testing.T) {
+	config := DefaultConfig()
+	config.AckApplied = true
+	config.MaxHealthyApplyLag = 2
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, term := h.CheckSingleLeader()
+	laggingId := (leaderId + 1) % 3
+	var index int
+	for v := 1; v <= 5; v++ {
+		_, index = h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+
+	// The leader's client applied all entries, the lagging follower's none.
+	h.cluster[leaderId].cm.SetLastApplied(index)
+	code, status := getHealth(t, h.cluster[leaderId])
+	want := HealthStatus{Role: "leader", Term: term, CommitIndex: index, LastApplied: index, ApplyLag: 0, Healthy: true}
+	if code != http.StatusOK || status != want {
+		t.Errorf("leader: %d %+v; want %d %+v", code, status, http.StatusOK, want)
+	}
+	code, status = getHealth(t, h.cluster[laggingId])
+	if code != http.StatusServiceUnavailable || status.Role != "follower" || status.ApplyLag != index+1 || status.Healthy {
+		t.Errorf("lagging follower: %d %+v; want it unhealthy with a lag of %d", code, status, index+1)
+	}
+
+	h.CrashPeer(leaderId)
+	code, status = getHealth(t, h.cluster[leaderId])
+	if code != http.StatusServiceUnavailable || status.Role != "dead" || status.Healthy {
+		t.Errorf("crashed server: %d %+v; want it dead", code, status)
+	}
+}
@@ -0,0 +1,243 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InmemNetwork connects a set of InmemTransports into a mesh, routing RPCs
+// between nodes in the same process through channels instead of TCP. It's
+// meant for tests: clusters start instantly, and Partition/Heal simulate
+// network splits deterministically.
+type InmemNetwork struct {
+	mu sync.Mutex
+
+	// inboxes holds the inbox of every node with a registered handler.
+	inboxes map[int]chan *inmemRequest
+
+	// partitioned holds the ids on one side of a partition; nodes can only
+	// talk to nodes on the same side. Empty when the network is healthy.
+	partitioned map[int]bool
+
+	// Unreliability settings; see SetReliability.
+	dropProb float64
+	minDelay time.Duration
+	maxDelay time.Duration
+	rand     *rand.Rand
+}
+
+// inmemRequest is a single RPC in flight on an InmemNetwork. args are already
+// gob-encoded, so that the receiver can't share memory with the sender.
+type inmemRequest struct {
+	serviceMethod string
+	args          []byte
+	reply         interface{}
+	done          chan error
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		inboxes:     make(map[int]chan *inmemRequest),
+		partitioned: make(map[int]bool),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetReliability makes the network unreliable: every request and every reply
+// is dropped with probability dropProb, and each request is delayed by a
+// random duration in [minDelay, maxDelay] before it's delivered. Delays are
+// drawn independently for every request, so requests may be delivered out of
+// order. SetReliability(0, 0, 0) restores a reliable network. It's safe to
+// call at any time, including while RPCs are in flight.
+func (n *InmemNetwork) SetReliability(dropProb float64, minDelay, maxDelay time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropProb = dropProb
+	n.minDelay = minDelay
+	n.maxDelay = maxDelay
+}
+
+// unreliability decides the fate of a single request: how long to delay it,
+// and whether the request or its reply gets dropped.
+// Expects n.mu to be locked.
+func (n *InmemNetwork) unreliability() (delay time.Duration, dropRequest bool, dropReply bool) {
+	delay = n.minDelay
+	if n.maxDelay > n.minDelay {
+		delay += time.Duration(n.rand.Int63n(int64(n.maxDelay - n.minDelay + 1)))
+	}
+	dropRequest = n.rand.Float64() < n.dropProb
+	dropReply = n.rand.Float64() < n.dropProb
+	return delay, dropRequest, dropReply
+}
+
+// Transport returns a new InmemTransport sending RPCs from node id over this
+// network.
+func (n *InmemNetwork) Transport(id int) *InmemTransport {
+	return &InmemTransport{id: id, network: n}
+}
+
+// Register makes handler receive all RPCs sent to node id; handler has to
+// have methods with the signatures net/rpc expects, like RPCProxy. Registering
+// a handler for an id that already has one replaces it.
+func (n *InmemNetwork) Register(id int, handler interface{}) {
+	inbox := make(chan *inmemRequest)
+	n.mu.Lock()
+	if old, ok := n.inboxes[id]; ok {
+		close(old)
+	}
+	n.inboxes[id] = inbox
+	n.mu.Unlock()
+
+	go func() {
+		for req := range inbox {
+			go func(req *inmemRequest) {
+				req.done <- dispatchInmem(handler, req)
+			}(req)
+		}
+	}()
+}
+
+// Unregister removes the handler of node id; RPCs to it fail afterwards.
+func (n *InmemNetwork) Unregister(id int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if inbox, ok := n.inboxes[id]; ok {
+		close(inbox)
+		delete(n.inboxes, id)
+	}
+}
+
+// Partition splits the network in two: the nodes in ids on one side and all
+// other nodes on the other. RPCs across the split fail.
+func (n *InmemNetwork) Partition(ids ...int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitioned = make(map[int]bool)
+	for _, id := range ids {
+		n.partitioned[id] = true
+	}
+}
+
+// Heal undoes Partition, reconnecting all nodes.
+func (n *InmemNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitioned = make(map[int]bool)
+}
+
+// call routes an RPC from node from to node to.
+func (n *InmemNetwork) call(from, to int, serviceMethod string, args interface{}, reply interface{}) error {
+	var argsData bytes.Buffer
+	if err := gob.NewEncoder(&argsData).Encode(args); err != nil {
+		return err
+	}
+	req := &inmemRequest{
+		serviceMethod: serviceMethod,
+		args:          argsData.Bytes(),
+		reply:         reply,
+		done:          make(chan error, 1),
+	}
+
+	n.mu.Lock()
+	delay, dropRequest, dropReply := n.unreliability()
+	n.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if dropRequest {
+		return fmt.Errorf("request from node %d to node %d dropped", from, to)
+	}
+
+	n.mu.Lock()
+	if n.partitioned[from] != n.partitioned[to] {
+		n.mu.Unlock()
+		return fmt.Errorf("node %d is partitioned from node %d", from, to)
+	}
+	inbox, ok := n.inboxes[to]
+	if !ok {
+		n.mu.Unlock()
+		return fmt.Errorf("node %d is not reachable", to)
+	}
+	// The send happens under the lock so the inbox can't be closed
+	// concurrently; its dispatcher hands requests off right away.
+	inbox <- req
+	n.mu.Unlock()
+
+	err := <-req.done
+	if dropReply {
+		return fmt.Errorf("reply from node %d to node %d dropped", to, from)
+	}
+	return err
+}
+
+// dispatchInmem decodes req's args, invokes the matching method of handler and
+// copies the result into req.reply.
+func dispatchInmem(handler interface{}, req *inmemRequest) error {
+	dot := strings.LastIndex(req.serviceMethod, ".")
+	method := reflect.ValueOf(handler).MethodByName(req.serviceMethod[dot+1:])
+	if !method.IsValid() {
+		return fmt.Errorf("can't find method %s", req.serviceMethod)
+	}
+
+	args := reflect.New(method.Type().In(0))
+	if err := gob.NewDecoder(bytes.NewReader(req.args)).DecodeValue(args); err != nil {
+		return err
+	}
+	reply := reflect.New(method.Type().In(1).Elem())
+	out := method.Call([]reflect.Value{args.Elem(), reply})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return err
+	}
+
+	var replyData bytes.Buffer
+	if err := gob.NewEncoder(&replyData).EncodeValue(reply); err != nil {
+		return err
+	}
+	return gob.NewDecoder(&replyData).Decode(req.reply)
+}
+
+// InmemTransport is a Transport sending RPCs over an InmemNetwork; create one
+// with InmemNetwork.Transport.
+type InmemTransport struct {
+	id      int
+	network *InmemNetwork
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// RegisterHandler registers handler with the network to receive the RPCs
+// sent to this transport's node. A Server calls it from Serve with its
+// RPCProxy.
+func (t *InmemTransport) RegisterHandler(handler interface{}) {
+	t.network.Register(t.id, handler)
+}
+
+func (t *InmemTransport) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return fmt.Errorf("call client %d: %w", id, ErrPeerClosed)
+	}
+	return t.network.call(t.id, id, serviceMethod, args, reply)
+}
+
+// Close stops this transport: it can't send RPCs anymore and its node stops
+// receiving them.
+func (t *InmemTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.network.Unregister(t.id)
+	}
+	return nil
+}
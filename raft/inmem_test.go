@@ -0,0 +1,44 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnreliableNetwork(t *testing.T) {
+	network := NewInmemNetwork()
+	config := DefaultConfig()
+	config.Logger = NopLogger{}
+	h := NewHarnessWithNetwork(t, 3, config, network)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	// With RPCs and replies dropped, delayed and reordered, every command
+	// still commits everywhere, once and in order. A lost leadership only
+	// makes the command be submitted again.
+	network.SetReliability(0.1, 0, 5*time.Millisecond)
+	for v := 1; v <= 20; v++ {
+		for {
+			leaderId, _ := h.CheckSingleLeader()
+			if _, _, isLeader := h.cluster[leaderId].Submit(v); isLeader {
+				break
+			}
+		}
+		sleepMs(10)
+	}
+	sleepMs(500)
+	network.SetReliability(0, 0, 0)
+	sleepMs(250)
+
+	prevIndex := -1
+	for v := 1; v <= 20; v++ {
+		nc, index := h.CheckCommitted(v)
+		if nc != 3 {
+			t.Errorf("%d committed on %d servers; want 3", v, nc)
+		}
+		if index <= prevIndex {
+			t.Errorf("%d committed at index %d, after index %d", v, index, prevIndex)
+		}
+		prevIndex = index
+	}
+}
@@ -0,0 +1,7 @@
+//go:build raftdebug
+
+package raft
+
+// lockChecks turns on assertLocked; it's set in builds with the raftdebug
+// tag, e.g. go test -race -tags raftdebug ./...
+const lockChecks = true
@@ -0,0 +1,56 @@
+//go:build raftdebug
+
+package raft
+
+import "testing"
+
+// Run with go test -race -tags raftdebug ./raft.
+func TestAssertLocked(t *testing.T) {
+	// An idle CM has no goroutine of its own holding cm.mu, so a helper
+	// called without the lock always panics, before it touches the CM.
+	cm := newIdleCM(t, nil)
+	var tests = []struct {
+		name string
+		call func()
+	}{
+		{"lastLogIndexAndTerm", func() { cm.lastLogIndexAndTerm() }},
+		{"appliedIndex", func() { cm.appliedIndex() }},
+		{"hasActiveLeader", func() { cm.hasActiveLeader() }},
+		{"isLogUpToDate", func() { cm.isLogUpToDate(0, 1) }},
+		{"logIndexToSlice", func() { cm.logIndexToSlice(0) }},
+		{"persistLog", func() { cm.persistLog() }},
+		{"submit", func() { cm.submit(42) }},
+		{"getState", func() { cm.getState() }},
+		{"setState", func() { cm.setState(Follower) }},
+		{"getTerm", func() { cm.getTerm() }},
+		{"setTerm", func() { cm.setTerm(0) }},
+		{"getCommitIndex", func() { cm.getCommitIndex() }},
+		{"setCommitIndex", func() { cm.setCommitIndex(-1) }},
+		{"learnerCaughtUp", func() { cm.learnerCaughtUp(1) }},
+	}
+	for _, tt := range tests {
+		panicked := func() (panicked bool) {
+			defer func() {
+				panicked = recover() != nil
+			}()
+			tt.call()
+			return false
+		}()
+		if !panicked {
+			t.Errorf("%s without cm.mu didn't panic", tt.name)
+		}
+
+		cm.mu.Lock()
+		tt.call()
+		cm.mu.Unlock()
+	}
+
+	// A cluster runs with the checks on: none of its code paths calls a
+	// helper without the lock.
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+}
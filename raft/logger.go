@@ -0,0 +1,58 @@
+package raft
+
+import "log"
+
+// LogFields are the structured fields attached to every message a
+// ConsensusModule logs.
+type LogFields struct {
+	// Id is the id of the logging node.
+	Id int
+
+	// Term is the node's current term when the message was logged.
+	Term int
+}
+
+// Logger is the interface a ConsensusModule logs through. Implementations
+// must be safe for concurrent use.
+type Logger interface {
+	Debugf(fields LogFields, format string, args ...interface{})
+	Infof(fields LogFields, format string, args ...interface{})
+	Warnf(fields LogFields, format string, args ...interface{})
+}
+
+// StdLogger is a Logger backed by a standard library *log.Logger. Debug
+// messages are only logged if Debug is true.
+type StdLogger struct {
+	Logger *log.Logger
+	Debug  bool
+}
+
+// NewStdLogger returns a StdLogger writing to the standard logger.
+func NewStdLogger(debug bool) *StdLogger {
+	return &StdLogger{Logger: log.Default(), Debug: debug}
+}
+
+func (l *StdLogger) Debugf(fields LogFields, format string, args ...interface{}) {
+	if l.Debug {
+		l.logf("DEBUG", fields, format, args...)
+	}
+}
+
+func (l *StdLogger) Infof(fields LogFields, format string, args ...interface{}) {
+	l.logf("INFO", fields, format, args...)
+}
+
+func (l *StdLogger) Warnf(fields LogFields, format string, args ...interface{}) {
+	l.logf("WARN", fields, format, args...)
+}
+
+func (l *StdLogger) logf(level string, fields LogFields, format string, args ...interface{}) {
+	l.Logger.Printf("%s [id=%d term=%d] "+format, append([]interface{}{level, fields.Id, fields.Term}, args...)...)
+}
+
+// NopLogger is a Logger that discards all messages.
+type NopLogger struct{}
+
+func (NopLogger) Debugf(fields LogFields, format string, args ...interface{}) {}
+func (NopLogger) Infof(fields LogFields, format string, args ...interface{})  {}
+func (NopLogger) Warnf(fields LogFields, format string, args ...interface{})  {}
@@ -0,0 +1,418 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+func init() {
+	gob.Register(ConfigEntry{})
+}
+
+// ConfigEntry is the command of a log entry that changes the cluster
+// membership. Servers lists the ids of all voting members of the new
+// configuration, and Learners the ids of non-voting members. Configuration
+// entries take effect as soon as they're appended to a log (not when
+// committed), and are consumed by the CM itself; they're never delivered on
+// the commit channel.
+//
+// OldServers is only set in the joint configuration C_old,new that
+// ChangeConfiguration goes through: it lists the voting members of C_old,
+// while Servers lists those of C_new. Elections and commits then need a
+// majority of both.
+type ConfigEntry struct {
+	Servers    []int
+	Learners   []int
+	OldServers []int
+}
+
+// AddServer adds server id to the cluster configuration as a voting member.
+// It can only be called on the leader, and only one configuration change can
+// be in progress at a time: an error matching ErrConfigChangeInProgress is
+// returned if a previous change isn't committed yet, or if the leader hasn't
+// committed an entry of its current term yet. The caller is responsible for connecting the new server to
+// the cluster's transport before calling AddServer.
+//
+// So that a far-behind server doesn't stall commits that would need its
+// acknowledgement, it's first added as a learner, and only promoted to voter
+// once its log stayed within Config.CatchUpThreshold entries of the leader's
+// for a whole round of the maximal election timeout. If it doesn't catch up
+// within Config.CatchUpRounds rounds, it's removed again and an error
+// matching ErrTimeout is returned. AddServer blocks until then.
+func (cm *ConsensusModule) AddServer(id int) error {
+	if err := cm.AddLearner(id); err != nil {
+		return err
+	}
+	if err := cm.catchUp(id); err != nil {
+		if removeErr := cm.RemoveServer(id); removeErr != nil {
+			cm.wlog("removing learner %d that didn't catch up: %v", id, removeErr)
+		}
+		return fmt.Errorf("add server %d: %w", id, err)
+	}
+	return cm.PromoteLearner(id)
+}
+
+// catchUp waits until learner id is caught up enough for PromoteLearner, and
+// the configuration that added it is committed, for at most
+// Config.CatchUpRounds rounds of the maximal election timeout. The learner
+// has to stay caught up for a whole round, so one that acknowledged a short
+// log once, and then fell behind or went away, isn't promoted.
+func (cm *ConsensusModule) catchUp(id int) error {
+	cm.mu.Lock()
+	savedCurrentTerm := cm.getTerm()
+	cm.mu.Unlock()
+
+	ticker := cm.clock.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var caughtUpSince time.Time
+	for round := 1; round <= cm.config.CatchUpRounds; round++ {
+		deadline := cm.clock.Now().Add(cm.config.ElectionTimeoutMax)
+		for {
+			cm.mu.Lock()
+			if cm.getState() != Leader || cm.getTerm() != savedCurrentTerm {
+				cm.mu.Unlock()
+				return fmt.Errorf("lost leadership while %d was catching up: %w", id, ErrNotLeader)
+			}
+			lastLogIndex, _ := cm.lastLogIndexAndTerm()
+			caughtUp := cm.configIndex <= cm.getCommitIndex() && cm.learnerCaughtUp(id)
+			matchIndex := cm.matchIndex[id]
+			cm.mu.Unlock()
+
+			now := cm.clock.Now()
+			if !caughtUp {
+				caughtUpSince = time.Time{}
+			} else if caughtUpSince.IsZero() {
+				caughtUpSince = now
+			}
+			if caughtUp && now.Sub(caughtUpSince) >= cm.config.ElectionTimeoutMax {
+				cm.dlog("learner %d caught up in round %d", id, round)
+				return nil
+			}
+			if cm.clock.Now().After(deadline) {
+				cm.dlog("learner %d still catching up after round %d: matchIndex=%d, lastLogIndex=%d", id, round, matchIndex, lastLogIndex)
+				break
+			}
+			<-ticker.C()
+		}
+	}
+	return fmt.Errorf("server %d didn't catch up in %d rounds: %w", id, cm.config.CatchUpRounds, ErrTimeout)
+}
+
+// AddLearner adds server id to the cluster configuration as a learner: it
+// receives log entries and snapshots from the leader like any follower, but
+// it doesn't vote and doesn't count towards the quorum for commits, so adding
+// a far-behind server doesn't hurt availability. Once it has caught up, make
+// it a voter with PromoteLearner. The same restrictions as for AddServer
+// apply.
+func (cm *ConsensusModule) AddLearner(id int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	config, err := cm.checkConfigChange()
+	if err != nil {
+		return err
+	}
+	if containsId(config.Servers, id) || containsId(config.Learners, id) {
+		return fmt.Errorf("server %d is already a member", id)
+	}
+	config.Learners = append(config.Learners, id)
+	return cm.appendConfigEntry(config)
+}
+
+// PromoteLearner turns learner id into a voting member. An error is returned
+// if its log isn't within Config.CatchUpThreshold entries of the leader's. The
+// same restrictions as for AddServer apply.
+func (cm *ConsensusModule) PromoteLearner(id int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	config, err := cm.checkConfigChange()
+	if err != nil {
+		return err
+	}
+	if !containsId(config.Learners, id) {
+		return fmt.Errorf("server %d is not a learner", id)
+	}
+	if !cm.learnerCaughtUp(id) {
+		lastLogIndex, _ := cm.lastLogIndexAndTerm()
+		return fmt.Errorf("learner %d is not caught up: matchIndex=%d, lastLogIndex=%d", id, cm.matchIndex[id], lastLogIndex)
+	}
+	config.Learners = removeId(config.Learners, id)
+	config.Servers = append(config.Servers, id)
+	return cm.appendConfigEntry(config)
+}
+
+// learnerCaughtUp reports whether learner id acknowledged entries up to
+// within Config.CatchUpThreshold of the end of this leader's log. A learner
+// that acknowledged nothing yet isn't caught up, however short the log is.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) learnerCaughtUp(id int) bool {
+	cm.assertLocked()
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	matchIndex, ok := cm.matchIndex[id]
+	return ok && matchIndex >= 0 && matchIndex >= lastLogIndex-cm.config.CatchUpThreshold
+}
+
+// RemoveServer removes server id, a voter or a learner, from the cluster
+// configuration. The same restrictions as for AddServer apply; in addition,
+// the leader can't remove itself.
+func (cm *ConsensusModule) RemoveServer(id int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	config, err := cm.checkConfigChange()
+	if err != nil {
+		return err
+	}
+	if id == cm.id {
+		return fmt.Errorf("leader %d can't remove itself", id)
+	}
+	if !containsId(config.Servers, id) && !containsId(config.Learners, id) {
+		return fmt.Errorf("server %d is not a member", id)
+	}
+	config.Servers = removeId(config.Servers, id)
+	config.Learners = removeId(config.Learners, id)
+	return cm.appendConfigEntry(config)
+}
+
+// ChangeConfiguration replaces the voting members of the cluster with
+// servers, which may differ from the current voters in any number of members,
+// using joint consensus: the leader first appends a joint configuration that
+// needs majorities of both the old and the new voters, and once that's
+// committed, the final configuration with just the new voters. Learners that
+// aren't in servers stay learners. The leader itself may be left out of
+// servers; it then steps down once the final configuration is committed. The
+// same restrictions as for AddServer apply.
+func (cm *ConsensusModule) ChangeConfiguration(servers []int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	config, err := cm.checkConfigChange()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("configuration must have at least one voting member")
+	}
+	learners := config.Learners
+	for _, id := range servers {
+		learners = removeId(learners, id)
+	}
+	return cm.appendConfigEntry(ConfigEntry{
+		Servers:    append([]int(nil), servers...),
+		Learners:   learners,
+		OldServers: config.Servers,
+	})
+}
+
+// BootstrapCluster prepares the empty storage of a server of a new cluster,
+// whose voting members are the servers with the given ids: it writes a log
+// holding just a configuration entry with them, at index 0 and term 0. With
+// every member bootstrapped this way, the servers start out knowing the
+// cluster's membership, whatever peers their ConsensusModules are created
+// with, and elect a leader that commits the entry as usual; there's no need
+// for a leader to commit an initial configuration first. An error is returned
+// if storage already has data, so an existing server can't be reset by
+// mistake.
+func BootstrapCluster(storage Storage, peers []int) error {
+	if storage.HasData() {
+		return fmt.Errorf("refusing to bootstrap storage that already has data")
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("configuration must have at least one voting member")
+	}
+	// A bare CM is enough to write its initial state.
+	cm := &ConsensusModule{
+		storage:           storage,
+		votedFor:          -1,
+		lastIncludedIndex: -1,
+		lastIncludedTerm:  -1,
+		log:               []LogEntry{{Command: ConfigEntry{Servers: append([]int(nil), peers...)}, Term: 0}},
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.persistTermAndVote()
+	cm.persistLog()
+	return nil
+}
+
+// checkConfigChange verifies a new configuration change may start, and returns
+// a copy of the current configuration (including this server).
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) checkConfigChange() (ConfigEntry, error) {
+	cm.assertLocked()
+	if cm.getState() != Leader {
+		return ConfigEntry{}, fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	if cm.configIndex > cm.getCommitIndex() || cm.oldVoters != nil {
+		return ConfigEntry{}, fmt.Errorf("configuration change at index %d is not committed yet: %w", cm.configIndex, ErrConfigChangeInProgress)
+	}
+	// Until a new leader commits an entry of its own term, a configuration
+	// change appended by its predecessor may be uncommitted, possibly
+	// without the new leader knowing; changing the configuration on top of it
+	// could then make two disjoint majorities (see section 4.1 of the Raft
+	// thesis, and its errata). The no-op appended in startLeader commits soon.
+	if cm.getCommitIndex() < 0 || cm.entryAt(cm.getCommitIndex()).Term != cm.getTerm() {
+		return ConfigEntry{}, fmt.Errorf("leader %d hasn't committed an entry of term %d yet: %w", cm.id, cm.getTerm(), ErrConfigChangeInProgress)
+	}
+	return ConfigEntry{
+		Servers:  append([]int(nil), cm.voters...),
+		Learners: append([]int(nil), cm.learnerIds...),
+	}, nil
+}
+
+// finishConfigChange is called on the leader when its commit index advances.
+// Once a joint configuration is committed, it appends the final
+// configuration; once a configuration that doesn't include this CM as a voter
+// is committed, it steps down.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) finishConfigChange() {
+	cm.assertLocked()
+	if cm.getState() != Leader || cm.configIndex > cm.getCommitIndex() {
+		return
+	}
+	if cm.oldVoters != nil {
+		cm.appendConfigEntry(ConfigEntry{
+			Servers:  append([]int(nil), cm.voters...),
+			Learners: append([]int(nil), cm.learnerIds...),
+		})
+		cm.triggerAE()
+		return
+	}
+	if !cm.isVoter {
+		cm.ilog("not a voter in the committed configuration, stepping down")
+		cm.becomeFollower(cm.getTerm())
+	}
+}
+
+// appendConfigEntry appends a configuration entry to the leader's log and
+// applies it right away.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) appendConfigEntry(config ConfigEntry) error {
+	cm.assertLocked()
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	cm.log = append(cm.log, LogEntry{Command: config, Term: cm.getTerm()})
+	cm.persistLog()
+	cm.applyConfiguration()
+
+	// Newly added peers start from the end of the leader's log and are
+	// backed up from there by the usual consistency check.
+	for _, peerId := range cm.replicationTargets() {
+		if _, ok := cm.nextIndex[peerId]; !ok {
+			cm.nextIndex[peerId] = lastLogIndex + 1
+			cm.matchIndex[peerId] = -1
+		}
+	}
+	cm.dlog("appended configuration %+v at index %d", config, cm.configIndex)
+	return nil
+}
+
+// applyConfiguration sets cm.peerIds and cm.learnerIds from the latest
+// configuration entry in the log, falling back to the configuration included
+// in the snapshot. It has to be called whenever entries are appended to or
+// truncated from the log.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) applyConfiguration() {
+	cm.assertLocked()
+	config := cm.snapshotConfig
+	cm.configIndex = cm.lastIncludedIndex
+	for i := len(cm.log) - 1; i >= 0; i-- {
+		if c, ok := cm.log[i].Command.(ConfigEntry); ok {
+			config = c
+			cm.configIndex = cm.lastIncludedIndex + 1 + i
+			break
+		}
+	}
+
+	cm.voters = config.Servers
+	cm.oldVoters = config.OldServers
+	cm.peerIds = removeId(config.Servers, cm.id)
+	for _, id := range config.OldServers {
+		if id != cm.id && !containsId(cm.peerIds, id) {
+			cm.peerIds = append(cm.peerIds, id)
+		}
+	}
+	cm.learnerIds = removeId(config.Learners, cm.id)
+	cm.isVoter = containsId(config.Servers, cm.id) || containsId(config.OldServers, cm.id)
+}
+
+// configurationAt returns the configuration in effect at the given log index,
+// which must not precede lastIncludedIndex.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) configurationAt(index int) ConfigEntry {
+	cm.assertLocked()
+	for i := cm.logIndexToSlice(index); i >= 0; i-- {
+		if c, ok := cm.log[i].Command.(ConfigEntry); ok {
+			return c
+		}
+	}
+	return cm.snapshotConfig
+}
+
+// hasQuorum reports whether the servers for which acked returns true (votes,
+// acknowledgements, ...) make a majority of the voters of the current
+// configuration; in a joint configuration, they have to make a majority of
+// both the old and the new voters. Learners never count.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) hasQuorum(acked func(id int) bool) bool {
+	cm.assertLocked()
+	if !isMajority(cm.voters, acked) {
+		return false
+	}
+	return cm.oldVoters == nil || isMajority(cm.oldVoters, acked)
+}
+
+// isMajority reports whether acked returns true for a majority of ids.
+func isMajority(ids []int, acked func(id int) bool) bool {
+	count := 0
+	for _, id := range ids {
+		if acked(id) {
+			count++
+		}
+	}
+	return count*2 > len(ids)
+}
+
+// replicationTargets returns the ids of all servers the leader replicates its
+// log to: voting peers and learners. While the latest configuration entry
+// isn't committed, members it removed are still included, so they learn
+// about their removal instead of timing out and disrupting the cluster with
+// elections.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) replicationTargets() []int {
+	cm.assertLocked()
+	targets := append([]int(nil), cm.peerIds...)
+	targets = append(targets, cm.learnerIds...)
+	if cm.configIndex > cm.getCommitIndex() && cm.configIndex-1 >= cm.lastIncludedIndex {
+		prev := cm.configurationAt(cm.configIndex - 1)
+		for _, ids := range [][]int{prev.Servers, prev.OldServers, prev.Learners} {
+			for _, id := range ids {
+				if id != cm.id && !containsId(targets, id) {
+					targets = append(targets, id)
+				}
+			}
+		}
+	}
+	return targets
+}
+
+func containsId(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeId returns a copy of ids without id.
+func removeId(ids []int, id int) []int {
+	var result []int
+	for _, i := range ids {
+		if i != id {
+			result = append(result, i)
+		}
+	}
+	return result
+}
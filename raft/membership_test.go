@@ -0,0 +1,336 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// appendEntriesBlocker makes the servers it's installed on hold incoming
+// AppendEntries RPCs while it's blocking, so that leaders can't commit
+// anything; elections still go through.
+type appendEntriesBlocker struct {
+	blocking atomic.Bool
+	release  chan struct{}
+	once     sync.Once
+}
+
+func newAppendEntriesBlocker(config *Config) *appendEntriesBlocker {
+	b := &appendEntriesBlocker{release: make(chan struct{})}
+	config.OnRPCRecv = func(serviceMethod string, args interface{}) {
+		if serviceMethod == "ConsensusModule.AppendEntries" && b.blocking.Load() {
+			<-b.release
+		}
+	}
+	return b
+}
+
+// Release lets all held and future AppendEntries RPCs through.
+func (b *appendEntriesBlocker) Release() {
+	b.once.Do(func() {
+		b.blocking.Store(false)
+		close(b.release)
+	})
+}
+
+func TestRemoveServer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	removedId := (leaderId + 1) % 3
+	if err := h.cluster[leaderId].cm.RemoveServer(removedId); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(250)
+	h.DisconnectPeer(removedId)
+
+	// The two remaining servers are a majority of the new configuration on
+	// their own.
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 2)
+	if id, _ := h.CheckSingleLeader(); id != leaderId {
+		t.Errorf("leader is %d; want %d", id, leaderId)
+	}
+
+	if err := h.cluster[leaderId].cm.RemoveServer(removedId); err == nil {
+		t.Errorf("removing %d again succeeded", removedId)
+	}
+}
+
+func TestConfigChangeOnlyOneAtATime(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	sleepMs(150)
+	cm := h.cluster[leaderId].cm
+	if err := cm.AddLearner(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.AddLearner(4); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Errorf("second AddLearner: got %v; want ErrConfigChangeInProgress", err)
+	}
+
+	// Once the first change commits, the next one may start.
+	sleepMs(250)
+	if err := cm.AddLearner(4); err != nil {
+		t.Errorf("AddLearner after the first change committed: %v", err)
+	}
+}
+
+func TestConfigChangeWaitsForCurrentTermCommit(t *testing.T) {
+	config := DefaultConfig()
+	blocker := newAppendEntriesBlocker(config)
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+	defer blocker.Release()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	sleepMs(150)
+
+	// A new leader whose no-op can't be replicated has no entry of its term
+	// committed, so it has to refuse configuration changes.
+	blocker.blocking.Store(true)
+	newLeaderId := (origLeaderId + 1) % 3
+	h.ElectLeader(newLeaderId)
+	cm := h.cluster[newLeaderId].cm
+	if err := cm.AddLearner(3); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Errorf("AddLearner before the no-op committed: got %v; want ErrConfigChangeInProgress", err)
+	}
+
+	blocker.Release()
+	sleepMs(250)
+	if err := cm.AddLearner(3); err != nil {
+		t.Errorf("AddLearner after the no-op committed: %v", err)
+	}
+}
+
+func TestChangeConfigurationJointConsensus(t *testing.T) {
+	// Servers 0-4 are the voters, and 5-7 are running but not members.
+	storage := make([]*MapStorage, 8)
+	for i := range storage {
+		storage[i] = NewMapStorage()
+		if err := BootstrapCluster(storage[i], []int{0, 1, 2, 3, 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	leaders := make(map[int]int)
+	config := DefaultConfig()
+	config.OnStateChange = func(old, new CMState, term int) {
+		if new == Leader {
+			mu.Lock()
+			leaders[term]++
+			mu.Unlock()
+		}
+	}
+	h := NewHarnessWithStorage(t, storage, config)
+	defer h.Shutdown()
+
+	// Three of the five voters, the leader among them, are swapped for the
+	// three others.
+	leaderId, _ := h.CheckSingleLeader()
+	h.SubmitToLeader(1)
+	sleepMs(150)
+	removed := []int{leaderId, (leaderId + 1) % 5, (leaderId + 2) % 5}
+	newServers := []int{(leaderId + 3) % 5, (leaderId + 4) % 5, 5, 6, 7}
+	cm := h.cluster[leaderId].cm
+	if err := cm.ChangeConfiguration(newServers); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(250)
+
+	// The leader went through the joint configuration to the new one, then
+	// stepped down.
+	var configs []ConfigEntry
+	for _, entry := range cm.LogSlice(0, cm.CommitIndex()+1) {
+		if config, ok := entry.Command.(ConfigEntry); ok {
+			configs = append(configs, config)
+		}
+	}
+	if len(configs) != 3 || len(configs[1].OldServers) != 5 || len(configs[1].Servers) != 5 || configs[2].OldServers != nil {
+		t.Fatalf("committed configurations %+v; want the bootstrap one, the joint one, then the new one", configs)
+	}
+	if _, isLeader := h.cluster[leaderId].GetState(); isLeader {
+		t.Errorf("removed leader %d is still leader", leaderId)
+	}
+
+	// The new voters elect a leader and commit on their own, though three of
+	// them weren't in the old configuration.
+	for _, id := range removed {
+		h.DisconnectPeer(id)
+	}
+	newLeaderId, _ := h.CheckSingleLeader()
+	if !containsId(newServers, newLeaderId) {
+		t.Errorf("leader %d isn't in the new configuration %v", newLeaderId, newServers)
+	}
+	h.SubmitToLeader(2)
+	sleepMs(250)
+	h.CheckCommittedN(2, 5)
+
+	// No term ever had two leaders, in either configuration.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaders) < 2 {
+		t.Errorf("leaders were elected in terms %v; want one before the change and one after", leaders)
+	}
+	for term, n := range leaders {
+		if n > 1 {
+			t.Errorf("%d leaders in term %d", n, term)
+		}
+	}
+}
+
+func TestChangeConfigurationWithoutLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	sleepMs(150)
+	newServers := []int{(origLeaderId + 1) % 3, (origLeaderId + 2) % 3}
+	if err := h.cluster[origLeaderId].cm.ChangeConfiguration(newServers); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leader steps down once the configuration without it is committed,
+	// and the remaining servers elect a leader among themselves.
+	sleepMs(250)
+	if _, isLeader := h.cluster[origLeaderId].GetState(); isLeader {
+		t.Errorf("removed leader %d is still leader", origLeaderId)
+	}
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(350)
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 2)
+}
+
+func TestAddServerCatchesUp(t *testing.T) {
+	config := DefaultConfig()
+	config.PreVote = true
+	config.Logger = NopLogger{}
+	h := NewHarnessWithConfig(t, 4, config)
+	defer h.Shutdown()
+
+	// Server 3 leaves the cluster before it got anything, and the three
+	// others build up a log far longer than CatchUpThreshold.
+	h.CrashPeer(3)
+	leaderId, _ := h.CheckSingleLeader()
+	sleepMs(150)
+	cm := h.cluster[leaderId].cm
+	if err := cm.RemoveServer(3); err != nil {
+		t.Fatal(err)
+	}
+	for v := 1; v <= 500; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(500, 3)
+
+	// AddServer returns once server 3 is caught up and a voter.
+	h.storage[3] = NewMapStorage()
+	h.RestartPeer(3)
+	if err := cm.AddServer(3); err != nil {
+		t.Fatal(err)
+	}
+	cm.mu.Lock()
+	voter := containsId(cm.voters, 3)
+	cm.mu.Unlock()
+	if !voter {
+		t.Errorf("server 3 isn't a voter after AddServer")
+	}
+	sleepMs(150)
+	h.CheckCommittedN(500, 4)
+
+	// Its acknowledgement counts: with another server gone, the leader needs
+	// it for a majority of four.
+	h.CrashPeer((leaderId + 1) % 3)
+	h.SubmitToLeader(501)
+	sleepMs(250)
+	h.CheckCommittedN(501, 3)
+}
+
+func TestPromoteDisconnectedLearner(t *testing.T) {
+	config := DefaultConfig()
+	config.PreVote = true
+	config.CatchUpRounds = 2
+	config.Logger = NopLogger{}
+	h := NewHarnessWithConfig(t, 4, config)
+	defer h.Shutdown()
+
+	// Server 3 is gone, and the log stays far shorter than CatchUpThreshold.
+	h.CrashPeer(3)
+	leaderId, _ := h.CheckSingleLeader()
+	sleepMs(150)
+	cm := h.cluster[leaderId].cm
+	if err := cm.RemoveServer(3); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(150)
+
+	// A learner that never acknowledged an entry isn't caught up, however
+	// short the log is.
+	if err := cm.AddLearner(3); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(150)
+	if err := cm.PromoteLearner(3); err == nil {
+		t.Errorf("promoting a disconnected learner succeeded")
+	}
+	if err := cm.RemoveServer(3); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(150)
+
+	if err := cm.AddServer(3); !errors.Is(err, ErrTimeout) {
+		t.Errorf("AddServer of a disconnected server: got %v; want ErrTimeout", err)
+	}
+	cm.mu.Lock()
+	voter := containsId(cm.voters, 3)
+	cm.mu.Unlock()
+	if voter {
+		t.Errorf("disconnected server 3 is a voter")
+	}
+
+	// The three others still commit on their own.
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+}
+
+func TestBootstrapCluster(t *testing.T) {
+	storage := make([]*MapStorage, 3)
+	for i := range storage {
+		storage[i] = NewMapStorage()
+		if err := BootstrapCluster(storage[i], []int{0, 1, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := BootstrapCluster(storage[0], []int{0, 1, 2}); err == nil {
+		t.Errorf("bootstrapping storage with data succeeded")
+	}
+	h := NewHarnessWithStorage(t, storage, nil)
+	defer h.Shutdown()
+
+	// The servers form a cluster with the bootstrapped configuration, which
+	// the first leader commits like any entry.
+	leaderId, _ := h.CheckSingleLeader()
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		cm.mu.Lock()
+		config, ok := cm.log[0].Command.(ConfigEntry)
+		if !ok || len(config.Servers) != 3 || len(cm.voters) != 3 || cm.commitIndex < 0 {
+			t.Errorf("server %d: log starts with %+v, voters %v, commitIndex %d; want the committed bootstrap configuration", i, cm.log[0], cm.voters, cm.commitIndex)
+		}
+		cm.mu.Unlock()
+	}
+	if err := h.cluster[leaderId].cm.RemoveServer((leaderId + 1) % 3); err != nil {
+		t.Errorf("RemoveServer in the bootstrapped configuration: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package raft
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics is the interface a ConsensusModule reports its activity through, so
+// operators can monitor the cluster. Methods may be called with the CM's
+// mutex held: implementations must be safe for concurrent use, return quickly
+// and not call back into the CM.
+type Metrics interface {
+	// SetTerm reports the CM's current term whenever it changes.
+	SetTerm(term int)
+
+	// SetState reports the CM's state whenever it changes.
+	SetState(state CMState)
+
+	// ElectionStarted is called whenever the CM starts an election, and
+	// ElectionWon whenever it wins one.
+	ElectionStarted()
+	ElectionWon()
+
+	// EntriesCommitted reports n more entries delivered on the commit channel
+	// (or about to be).
+	EntriesCommitted(n int)
+
+	// ObserveCommitLatency reports, on the leader, the time between the
+	// submission of a command and its commit.
+	ObserveCommitLatency(d time.Duration)
+
+	// AppendEntriesResult reports the outcome of an AppendEntries RPC the
+	// leader sent to peerId; success is false if the RPC failed or the peer
+	// rejected the entries.
+	AppendEntriesResult(peerId int, success bool)
+
+	// SetInflightAppends reports the number of AppendEntries RPCs the leader
+	// has outstanding to peerId whenever it changes.
+	SetInflightAppends(peerId int, n int)
+
+	// SetCommitChanDepth reports the number of entries waiting in the commit
+	// channel, and its capacity, before every send on it. A full channel
+	// means the client isn't keeping up with commits.
+	SetCommitChanDepth(depth, capacity int)
+}
+
+// NopMetrics is a Metrics that discards everything; it's the default.
+type NopMetrics struct{}
+
+func (NopMetrics) SetTerm(term int)                             {}
+func (NopMetrics) SetState(state CMState)                       {}
+func (NopMetrics) ElectionStarted()                             {}
+func (NopMetrics) ElectionWon()                                 {}
+func (NopMetrics) EntriesCommitted(n int)                       {}
+func (NopMetrics) ObserveCommitLatency(d time.Duration)         {}
+func (NopMetrics) AppendEntriesResult(peerId int, success bool) {}
+func (NopMetrics) SetInflightAppends(peerId int, n int)         {}
+func (NopMetrics) SetCommitChanDepth(depth, capacity int)       {}
+
+// PrometheusMetrics is a Metrics that keeps the values of one CM in memory
+// and exposes them in the Prometheus text format through MetricsHandler, so
+// a Prometheus server can scrape them. Every metric has an "id" label with the
+// CM's id, so the metrics of several CMs can be served together. Users with
+// their own Prometheus registry can implement Metrics on top of it instead.
+type PrometheusMetrics struct {
+	mu sync.Mutex
+	id int
+
+	term              int
+	state             CMState
+	electionsStarted  int64
+	electionsWon      int64
+	entriesCommitted  int64
+	commitLatencySum  time.Duration
+	commitLatencyN    int64
+	appendEntriesSucc map[int]int64
+	appendEntriesFail map[int]int64
+	inflightAppends   map[int]int
+	commitChanDepth   int
+	commitChanCap     int
+}
+
+// NewPrometheusMetrics creates the metrics of the CM with the given id.
+func NewPrometheusMetrics(id int) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		id:                id,
+		appendEntriesSucc: make(map[int]int64),
+		appendEntriesFail: make(map[int]int64),
+		inflightAppends:   make(map[int]int),
+	}
+}
+
+func (m *PrometheusMetrics) SetTerm(term int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.term = term
+}
+
+func (m *PrometheusMetrics) SetState(state CMState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+}
+
+func (m *PrometheusMetrics) ElectionStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.electionsStarted++
+}
+
+func (m *PrometheusMetrics) ElectionWon() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.electionsWon++
+}
+
+func (m *PrometheusMetrics) EntriesCommitted(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entriesCommitted += int64(n)
+}
+
+func (m *PrometheusMetrics) ObserveCommitLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commitLatencySum += d
+	m.commitLatencyN++
+}
+
+func (m *PrometheusMetrics) AppendEntriesResult(peerId int, success bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if success {
+		m.appendEntriesSucc[peerId]++
+	} else {
+		m.appendEntriesFail[peerId]++
+	}
+}
+
+func (m *PrometheusMetrics) SetInflightAppends(peerId int, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflightAppends[peerId] = n
+}
+
+func (m *PrometheusMetrics) SetCommitChanDepth(depth, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commitChanDepth = depth
+	m.commitChanCap = capacity
+}
+
+// stateLabels are the values of the "state" label of the raft_state metric.
+var stateLabels = []struct {
+	state CMState
+	label string
+}{
+	{Follower, "follower"},
+	{Candidate, "candidate"},
+	{Leader, "leader"},
+	{Dead, "dead"},
+}
+
+// writeSamples writes m's samples of the metric called name to w.
+func (m *PrometheusMetrics) writeSamples(w io.Writer, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch name {
+	case "raft_term":
+		fmt.Fprintf(w, "raft_term{id=\"%d\"} %d\n", m.id, m.term)
+	case "raft_state":
+		for _, s := range stateLabels {
+			value := 0
+			if m.state == s.state {
+				value = 1
+			}
+			fmt.Fprintf(w, "raft_state{id=\"%d\",state=\"%s\"} %d\n", m.id, s.label, value)
+		}
+	case "raft_elections_started_total":
+		fmt.Fprintf(w, "raft_elections_started_total{id=\"%d\"} %d\n", m.id, m.electionsStarted)
+	case "raft_elections_won_total":
+		fmt.Fprintf(w, "raft_elections_won_total{id=\"%d\"} %d\n", m.id, m.electionsWon)
+	case "raft_entries_committed_total":
+		fmt.Fprintf(w, "raft_entries_committed_total{id=\"%d\"} %d\n", m.id, m.entriesCommitted)
+	case "raft_commit_latency_seconds":
+		fmt.Fprintf(w, "raft_commit_latency_seconds_sum{id=\"%d\"} %g\n", m.id, m.commitLatencySum.Seconds())
+		fmt.Fprintf(w, "raft_commit_latency_seconds_count{id=\"%d\"} %d\n", m.id, m.commitLatencyN)
+	case "raft_inflight_appends":
+		peerIds := make([]int, 0, len(m.inflightAppends))
+		for peerId := range m.inflightAppends {
+			peerIds = append(peerIds, peerId)
+		}
+		sort.Ints(peerIds)
+		for _, peerId := range peerIds {
+			fmt.Fprintf(w, "raft_inflight_appends{id=\"%d\",peer=\"%d\"} %d\n", m.id, peerId, m.inflightAppends[peerId])
+		}
+	case "raft_commit_chan_depth":
+		fmt.Fprintf(w, "raft_commit_chan_depth{id=\"%d\"} %d\n", m.id, m.commitChanDepth)
+	case "raft_commit_chan_capacity":
+		fmt.Fprintf(w, "raft_commit_chan_capacity{id=\"%d\"} %d\n", m.id, m.commitChanCap)
+	case "raft_append_entries_total":
+		peers := make(map[int]bool)
+		for peerId := range m.appendEntriesSucc {
+			peers[peerId] = true
+		}
+		for peerId := range m.appendEntriesFail {
+			peers[peerId] = true
+		}
+		peerIds := make([]int, 0, len(peers))
+		for peerId := range peers {
+			peerIds = append(peerIds, peerId)
+		}
+		sort.Ints(peerIds)
+		for _, peerId := range peerIds {
+			fmt.Fprintf(w, "raft_append_entries_total{id=\"%d\",peer=\"%d\",result=\"success\"} %d\n", m.id, peerId, m.appendEntriesSucc[peerId])
+			fmt.Fprintf(w, "raft_append_entries_total{id=\"%d\",peer=\"%d\",result=\"failure\"} %d\n", m.id, peerId, m.appendEntriesFail[peerId])
+		}
+	}
+}
+
+// metricFamilies lists the metrics PrometheusMetrics exposes, in the order
+// MetricsHandler writes them.
+var metricFamilies = []struct {
+	name, kind, help string
+}{
+	{"raft_term", "gauge", "Current term."},
+	{"raft_state", "gauge", "1 for the current state of the node, 0 for the others."},
+	{"raft_elections_started_total", "counter", "Elections started by the node."},
+	{"raft_elections_won_total", "counter", "Elections won by the node."},
+	{"raft_entries_committed_total", "counter", "Log entries committed and applied by the node."},
+	{"raft_commit_latency_seconds", "summary", "Time from submission to commit of commands, measured on the leader."},
+	{"raft_commit_chan_depth", "gauge", "Committed entries waiting in the commit channel for the client."},
+	{"raft_commit_chan_capacity", "gauge", "Capacity of the commit channel."},
+	{"raft_inflight_appends", "gauge", "AppendEntries RPCs outstanding to each peer."},
+	{"raft_append_entries_total", "counter", "AppendEntries RPCs sent by the node as leader, by peer and result."},
+}
+
+// MetricsHandler returns an http.Handler serving the given metrics in the
+// Prometheus text format; register it on the path Prometheus scrapes, usually
+// /metrics:
+//
+//	http.Handle("/metrics", raft.MetricsHandler(metrics))
+func MetricsHandler(metrics ...*PrometheusMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, family := range metricFamilies {
+			fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+			for _, m := range metrics {
+				m.writeSamples(w, family.name)
+			}
+		}
+	})
+}
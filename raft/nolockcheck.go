@@ -0,0 +1,7 @@
+//go:build !raftdebug
+
+package raft
+
+// lockChecks turns on assertLocked; it's off by default, so the checks cost
+// nothing in production builds.
+const lockChecks = false
@@ -0,0 +1,93 @@
+package raft
+
+// RequestPreVote RPC. It's identical to RequestVote, except that args.Term is
+// the term the candidate would campaign in and granting a pre-vote doesn't
+// change any state on the voter. A pre-vote is granted only if this server
+// hasn't heard from a leader within the minimum election timeout, so a
+// server rejoining after a partition can't disrupt a healthy leader.
+func (cm *ConsensusModule) RequestPreVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Dead {
+		reply.Term = cm.getTerm()
+		return nil
+	}
+	cm.dlog("RequestPreVote: %+v [currentTerm=%d, lastLeaderContact=%v]", args, cm.getTerm(), cm.lastLeaderContact)
+
+	reply.Term = cm.getTerm()
+	reply.VoteGranted = cm.getState() != Leader &&
+		args.Term > cm.getTerm() &&
+		cm.clock.Now().Sub(cm.lastLeaderContact) >= cm.config.ElectionTimeoutMin &&
+		cm.isLogUpToDate(args.LastLogIndex, args.LastLogTerm)
+	cm.dlog("... RequestPreVote reply: %+v", reply)
+	return nil
+}
+
+// startPreVote runs the pre-vote phase of an election: it asks all peers
+// whether they would vote for this CM in the next term, and only starts a real
+// election (bumping currentTerm) if a majority would. If restartTimer is true a
+// new election timer is started for the case the pre-vote fails; it's false
+// when the caller's election timer keeps running.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startPreVote(restartTimer bool) {
+	cm.assertLocked()
+	savedCurrentTerm := cm.getTerm()
+	savedState := cm.getState()
+	savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
+	cm.electionResetEvent = cm.clock.Now()
+	cm.beginElectionRound()
+	cm.dlog("starts pre-vote for term %d", savedCurrentTerm+1)
+
+	votes := map[int]bool{cm.id: true}
+	for _, peerId := range cm.peerIds {
+		go func(peerId int) {
+			args := RequestVoteArgs{
+				Term:         savedCurrentTerm + 1,
+				CandidateId:  cm.id,
+				LastLogIndex: savedLastLogIndex,
+				LastLogTerm:  savedLastLogTerm,
+			}
+			var reply RequestVoteReply
+
+			cm.dlog("sending RequestPreVote to %d: %+v", peerId, args)
+			if err := cm.callPeer(peerId, "ConsensusModule.RequestPreVote", args, &reply); err == nil {
+				cm.mu.Lock()
+				defer cm.mu.Unlock()
+				if cm.getState() == Dead {
+					return
+				}
+				cm.dlog("received RequestPreVote reply %+v", reply)
+				cm.peerAnswered()
+
+				// The pre-vote is moot if anything happened in the meantime.
+				if cm.getState() != savedState || cm.getTerm() != savedCurrentTerm {
+					return
+				}
+
+				if reply.Term > cm.getTerm() {
+					cm.dlog("term out of date in RequestPreVote reply")
+					cm.becomeFollower(reply.Term)
+					return
+				}
+				if reply.VoteGranted {
+					votes[peerId] = true
+					if cm.hasQuorum(func(id int) bool { return votes[id] }) {
+						cm.dlog("wins pre-vote with %d votes", len(votes))
+						cm.startElection(false)
+					}
+				}
+			}
+		}(peerId)
+	}
+
+	if cm.hasQuorum(func(id int) bool { return votes[id] }) {
+		// No peers to ask.
+		cm.startElection(false)
+		return
+	}
+
+	// Run another election timer, in case the pre-vote doesn't succeed.
+	if restartTimer {
+		go cm.runElectionTimer()
+	}
+}
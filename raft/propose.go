@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxProposeRedirects caps how many times Server.Propose follows a leader hint
+// from a server that turned out not to be the leader, so a proposal doesn't
+// bounce between servers with stale hints during an election.
+const maxProposeRedirects = 3
+
+type ProposeForwardArgs struct {
+	Command interface{}
+}
+
+type ProposeForwardReply struct {
+	// IsLeader is true iff the command was submitted; Index and Term are then
+	// those Submit returned. Otherwise LeaderId is the leader known to the
+	// server that was asked, or -1. LogFull is set if that server is the
+	// leader, but its log is full.
+	IsLeader bool
+	Index    int
+	Term     int
+	LeaderId int
+	LogFull  bool
+}
+
+// ProposeForward RPC. A follower's Server.Propose uses it to submit a command
+// on the leader.
+func (cm *ConsensusModule) ProposeForward(args ProposeForwardArgs, reply *ProposeForwardReply) error {
+	cm.mu.Lock()
+	index, term, err := cm.submit(args.Command)
+	cm.mu.Unlock()
+	reply.Index, reply.Term, reply.IsLeader = index, term, err == nil
+	reply.LogFull = errors.Is(err, ErrLogFull)
+	if !reply.IsLeader {
+		reply.LeaderId = cm.LeaderId()
+	}
+	return nil
+}
+
+// Propose submits command to the cluster. If this server is the leader, it's
+// like Submit; otherwise the command is forwarded to the leader this server
+// knows of. It returns the index and term the leader appended the command at,
+// ErrNoLeader if no leader is known, ErrLogFull if the leader's log is full,
+// or another error if forwarding failed.
+// Like with Submit, the command isn't committed yet when Propose returns.
+func (s *Server) Propose(command interface{}) (index int, term int, err error) {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return -1, -1, fmt.Errorf("server %d is not serving: %w", s.serverId, ErrShutdown)
+	}
+
+	cm.mu.Lock()
+	index, term, err = cm.submit(command)
+	cm.mu.Unlock()
+	if !errors.Is(err, ErrNotLeader) {
+		return index, term, err
+	}
+	leaderId := cm.LeaderId()
+	for redirects := 0; redirects < maxProposeRedirects; redirects++ {
+		if leaderId < 0 || leaderId == s.serverId {
+			return -1, -1, ErrNoLeader
+		}
+		// With a Codec, the command is encoded here, so it crosses the
+		// network as bytes like log entries do.
+		forwarded, err := cm.encodeCommand(command)
+		if err != nil {
+			return -1, -1, fmt.Errorf("encode command: %w", err)
+		}
+		var reply ProposeForwardReply
+		if err := cm.callPeer(leaderId, "ConsensusModule.ProposeForward", ProposeForwardArgs{Command: forwarded}, &reply); err != nil {
+			return -1, -1, fmt.Errorf("forward proposal to leader %d: %w", leaderId, err)
+		}
+		if reply.IsLeader {
+			return reply.Index, reply.Term, nil
+		}
+		if reply.LogFull {
+			return -1, -1, fmt.Errorf("leader %d: %w", leaderId, ErrLogFull)
+		}
+		leaderId = reply.LeaderId
+	}
+	return -1, -1, ErrNoLeader
+}
@@ -1,14 +1,40 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const DebugCM = 1
+// CommitEntry is the data reported by Raft to the commit channel. Each commit
+// entry notifies the client that consensus was reached on a command and it can
+// be applied to the client's state machine.
+type CommitEntry struct {
+	// Command is the client command being committed.
+	Command interface{}
+
+	// Index is the log index at which the client command is committed.
+	// Indices of entries used internally by Raft (such as configuration
+	// changes) are skipped, so the sequence of indices may have gaps.
+	Index int
+
+	// Term is the Raft term of the committed log entry.
+	Term int
+
+	// IsSnapshot marks an entry that carries a state machine snapshot instead
+	// of a command. The client should replace its state with Snapshot; Index
+	// and Term are then those of the last log entry covered by the snapshot.
+	IsSnapshot bool
+	Snapshot   []byte
+}
 
 type CMState int
 
@@ -19,23 +45,837 @@ const (
 	Dead
 )
 
+func (s CMState) String() string {
+	switch s {
+	case Follower:
+		return "Follower"
+	case Candidate:
+		return "Candidate"
+	case Leader:
+		return "Leader"
+	case Dead:
+		return "Dead"
+	default:
+		return fmt.Sprintf("CMState(%d)", int(s))
+	}
+}
+
 // ConsensusModule is a single node of Raft consensus
 type ConsensusModule struct {
 	mu sync.Mutex
 
 	id int
 
-	peerIds []int
+	// peerIds lists the other voting members of the cluster, and learnerIds
+	// its non-voting members (other than this CM). They reflect the latest
+	// configuration entry in the log, see applyConfiguration. isVoter is true
+	// iff this CM is a voting member itself. voters lists all voting members
+	// including this CM; during a joint configuration change these are the
+	// new voters, oldVoters the old ones, and peerIds holds both.
+	peerIds    []int
+	learnerIds []int
+	isVoter    bool
+	voters     []int
+	oldVoters  []int
 
 	server *Server
 
-	// Raft state
+	// storage is used to persist state.
+	storage Storage
+
+	// commitChan is the channel where this CM is going to report committed log
+	// entries. It's passed in by the client during construction. Sends on it
+	// block for as long as the client doesn't consume, so they're only done
+	// by commitChanSender (through sendCommit), never with cm.mu held;
+	// otherwise a slow client would stall elections and heartbeats too.
+	commitChan chan<- CommitEntry
+
+	// triggerAEChan is an internal notification channel used to trigger
+	// sending new AEs to followers when interesting changes occurred.
+	triggerAEChan chan struct{}
+
+	// newCommitReadyChan is an internal notification channel used by goroutines
+	// that commit new entries to the log to notify that these entries may be sent
+	// on commitChan.
+	newCommitReadyChan chan struct{}
+
+	// leaderId is the leader this CM knows of in the current term, or -1 if
+	// there's none (e.g. during an election); it's set from valid
+	// AppendEntries. leaderChanges reports every change of it, see
+	// LeaderChanges.
+	leaderId      int
+	leaderChanges chan int
+
+	// commitWaitChan is closed, and replaced by a new channel, whenever
+	// commitIndex advances or this CM changes state; WaitForCommit waits on it.
+	commitWaitChan chan struct{}
+
+	// Raft state. state, currentTerm and commitIndex are only accessed
+	// through getState, getTerm, getCommitIndex and their setters, which
+	// check that cm.mu is held, except while the CM is constructed.
 	state              CMState
 	electionResetEvent time.Time
 
+	// config holds the CM's tunable parameters, with defaults filled in.
+	config Config
+
+	// clock is the source of time for all of the CM's timing; it's
+	// cm.config.Clock.
+	clock Clock
+
+	// rand is the source of randomness for election timeouts. It's used with
+	// and without cm.mu held, so it has its own mutex.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// logTerm mirrors currentTerm for logging, which has to work whether or
+	// not cm.mu is held. setTerm updates it along with currentTerm.
+	logTerm atomic.Int64
+
+	// lastLeaderContact is when this CM last heard from a valid leader.
+	lastLeaderContact time.Time
+
 	// Persistent Raft state
 	currentTerm int
 	votedFor    int
+	log         []LogEntry
+
+	// Snapshot state. The log holds only the entries that follow
+	// lastIncludedIndex; log[i] is the entry at index lastIncludedIndex+1+i.
+	// Both are -1 when no snapshot was taken yet.
+	lastIncludedIndex int
+	lastIncludedTerm  int
+	snapshot          []byte
+
+	// snapshotConfig is the cluster membership as of lastIncludedIndex (the
+	// initial membership when there's no snapshot); configIndex is the index
+	// of the configuration entry currently in effect.
+	snapshotConfig ConfigEntry
+	configIndex    int
+
+	// pendingSnapshot is set when a snapshot was installed that the client
+	// wasn't told about yet; commitChanSender delivers it before any entry
+	// that follows it. pendingSnapshotData is that snapshot, decoded from
+	// cm.snapshot, which holds it as encoded by encodeSnapshot.
+	pendingSnapshot     bool
+	pendingSnapshotData []byte
+
+	// Volatile Raft state on all servers
+	commitIndex int
+	lastApplied int
+
+	// deliveredIndex is the index of the latest entry commitChanSender
+	// handed over to the client on commitChan. lastApplied is advanced when
+	// entries are picked for sending, deliveredIndex only once they're sent.
+	// clientApplied is the latest index the client reported with
+	// SetLastApplied; see appliedIndex.
+	deliveredIndex int
+	clientApplied  int
+
+	// Volatile Raft state on leaders
+	nextIndex  map[int]int
+	matchIndex map[int]int
+
+	// inflight counts, for every peer, the AppendEntries RPCs that were sent
+	// in the current term and haven't been answered yet.
+	inflight map[int]int
+
+	// leaderSince is when this CM last became leader.
+	leaderSince time.Time
+
+	// leaderStop is closed when this CM stops leading the term startLeader
+	// created it for, by stepping down or becoming Dead, so the leader's
+	// goroutines exit right away instead of on their next heartbeat. It's nil
+	// when this CM isn't the leader.
+	leaderStop chan struct{}
+
+	// submitTimes holds, for every entry submitted to this leader in the
+	// current term and not committed yet, when it was submitted; used for the
+	// commit latency metric.
+	submitTimes map[int]time.Time
+
+	// tracing is false when config.Tracer is a NopTracer, so the CM can skip
+	// all tracing work. traces holds, by log index, the context that the
+	// "commit" span of a traced entry will be a child of; on the leader
+	// that's also the parent of the "replicate to peer N" spans.
+	// proposeSpans holds the "propose" spans of the entries submitted to this
+	// leader that aren't committed yet.
+	tracing      bool
+	traces       map[int]context.Context
+	proposeSpans map[int]Span
+
+	// peerAckTime holds, for every peer, the send time of the latest
+	// heartbeat the peer acknowledged in the current term; used for leases.
+	peerAckTime map[int]time.Time
+
+	// transferTarget is the peer leadership is being transferred to, or -1.
+	transferTarget int
+
+	// electionsPaused keeps this CM from starting elections, see
+	// PauseElections.
+	electionsPaused bool
+
+	// unansweredElections counts the consecutive elections (or pre-votes)
+	// this CM started that no peer answered; electionAnswered is whether a
+	// peer answered the latest one. See Isolated.
+	unansweredElections int
+	electionAnswered    bool
+
+	// incomingSnapshot is the snapshot being received from the leader in
+	// chunks, or nil. sendingSnapshot has the peers this leader is sending
+	// its snapshot to.
+	incomingSnapshot *snapshotTransfer
+	sendingSnapshot  map[int]bool
+
+	// events is the event log, a ring buffer of up to config.EventLogSize
+	// events; once it's full, eventsNext is the position of the oldest one.
+	events     []Event
+	eventsNext int
+
+	// stateChanges are the state changes stateChangeSender has yet to report
+	// to config.OnStateChange; stateChangeReady signals it when there are
+	// new ones.
+	stateChanges     []stateChange
+	stateChangeReady chan struct{}
+}
+
+// NewConsensusModule creates a new CM with the given ID, list of peer IDs,
+// server and storage. The ready channel signals the CM that all peers are connected and
+// it's safe to start its state machine. commitChan is going to be used by the
+// CM to send log entries that have been committed by the Raft cluster; its
+// capacity is how many committed entries the CM can hand over before it waits
+// for the client to consume them.
+// config tunes the CM's behavior; it may be nil to use DefaultConfig.
+//
+// If storage already holds data from a previous run, the CM's persistent state
+// is restored from it before the CM starts participating in elections; an
+// error is returned if config is invalid, or if that state can't be decoded,
+// in which case the error matches ErrCorruptStorage.
+func NewConsensusModule(id int, peerIds []int, server *Server, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry, config *Config) (*ConsensusModule, error) {
+	c := config.withDefaults()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	cm := new(ConsensusModule)
+	// Nothing else can reach cm yet, but the helpers called below expect the
+	// lock to be held.
+	cm.mu.Lock()
+	cm.id = id
+	cm.peerIds = peerIds
+	cm.server = server
+	cm.storage = storage
+	cm.commitChan = commitChan
+	cm.config = c
+	cm.clock = c.Clock
+	seed := c.RandSeed + int64(id)
+	if c.RandSeed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	cm.rand = rand.New(rand.NewSource(seed))
+	cm.newCommitReadyChan = make(chan struct{}, 1)
+	cm.stateChangeReady = make(chan struct{}, 1)
+	cm.triggerAEChan = make(chan struct{}, 1)
+	cm.commitWaitChan = make(chan struct{})
+	cm.leaderChanges = make(chan int, 1)
+	cm.leaderId = -1
+	cm.state = Follower
+	cm.votedFor = -1
+	cm.commitIndex = -1
+	cm.lastApplied = -1
+	cm.deliveredIndex = -1
+	cm.clientApplied = -1
+	cm.lastIncludedIndex = -1
+	cm.lastIncludedTerm = -1
+	cm.log = cm.newLog(nil)
+	if c.Learner {
+		cm.snapshotConfig = ConfigEntry{Servers: peerIds, Learners: []int{id}}
+	} else {
+		cm.snapshotConfig = ConfigEntry{Servers: append([]int{id}, peerIds...)}
+	}
+	cm.applyConfiguration()
+	cm.transferTarget = -1
+	cm.nextIndex = make(map[int]int)
+	cm.matchIndex = make(map[int]int)
+	cm.peerAckTime = make(map[int]time.Time)
+	cm.inflight = make(map[int]int)
+	cm.submitTimes = make(map[int]time.Time)
+	_, nopTracer := c.Tracer.(NopTracer)
+	cm.tracing = !nopTracer
+	cm.traces = make(map[int]context.Context)
+	cm.proposeSpans = make(map[int]Span)
+	cm.sendingSnapshot = make(map[int]bool)
+
+	if ss, ok := cm.storage.(syncSetter); ok {
+		ss.SetSync(!c.NoSync)
+	}
+	if cm.storage.HasData() {
+		if err := cm.restoreFromStorage(); err != nil {
+			cm.mu.Unlock()
+			return nil, err
+		}
+		cm.applyConfiguration()
+	} else {
+		// Store the initial state right away, so that the stored state is
+		// complete whichever part is persisted first.
+		cm.persistTermAndVote()
+		cm.persistLog()
+	}
+	cm.config.Metrics.SetTerm(cm.currentTerm)
+	cm.config.Metrics.SetState(cm.state)
+	cm.mu.Unlock()
+
+	go func() {
+		// The CM is quiescent until ready is signaled; then, it starts a countdown
+		// for leader election.
+		<-ready
+		cm.mu.Lock()
+		cm.electionResetEvent = cm.clock.Now()
+		cm.mu.Unlock()
+		cm.runElectionTimer()
+	}()
+
+	go cm.commitChanSender()
+	if cm.config.OnStateChange != nil {
+		go cm.stateChangeSender()
+	}
+	return cm, nil
+}
+
+// Report reports the state of this CM. It's safe to call concurrently with
+// anything else the CM is doing.
+func (cm *ConsensusModule) Report() (id int, term int, isLeader bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.id, cm.getTerm(), cm.getState() == Leader
+}
+
+// LeaderId returns the id of the leader this CM knows of, or -1 if it doesn't
+// know of one. A client-facing layer can use it to redirect clients that
+// reached a follower.
+func (cm *ConsensusModule) LeaderId() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.leaderId
+}
+
+// LeaderChanges returns a channel that receives the id of the leader this CM
+// knows of whenever that changes: when it hears from a new leader, or wins an
+// election itself. -1 means there's no known leader, e.g. during an election.
+// Only the latest change is kept for a slow consumer, earlier ones are
+// dropped. The channel is closed when the CM stops.
+func (cm *ConsensusModule) LeaderChanges() <-chan int {
+	return cm.leaderChanges
+}
+
+// CommitIndex returns the index of the latest entry this CM knows to be
+// committed, or -1 if there's none.
+func (cm *ConsensusModule) CommitIndex() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.getCommitIndex()
+}
+
+// SetLastApplied reports that the client applied all entries up to index to
+// its state machine. With Config.AckApplied, the client must call it after
+// processing each CommitEntry it received from the commit channel, with the
+// entry's index; indices below one reported before are ignored.
+func (cm *ConsensusModule) SetLastApplied(index int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if index > cm.deliveredIndex {
+		// The client can't have applied what it wasn't sent yet.
+		index = cm.deliveredIndex
+	}
+	if index > cm.clientApplied {
+		cm.clientApplied = index
+		cm.notifyCommitWaiters()
+	}
+}
+
+// LastApplied returns the index of the latest entry the client applied to its
+// state machine, or -1 if there's none; see Config.AckApplied.
+func (cm *ConsensusModule) LastApplied() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.appliedIndex()
+}
+
+// appliedIndex returns the index of the latest entry the client applied: the
+// one it reported with SetLastApplied with Config.AckApplied, and the latest
+// one delivered on the commit channel otherwise.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) appliedIndex() int {
+	cm.assertLocked()
+	if cm.config.AckApplied {
+		return cm.clientApplied
+	}
+	return cm.deliveredIndex
+}
+
+// LogSlice returns a copy of the entries of this CM's log with global indices
+// in [from, to), for tools that dump or compare logs. The range is clipped to
+// the entries the CM has: entries compacted into the snapshot and indices
+// past the end of the log are left out. With a Codec, commands are decoded;
+// those that fail to decode are returned encoded. Commands aren't
+// deep-copied, so callers mustn't modify what they point to.
+func (cm *ConsensusModule) LogSlice(from, to int) []LogEntry {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if from <= cm.lastIncludedIndex {
+		from = cm.lastIncludedIndex + 1
+	}
+	if lastLogIndex, _ := cm.lastLogIndexAndTerm(); to > lastLogIndex+1 {
+		to = lastLogIndex + 1
+	}
+	if from >= to {
+		return nil
+	}
+	entries := append([]LogEntry(nil), cm.log[cm.logIndexToSlice(from):cm.logIndexToSlice(to)]...)
+	for i := range entries {
+		if command, err := cm.decodeCommand(entries[i].Command); err == nil {
+			entries[i].Command = command
+		}
+	}
+	return entries
+}
+
+// GetState reports the current term of this CM and whether it's the leader.
+// With CheckQuorum, a leader that lost its quorum steps down right here
+// instead of on its next heartbeat, so callers gating writes on GetState
+// don't act on a stale leadership.
+func (cm *ConsensusModule) GetState() (term int, isLeader bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Leader && cm.config.CheckQuorum && !cm.hasRecentQuorum() {
+		cm.wlog("no quorum acknowledged leadership within %v, stepping down", cm.config.ElectionTimeoutMax)
+		cm.becomeFollower(cm.getTerm())
+	}
+	return cm.getTerm(), cm.getState() == Leader
+}
+
+// Stop stops this CM, cleaning up its state. This method returns quickly, but
+// it may take a bit of time (up to ~election timeout) for all goroutines to
+// exit; those still waiting for replies to RPCs sent before find the CM Dead
+// once the replies arrive, and exit without acting on them.
+func (cm *ConsensusModule) Stop() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Dead {
+		return
+	}
+	from := cm.getState()
+	cm.setState(Dead)
+	cm.recordStateChange(from)
+	cm.stopLeading()
+	cm.ilog("becomes Dead")
+	cm.config.Metrics.SetState(Dead)
+	close(cm.newCommitReadyChan)
+	close(cm.leaderChanges)
+	cm.notifyCommitWaiters()
+	cm.discardSnapshotTransfer()
+}
+
+// Submit submits a new command to the CM. This function doesn't block; it
+// reports isLeader=true iff this CM is the leader, in which case the command
+// was appended to the leader's log at index, in term, and accepted for
+// replication. Accepted is not the same as committed: clients learn that the
+// command was committed by reading the commit channel, where the CommitEntry
+// carries the same index; if the CommitEntry for index has a different term,
+// the command was overwritten by another leader. If isLeader is false, index
+// is -1 and the client will have to find a different CM to submit this
+// command to. Submit also reports false on a leader that's in the middle of
+// transferring leadership, whose log is full (see Config.MaxLogEntries), or
+// if the configured Codec can't encode command; Server.Propose tells these
+// cases apart.
+//
+// Submit used to return only a bool; callers that don't need to track their
+// entry can migrate with `_, _, ok := cm.Submit(command)`.
+func (cm *ConsensusModule) Submit(command interface{}) (index int, term int, isLeader bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	index, term, err := cm.submit(command)
+	return index, term, err == nil
+}
+
+// submit implements Submit. It returns an error matching ErrNotLeader if
+// this CM isn't the leader or is transferring leadership, and ErrLogFull if
+// its log is full.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) submit(command interface{}) (index int, term int, err error) {
+	cm.assertLocked()
+	cm.dlog("Submit received by %v: %v", cm.getState(), command)
+	if cm.getState() != Leader {
+		return -1, cm.getTerm(), fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	if cm.transferTarget != -1 {
+		return -1, cm.getTerm(), fmt.Errorf("server %d is transferring leadership: %w", cm.id, ErrNotLeader)
+	}
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	if limit := cm.config.MaxLogEntries; limit > 0 && lastLogIndex-cm.getCommitIndex() >= limit {
+		return -1, cm.getTerm(), fmt.Errorf("leader %d has %d uncommitted entries: %w", cm.id, lastLogIndex-cm.getCommitIndex(), ErrLogFull)
+	}
+	command, err = cm.encodeCommand(command)
+	if err != nil {
+		cm.wlog("Submit: encoding command: %v", err)
+		return -1, cm.getTerm(), fmt.Errorf("encode command: %w", err)
+	}
+	cm.log = append(cm.log, LogEntry{Command: command, Term: cm.getTerm()})
+	cm.persistLog()
+	cm.dlog("... log=%v", cm.log)
+	cm.triggerAE()
+	index, _ = cm.lastLogIndexAndTerm()
+	cm.submitTimes[index] = cm.clock.Now()
+	return index, cm.getTerm(), nil
+}
+
+// WaitForCommit blocks until the log entry at index is committed. It's meant
+// to be called on the leader with an index returned by Submit, and returns an error matching
+// ErrNotLeader if this CM isn't the leader, or stops being the leader of the current term before
+// the entry commits (the entry may then have been overwritten by another
+// leader). It also returns an error if ctx is done first.
+func (cm *ConsensusModule) WaitForCommit(ctx context.Context, index int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() != Leader {
+		return fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	savedCurrentTerm := cm.getTerm()
+
+	for cm.getCommitIndex() < index {
+		if cm.getState() != Leader || cm.getTerm() != savedCurrentTerm {
+			return fmt.Errorf("server %d lost leadership before index %d committed: %w", cm.id, index, ErrNotLeader)
+		}
+		waitChan := cm.commitWaitChan
+		cm.mu.Unlock()
+		select {
+		case <-waitChan:
+		case <-ctx.Done():
+			cm.mu.Lock()
+			return ctx.Err()
+		}
+		cm.mu.Lock()
+	}
+	return nil
+}
+
+// Barrier blocks until all entries submitted to this leader before the call
+// are committed and applied by the client, for example to flush the
+// entries of a previous leader before serving reads after a leadership change.
+// It appends a no-op entry, like a new leader does, and waits for it; an
+// entry commits only once all the entries before it did. It returns an error
+// matching ErrNotLeader if this CM isn't the leader, or stops being it before
+// the no-op commits, and ctx.Err() if ctx is done first.
+func (cm *ConsensusModule) Barrier(ctx context.Context) error {
+	cm.mu.Lock()
+	if cm.getState() != Leader {
+		cm.mu.Unlock()
+		return fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	cm.log = append(cm.log, LogEntry{Command: NoOpEntry{}, Term: cm.getTerm()})
+	cm.persistLog()
+	cm.triggerAE()
+	index, _ := cm.lastLogIndexAndTerm()
+	cm.mu.Unlock()
+
+	if err := cm.WaitForCommit(ctx, index); err != nil {
+		return err
+	}
+	return cm.waitForApplied(ctx, index)
+}
+
+// See figure 2 in the paper.
+type RequestVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+
+	// Force makes voters consider the vote even if they heard from a leader
+	// within the minimum election timeout. Without it they ignore the request
+	// (leader stickiness, section 4.2.3 of the Raft thesis), so a server that
+	// times out early can't unseat a healthy leader. Leadership transfers set
+	// it, because they're meant to unseat the leader.
+	Force bool
+}
+
+func (args RequestVoteArgs) String() string {
+	return fmt.Sprintf("{Term:%d CandidateId:%d LastLogIndex:%d LastLogTerm:%d Force:%v}", args.Term, args.CandidateId, args.LastLogIndex, args.LastLogTerm, args.Force)
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+// RequestVote RPC.
+func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Dead {
+		reply.Term = cm.getTerm()
+		return nil
+	}
+	cm.dlog("RequestVote: %+v [currentTerm=%d, votedFor=%d]", args, cm.getTerm(), cm.votedFor)
+
+	if !args.Force && cm.hasActiveLeader() {
+		// Neither the term nor the vote is changed.
+		cm.dlog("... ignoring RequestVote, leader %d is active", cm.leaderId)
+		reply.Term = cm.getTerm()
+		reply.VoteGranted = false
+		return nil
+	}
+
+	if args.Term > cm.getTerm() {
+		// A higher term always wins; step down to a follower in the new term
+		// before considering the vote. becomeFollower persists the new term.
+		cm.dlog("... term out of date in RequestVote")
+		cm.becomeFollower(args.Term)
+	}
+
+	if cm.getTerm() == args.Term &&
+		(cm.votedFor == -1 || cm.votedFor == args.CandidateId) &&
+		cm.isLogUpToDate(args.LastLogIndex, args.LastLogTerm) {
+		reply.VoteGranted = true
+		cm.votedFor = args.CandidateId
+		cm.recordEvent(Event{Type: EventVoteGranted, Peer: args.CandidateId})
+		cm.electionResetEvent = cm.clock.Now()
+		// The vote must be on stable storage before the reply leaves: the
+		// reply is only sent once this handler returns, and a server that
+		// crashed after granting but before persisting could vote for
+		// another candidate in the same term after restarting.
+		cm.persistTermAndVote()
+	} else {
+		reply.VoteGranted = false
+	}
+	reply.Term = cm.getTerm()
+	cm.dlog("... RequestVote reply: %+v", reply)
+	return nil
+}
+
+// hasActiveLeader reports whether this CM heard from the leader within the
+// minimum election timeout. Being the leader isn't enough on its own: a leader
+// cut off from the cluster must not hold off the elections that replace it, so
+// a leader only counts as active with CheckQuorum, when a majority of the
+// cluster acknowledged it within the minimum election timeout.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) hasActiveLeader() bool {
+	cm.assertLocked()
+	now := cm.clock.Now()
+	if cm.getState() == Leader {
+		return cm.config.CheckQuorum && now.Sub(cm.leaseStart()) < cm.config.ElectionTimeoutMin
+	}
+	return cm.leaderId != -1 && now.Sub(cm.lastLeaderContact) < cm.config.ElectionTimeoutMin
+}
+
+// isLogUpToDate reports whether a candidate whose log ends with an entry at
+// candLastIndex in candLastTerm has a log at least as up-to-date as this CM's
+// (section 5.4.1 of the paper): the log whose last entry has the later term is
+// more up-to-date, and if the terms are equal, the longer log is. Voting only
+// for such candidates guarantees that a leader holds all committed entries.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) isLogUpToDate(candLastIndex, candLastTerm int) bool {
+	cm.assertLocked()
+	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
+	return candLastTerm > lastLogTerm ||
+		(candLastTerm == lastLogTerm && candLastIndex >= lastLogIndex)
+}
+
+type LogEntry struct {
+	Command interface{}
+	Term    int
+}
+
+func init() {
+	gob.Register(NoOpEntry{})
+}
+
+// NoOpEntry is the command of the entry a leader appends to its log when it
+// takes office, and of the entries Barrier appends. Raft only lets a leader
+// commit entries from earlier terms indirectly, by committing an entry from
+// its own term; the no-op guarantees that happens even when clients submit
+// nothing. Like ConfigEntry, it's never delivered on the commit channel.
+type NoOpEntry struct{}
+
+// isInternalCommand reports whether command is used by Raft itself rather
+// than submitted by a client.
+func isInternalCommand(command interface{}) bool {
+	switch command.(type) {
+	case ConfigEntry, NoOpEntry:
+		return true
+	}
+	return false
+}
+
+// See figure 2 in the paper.
+type AppendEntriesArgs struct {
+	Term     int
+	LeaderId int
+
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+
+	// Traces holds, by log index, the encoded span contexts of the traced
+	// entries among Entries; see Tracer.
+	Traces map[int][]byte
+}
+
+// maxFormattedEntries is how many entries AppendEntriesArgs.String shows;
+// the others are only counted, so logging a batch of entries stays cheap.
+const maxFormattedEntries = 3
+
+func (args AppendEntriesArgs) String() string {
+	entries := fmt.Sprintf("%v", args.Entries)
+	if len(args.Entries) > maxFormattedEntries {
+		entries = fmt.Sprintf("%v... (%d entries)", args.Entries[:maxFormattedEntries], len(args.Entries))
+	}
+	return fmt.Sprintf("{Term:%d LeaderId:%d PrevLogIndex:%d PrevLogTerm:%d Entries:%s LeaderCommit:%d}", args.Term, args.LeaderId, args.PrevLogIndex, args.PrevLogTerm, entries, args.LeaderCommit)
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+
+	// Faster conflict resolution optimization (described near the end of
+	// section 5.3 in the paper). When Success is false because of a log
+	// mismatch, ConflictTerm is the term of the follower's entry at
+	// PrevLogIndex (or -1 if its log is too short) and ConflictIndex is the
+	// first index the follower stores for ConflictTerm (or its log length).
+	ConflictIndex int
+	ConflictTerm  int
+}
+
+// AppendEntries RPC.
+func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Dead {
+		reply.Term = cm.getTerm()
+		return nil
+	}
+	cm.dlog("AppendEntries: %+v", args)
+
+	if args.Term > cm.getTerm() {
+		cm.dlog("... term out of date in AppendEntries")
+		cm.becomeFollower(args.Term)
+	}
+
+	reply.Success = false
+	if args.Term == cm.getTerm() {
+		// A candidate that hears from a leader of its own term concedes.
+		if cm.getState() != Follower {
+			cm.becomeFollower(args.Term)
+		}
+		cm.electionResetEvent = cm.clock.Now()
+		cm.lastLeaderContact = cm.electionResetEvent
+		cm.setLeaderId(args.LeaderId)
+		cm.peerAnswered()
+
+		// Entries up to lastIncludedIndex are already covered by our snapshot
+		// and thus committed; skip any the leader resends.
+		if args.PrevLogIndex < cm.lastIncludedIndex {
+			skip := cm.lastIncludedIndex - args.PrevLogIndex
+			if skip > len(args.Entries) {
+				skip = len(args.Entries)
+			}
+			args.Entries = args.Entries[skip:]
+			args.PrevLogIndex = cm.lastIncludedIndex
+			args.PrevLogTerm = cm.lastIncludedTerm
+		}
+
+		// Does our log contain an entry at PrevLogIndex whose term matches
+		// PrevLogTerm? Note that in the extreme case of PrevLogIndex=-1 this is
+		// vacuously true, and PrevLogIndex=lastIncludedIndex is matched
+		// against the snapshot.
+		lastLogIndex, _ := cm.lastLogIndexAndTerm()
+		if args.PrevLogIndex == -1 ||
+			(args.PrevLogIndex <= lastLogIndex && args.PrevLogTerm == cm.entryAt(args.PrevLogIndex).Term) {
+			reply.Success = true
+			var traceCtxs map[int]context.Context
+			if cm.tracing && len(args.Traces) > 0 {
+				var spans []Span
+				traceCtxs, spans = cm.startAppendEntriesSpans(args)
+				defer endSpans(spans)
+			}
+
+			// Find an insertion point - where there's a term mismatch between
+			// the existing log starting at PrevLogIndex+1 and the new entries sent
+			// in the RPC. logInsertIndex is a position in cm.log, not a global
+			// log index. Entries we already have are skipped rather than
+			// rewritten, and nothing is truncated unless an entry conflicts,
+			// so a duplicated or reordered RPC leaves the log as it is: an
+			// older RPC carries a prefix of what a newer one did.
+			logInsertIndex := cm.logIndexToSlice(args.PrevLogIndex + 1)
+			newEntriesIndex := 0
+
+			for {
+				if logInsertIndex >= len(cm.log) || newEntriesIndex >= len(args.Entries) {
+					break
+				}
+				if cm.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+					break
+				}
+				logInsertIndex++
+				newEntriesIndex++
+			}
+			// At the end of this loop:
+			// - logInsertIndex points at the end of the log, or an index where the
+			//   term mismatches with an entry from the leader
+			// - newEntriesIndex points at the end of Entries, or an index where the
+			//   term mismatches with the corresponding log entry
+			if newEntriesIndex < len(args.Entries) {
+				// A conflicting entry and everything following it is dropped
+				// before the leader's entries are appended.
+				cm.dlog("... inserting entries %v from index %d", args.Entries[newEntriesIndex:], logInsertIndex)
+				if cm.tracing {
+					cm.dropTraces(cm.lastIncludedIndex + 1 + logInsertIndex)
+				}
+				cm.log = append(cm.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
+				cm.persistLog()
+				cm.applyConfiguration()
+				cm.dlog("... log is now: %v", cm.log)
+			}
+			for index, ctx := range traceCtxs {
+				if index > cm.lastIncludedIndex {
+					cm.traces[index] = ctx
+				}
+			}
+
+			// Set commit index. Only entries up to the last one in this RPC
+			// are known to match the leader's log; entries past it may be
+			// left over from an older leader.
+			if lastNewIndex := args.PrevLogIndex + len(args.Entries); args.LeaderCommit > cm.getCommitIndex() && lastNewIndex > cm.getCommitIndex() {
+				cm.setCommitIndex(intMin(args.LeaderCommit, lastNewIndex))
+				cm.dlog("... setting commitIndex=%d", cm.getCommitIndex())
+				cm.signalCommitReady()
+			}
+		} else {
+			// No match for PrevLogIndex/PrevLogTerm. Populate
+			// ConflictIndex/ConflictTerm to help the leader bring us up to date
+			// quickly. The scan stops at the snapshot: everything it covers
+			// is committed and matches the leader.
+			if args.PrevLogIndex > lastLogIndex {
+				reply.ConflictIndex = lastLogIndex + 1
+				reply.ConflictTerm = -1
+			} else {
+				reply.ConflictTerm = cm.entryAt(args.PrevLogIndex).Term
+
+				var i int
+				for i = args.PrevLogIndex - 1; i > cm.lastIncludedIndex; i-- {
+					if cm.entryAt(i).Term != reply.ConflictTerm {
+						break
+					}
+				}
+				reply.ConflictIndex = i + 1
+			}
+		}
+	}
+
+	reply.Term = cm.getTerm()
+	cm.dlog("AppendEntries reply: %+v", *reply)
+	return nil
 }
 
 // runElectionTimer implements an election timer. It should be launched whenever
@@ -45,38 +885,57 @@ type ConsensusModule struct {
 // it's designed to work for a single (one-shot) election timer, as it exits
 // whenever the CM state changes from follower/candidate or the term changes.
 func (cm *ConsensusModule) runElectionTimer() {
-	timeoutDuration := cm.electionTimeout()
 	cm.mu.Lock()
-	termStarted := cm.currentTerm
+	termStarted := cm.getTerm()
+	timeoutDuration := cm.isolationBackoff(cm.electionTimeout())
 	cm.mu.Unlock()
 
 	// This loops until either:
 	// - we discover the election timer is no longer needed, or
 	// - the election timer expires and this CM becomes a candidate
 	// In a follower, this typically keeps running in the background for the
-	// duration of the CM's lifetime.
-	ticker := time.NewTicker(10 * time.Millisecond)
+	// duration of the CM's lifetime. In a candidate, it's the timer of the
+	// election startElection just started: if that election splits the vote
+	// and nobody wins it, the timer expires and the candidate retries in the
+	// next term. Every timer draws a fresh random timeout, so candidates that
+	// split the vote once are unlikely to time out together again.
+	ticker := cm.clock.NewTicker(10 * time.Millisecond)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
+		<-ticker.C()
 
 		cm.mu.Lock()
-		if cm.state != Candidate && cm.state != Follower {
-			cm.dlog("In election timer state=%s, bailing out", cm.state)
+		if cm.getState() != Candidate && cm.getState() != Follower {
+			cm.dlog("In election timer state=%s, bailing out", cm.getState())
 			cm.mu.Unlock()
 			return
 		}
 
-		if termStarted != cm.currentTerm {
-			cm.dlog("In election timer term changed from %d to %d, bailing out", termStarted, cm.currentTerm)
+		if termStarted != cm.getTerm() {
+			cm.dlog("In election timer term changed from %d to %d, bailing out", termStarted, cm.getTerm())
 			cm.mu.Unlock()
 			return
 		}
 
 		// Start an election if nothing is heard from a leader or haven't voted for someone for the duration
 		// of the timeout.
-		if elapse := time.Since(cm.electionResetEvent); elapse >= timeoutDuration {
-			cm.startElection()
+		if elapse := cm.clock.Now().Sub(cm.electionResetEvent); elapse >= timeoutDuration {
+			if !cm.isVoter || cm.electionsPaused {
+				// Learners (and servers removed from the cluster) never
+				// campaign, nor do servers with paused elections; keep
+				// waiting in case that changes.
+				cm.electionResetEvent = cm.clock.Now()
+				cm.mu.Unlock()
+				continue
+			}
+			if cm.getState() == Candidate {
+				cm.dlog("election for term %d timed out without a majority, retrying", cm.getTerm())
+			}
+			if cm.config.PreVote {
+				cm.startPreVote(true)
+			} else {
+				cm.startElection(false)
+			}
 			cm.mu.Unlock()
 			return
 		}
@@ -84,14 +943,1017 @@ func (cm *ConsensusModule) runElectionTimer() {
 	}
 }
 
-// Creates a timeout of value between 150ms to 300ms
+// startElection starts a new election with this CM as a candidate. force is
+// set for intentional elections, from TimeoutNow or CampaignNow, that voters
+// grant even if they heard from a leader recently; see RequestVoteArgs.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startElection(force bool) {
+	cm.assertLocked()
+	from := cm.getState()
+	cm.setState(Candidate)
+	cm.setTerm(cm.getTerm() + 1)
+	cm.recordEvent(Event{Type: EventTermChange})
+	cm.recordStateChange(from)
+	cm.beginElectionRound()
+	savedCurrentTerm := cm.getTerm()
+	cm.electionResetEvent = cm.clock.Now()
+	cm.votedFor = cm.id
+	cm.persistTermAndVote()
+	cm.dlog("becomes Candidate (currentTerm=%d)", savedCurrentTerm)
+	cm.setLeaderId(-1)
+	cm.config.Metrics.SetState(Candidate)
+	cm.config.Metrics.SetTerm(savedCurrentTerm)
+	cm.config.Metrics.ElectionStarted()
+
+	savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
+	votes := map[int]bool{cm.id: true}
+
+	// Send RequestVote RPCs to all other servers concurrently. Votes are
+	// tallied as the replies arrive, so the election is won as soon as a
+	// majority granted its vote, without waiting for slow peers.
+	for _, peerId := range cm.peerIds {
+		go func(peerId int) {
+			args := RequestVoteArgs{
+				Term:         savedCurrentTerm,
+				CandidateId:  cm.id,
+				LastLogIndex: savedLastLogIndex,
+				LastLogTerm:  savedLastLogTerm,
+				Force:        force,
+			}
+			var reply RequestVoteReply
+
+			cm.dlog("sending RequestVote to %d: %+v", peerId, args)
+			if err := cm.callPeer(peerId, "ConsensusModule.RequestVote", args, &reply); err == nil {
+				cm.mu.Lock()
+				defer cm.mu.Unlock()
+				if cm.getState() == Dead {
+					return
+				}
+				cm.dlog("received RequestVoteReply %+v", reply)
+				cm.peerAnswered()
+
+				if cm.getState() != Candidate {
+					cm.dlog("while waiting for reply, state = %v", cm.getState())
+					return
+				}
+
+				if reply.Term > cm.getTerm() {
+					cm.dlog("term out of date in RequestVoteReply")
+					cm.becomeFollower(reply.Term)
+					return
+				} else if reply.Term == savedCurrentTerm && cm.getTerm() == savedCurrentTerm {
+					// Only count replies for the election this goroutine was
+					// started for; late replies from a stale term are ignored.
+					if reply.VoteGranted {
+						votes[peerId] = true
+						if cm.hasQuorum(func(id int) bool { return votes[id] }) {
+							// Won the election!
+							cm.dlog("wins election with %d votes", len(votes))
+							cm.startLeader()
+							return
+						}
+					}
+				}
+			}
+		}(peerId)
+	}
+
+	if cm.hasQuorum(func(id int) bool { return votes[id] }) {
+		// No peers to ask, e.g. in a single-server cluster.
+		cm.startLeader()
+		return
+	}
+
+	// Run another election timer, in case this election is not successful.
+	go cm.runElectionTimer()
+}
+
+// becomeFollower makes cm a follower and resets its state. The vote is only
+// cleared when term is newer than currentTerm: a server may vote at most once
+// per term, even if it steps down within that term. A term older than
+// currentTerm never moves it back; cm then steps down in its current term.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) becomeFollower(term int) {
+	cm.assertLocked()
+	if term < cm.getTerm() {
+		cm.dlog("becomeFollower with stale term=%d, staying in term %d", term, cm.getTerm())
+		term = cm.getTerm()
+	}
+	cm.dlog("becomes Follower with term=%d", term)
+	from := cm.getState()
+	cm.setState(Follower)
+	newTerm := term > cm.getTerm()
+	if newTerm {
+		cm.votedFor = -1
+	}
+	cm.setTerm(term)
+	if newTerm {
+		cm.recordEvent(Event{Type: EventTermChange})
+		cm.persistTermAndVote()
+	}
+	cm.recordStateChange(from)
+	cm.electionResetEvent = cm.clock.Now()
+	cm.config.Metrics.SetState(Follower)
+	cm.config.Metrics.SetTerm(term)
+	cm.stopLeading()
+
+	// Per-peer replication state is only meaningful for the leader that
+	// built it; a future leader term starts over in startLeader.
+	cm.nextIndex = make(map[int]int)
+	cm.matchIndex = make(map[int]int)
+	cm.peerAckTime = make(map[int]time.Time)
+	cm.inflight = make(map[int]int)
+	cm.submitTimes = make(map[int]time.Time)
+	if cm.tracing {
+		cm.endProposeSpans(-1)
+	}
+	cm.notifyCommitWaiters()
+	// A leader stepping down, or a new term, leaves no known leader until
+	// one is heard from.
+	if cm.leaderId == cm.id || newTerm {
+		cm.setLeaderId(-1)
+	}
+
+	go cm.runElectionTimer()
+}
+
+// startLeader switches cm into a leader state and begins process of heartbeats.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startLeader() {
+	cm.assertLocked()
+	from := cm.getState()
+	cm.setState(Leader)
+	cm.recordStateChange(from)
+	cm.ilog("becomes Leader; term=%d", cm.getTerm())
+	savedCurrentTerm := cm.getTerm()
+	cm.leaderSince = cm.clock.Now()
+	cm.setLeaderId(cm.id)
+	cm.config.Metrics.SetState(Leader)
+	cm.config.Metrics.ElectionWon()
+	cm.leaderStop = make(chan struct{})
+	stop := cm.leaderStop
+
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	cm.nextIndex = make(map[int]int)
+	cm.matchIndex = make(map[int]int)
+	cm.peerAckTime = make(map[int]time.Time)
+	cm.inflight = make(map[int]int)
+	cm.submitTimes = make(map[int]time.Time)
+	for _, peerId := range cm.replicationTargets() {
+		cm.nextIndex[peerId] = lastLogIndex + 1
+		cm.matchIndex[peerId] = -1
+	}
+
+	// The no-op goes out with the first round of heartbeats, and commits all
+	// entries from previous terms along with it.
+	cm.log = append(cm.log, LogEntry{Command: NoOpEntry{}, Term: cm.getTerm()})
+	cm.persistLog()
+
+	go func() {
+		// Heartbeats must go out well within the minimum election timeout,
+		// otherwise followers will start elections against a healthy leader.
+		ticker := cm.clock.NewTicker(cm.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		// Send periodic heartbeats, as long as still leader in the term this
+		// loop was started for. New entries are sent right away when Submit
+		// signals triggerAEChan, batched with whatever else is pending.
+		for {
+			cm.leaderSendHeartbeats(nil)
+			select {
+			case <-ticker.C():
+			case <-cm.triggerAEChan:
+			case <-stop:
+				return
+			}
+
+			cm.mu.Lock()
+			if cm.getState() != Leader || cm.getTerm() != savedCurrentTerm {
+				cm.mu.Unlock()
+				return
+			}
+			if cm.config.CheckQuorum && !cm.hasRecentQuorum() {
+				cm.wlog("no quorum acknowledged leadership within %v, stepping down", cm.config.ElectionTimeoutMax)
+				cm.becomeFollower(cm.getTerm())
+				cm.mu.Unlock()
+				return
+			}
+			cm.mu.Unlock()
+		}
+	}()
+}
+
+// advanceCommitIndex advances the leader's commitIndex to the highest index
+// stored on a majority of the voters, if that entry is from the current term.
+// With the voters' match indices (counting the leader's own log) sorted from
+// highest, the first one stored on a quorum is that index. Only an entry from
+// the current term is committed this way; earlier entries are committed
+// indirectly along with it (section 5.4.2 of the paper).
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) advanceCommitIndex() {
+	cm.assertLocked()
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	matchIndexOf := func(id int) int {
+		if id == cm.id {
+			return lastLogIndex
+		}
+		return cm.matchIndex[id]
+	}
+	matchIndices := []int{lastLogIndex}
+	for _, peerId := range cm.peerIds {
+		matchIndices = append(matchIndices, cm.matchIndex[peerId])
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(matchIndices)))
+	majorityIndex := -1
+	for _, index := range matchIndices {
+		if cm.hasQuorum(func(id int) bool { return matchIndexOf(id) >= index }) {
+			majorityIndex = index
+			break
+		}
+	}
+	if majorityIndex > cm.getCommitIndex() && cm.entryAt(majorityIndex).Term == cm.getTerm() {
+		cm.leaderCommit(majorityIndex)
+	}
+}
+
+// leaderCommit advances the leader's commitIndex to index, which is stored on
+// a majority, and hands the newly committed entries over to commitChanSender.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) leaderCommit(index int) {
+	cm.assertLocked()
+	cm.setCommitIndex(index)
+	cm.dlog("leader sets commitIndex := %d", cm.getCommitIndex())
+	now := cm.clock.Now()
+	for i, submitted := range cm.submitTimes {
+		if i <= cm.getCommitIndex() {
+			cm.config.Metrics.ObserveCommitLatency(now.Sub(submitted))
+			delete(cm.submitTimes, i)
+		}
+	}
+	if cm.tracing {
+		cm.endProposeSpans(cm.getCommitIndex())
+	}
+	cm.signalCommitReady()
+	cm.finishConfigChange()
+}
+
+// stopLeading stops the goroutines of the current leadership term, if any;
+// see leaderStop.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) stopLeading() {
+	cm.assertLocked()
+	if cm.leaderStop != nil {
+		close(cm.leaderStop)
+		cm.leaderStop = nil
+	}
+}
+
+// hasRecentQuorum implements CheckQuorum: it reports whether a majority of
+// the cluster acknowledged this leader within the last maximal election
+// timeout. A leader that just took office gets the benefit of the doubt for
+// one election timeout.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) hasRecentQuorum() bool {
+	cm.assertLocked()
+	now := cm.clock.Now()
+	if now.Sub(cm.leaderSince) < cm.config.ElectionTimeoutMax {
+		return true
+	}
+	return now.Sub(cm.leaseStart()) < cm.config.ElectionTimeoutMax
+}
+
+// leaderSendHeartbeats sends a round of heartbeats to all peers, collects their
+// replies and adjusts cm's state. If onAck isn't nil, it's called with cm.mu
+// locked for every peer that replies in the current term while cm is still
+// leader, acknowledging cm's leadership.
+func (cm *ConsensusModule) leaderSendHeartbeats(onAck func(peerId int)) {
+	cm.mu.Lock()
+	if cm.getState() != Leader {
+		cm.mu.Unlock()
+		return
+	}
+	savedCurrentTerm := cm.getTerm()
+	peerIds := cm.replicationTargets()
+	voterIds := append([]int(nil), cm.peerIds...)
+	if cm.hasQuorum(func(id int) bool { return id == cm.id }) {
+		// This CM is a majority on its own, as in a single-server cluster:
+		// its entries are committed as soon as they're in its log. Submit
+		// triggers a round right away, so they don't wait for a heartbeat.
+		cm.advanceCommitIndex()
+	}
+	cm.mu.Unlock()
+
+	for _, peerId := range peerIds {
+		// Learners don't acknowledge leadership, they don't vote.
+		onAck := onAck
+		if !containsId(voterIds, peerId) {
+			onAck = nil
+		}
+		go func(peerId int) {
+			cm.mu.Lock()
+			if cm.getState() != Leader || cm.getTerm() != savedCurrentTerm {
+				// Stepped down since the round started; an RPC now would
+				// be stale.
+				cm.mu.Unlock()
+				return
+			}
+			if cm.inflight[peerId] >= cm.config.MaxInflightAppends {
+				// The peer is slow to answer; don't pile up more RPCs (and
+				// goroutines) for it, the next round will try again.
+				cm.dlog("skipping AppendEntries to %d: %d in flight", peerId, cm.inflight[peerId])
+				cm.mu.Unlock()
+				return
+			}
+			ni := cm.nextIndex[peerId]
+			if ni <= cm.lastIncludedIndex {
+				// The entries this peer needs were compacted away; it has to
+				// catch up from our snapshot instead.
+				cm.mu.Unlock()
+				cm.leaderSendSnapshot(peerId, savedCurrentTerm, onAck)
+				return
+			}
+			prevLogIndex := ni - 1
+			prevLogTerm := cm.entryAt(prevLogIndex).Term
+			// Copy the entries so the RPC doesn't alias the log's backing array.
+			// All pending entries go out in one batch, up to
+			// MaxEntriesPerAppend; the rest follow once this batch is acked.
+			pending := cm.log[cm.logIndexToSlice(ni):]
+			if len(pending) > cm.config.MaxEntriesPerAppend {
+				pending = pending[:cm.config.MaxEntriesPerAppend]
+			}
+			entries := append([]LogEntry(nil), pending...)
+
+			args := AppendEntriesArgs{
+				Term:         savedCurrentTerm,
+				LeaderId:     cm.id,
+				PrevLogIndex: prevLogIndex,
+				PrevLogTerm:  prevLogTerm,
+				Entries:      entries,
+				LeaderCommit: cm.getCommitIndex(),
+			}
+			if cm.config.Pipeline {
+				// Assume the follower will accept these entries, so the next
+				// round sends what follows them without waiting for this
+				// reply. A failed reply moves nextIndex back again.
+				cm.nextIndex[peerId] = ni + len(entries)
+			}
+			var spans []Span
+			if cm.tracing {
+				spans = cm.startReplicateSpans(peerId, &args)
+			}
+			cm.inflight[peerId]++
+			inflight := cm.inflight
+			cm.config.Metrics.SetInflightAppends(peerId, inflight[peerId])
+			cm.mu.Unlock()
+			cm.dlog("sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, args)
+			sentAt := cm.clock.Now()
+			var reply AppendEntriesReply
+			err := cm.callPeer(peerId, "ConsensusModule.AppendEntries", args, &reply)
+			endSpans(spans)
+
+			cm.mu.Lock()
+			defer cm.mu.Unlock()
+			if cm.getState() == Dead {
+				// Stop may have been called while the RPC was in flight;
+				// a reply must not bring the CM back to life.
+				return
+			}
+			// Stepping down replaces the map, so this only touches the count
+			// of the term the RPC was sent in.
+			inflight[peerId]--
+			cm.config.Metrics.SetInflightAppends(peerId, inflight[peerId])
+			cm.config.Metrics.AppendEntriesResult(peerId, err == nil && reply.Success)
+			if err == nil {
+				if reply.Term > cm.getTerm() {
+					cm.dlog("term out of date in heartbeat reply")
+					cm.becomeFollower(reply.Term)
+					return
+				}
+
+				if cm.getState() == Leader && savedCurrentTerm == reply.Term {
+					cm.recordAck(peerId, sentAt, onAck)
+					if reply.Success {
+						// Replies may arrive out of order, when pipelining or
+						// when heartbeat rounds overlap; an older reply must
+						// not move the peer's progress back.
+						if match := ni + len(entries) - 1; match > cm.matchIndex[peerId] {
+							cm.matchIndex[peerId] = match
+						}
+						if cm.nextIndex[peerId] <= cm.matchIndex[peerId] {
+							cm.nextIndex[peerId] = cm.matchIndex[peerId] + 1
+						}
+						cm.dlog("AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v", peerId, cm.nextIndex, cm.matchIndex)
+						cm.advanceCommitIndex()
+						if lastLogIndex, _ := cm.lastLogIndexAndTerm(); cm.nextIndex[peerId] <= lastLogIndex {
+							// The batch was cut at MaxEntriesPerAppend; send
+							// the next one now rather than at the next
+							// heartbeat.
+							cm.triggerAE()
+						}
+					} else if cm.matchIndex[peerId] >= prevLogIndex {
+						// A later request already succeeded past this one's
+						// prevLogIndex, so the failure is stale.
+						cm.dlog("AppendEntries reply from %d !success ignored: matchIndex=%d, prevLogIndex=%d", peerId, cm.matchIndex[peerId], prevLogIndex)
+					} else {
+						// Skip back over the whole conflicting term at once,
+						// rather than by one entry per round-trip.
+						if reply.ConflictTerm >= 0 {
+							lastLogIndex, _ := cm.lastLogIndexAndTerm()
+							lastIndexOfTerm := -1
+							for i := lastLogIndex; i > cm.lastIncludedIndex; i-- {
+								if cm.entryAt(i).Term == reply.ConflictTerm {
+									lastIndexOfTerm = i
+									break
+								}
+							}
+							if lastIndexOfTerm >= 0 {
+								cm.nextIndex[peerId] = lastIndexOfTerm + 1
+							} else {
+								cm.nextIndex[peerId] = reply.ConflictIndex
+							}
+						} else {
+							cm.nextIndex[peerId] = reply.ConflictIndex
+						}
+						if cm.nextIndex[peerId] <= cm.matchIndex[peerId] {
+							cm.nextIndex[peerId] = cm.matchIndex[peerId] + 1
+						}
+						cm.dlog("AppendEntries reply from %d !success: nextIndex := %d", peerId, cm.nextIndex[peerId])
+					}
+				}
+			}
+		}(peerId)
+	}
+}
+
+// restoreFromStorage restores the persistent state of this CM from storage.
+// It should be called during constructor, before any concurrency concerns.
+func (cm *ConsensusModule) restoreFromStorage() error {
+	if termData, found := cm.storage.Get("currentTerm"); found {
+		d := gob.NewDecoder(bytes.NewBuffer(termData))
+		if err := d.Decode(&cm.currentTerm); err != nil {
+			return &CorruptStorageError{Key: "currentTerm", Err: err}
+		}
+		cm.logTerm.Store(int64(cm.currentTerm))
+	} else {
+		return &CorruptStorageError{Key: "currentTerm", Err: errNotFound}
+	}
+	if votedData, found := cm.storage.Get("votedFor"); found {
+		d := gob.NewDecoder(bytes.NewBuffer(votedData))
+		if err := d.Decode(&cm.votedFor); err != nil {
+			return &CorruptStorageError{Key: "votedFor", Err: err}
+		}
+	} else {
+		return &CorruptStorageError{Key: "votedFor", Err: errNotFound}
+	}
+	logFirstIndex := 0
+	if ls, ok := cm.storage.(LogStorage); ok {
+		logFirstIndex, cm.log = ls.LoadLog()
+	} else if logData, found := cm.storage.Get("log"); found {
+		d := gob.NewDecoder(bytes.NewBuffer(logData))
+		if err := d.Decode(&cm.log); err != nil {
+			return &CorruptStorageError{Key: "log", Err: err}
+		}
+	} else {
+		return &CorruptStorageError{Key: "log", Err: errNotFound}
+	}
+
+	// Snapshot state is optional; a node that never compacted its log has
+	// none.
+	if snapshotMetaData, found := cm.storage.Get("snapshotMeta"); found {
+		d := gob.NewDecoder(bytes.NewBuffer(snapshotMetaData))
+		if err := d.Decode(&cm.lastIncludedIndex); err != nil {
+			return &CorruptStorageError{Key: "snapshotMeta", Err: err}
+		}
+		if err := d.Decode(&cm.lastIncludedTerm); err != nil {
+			return &CorruptStorageError{Key: "snapshotMeta", Err: err}
+		}
+		if err := d.Decode(&cm.snapshotConfig); err != nil {
+			return &CorruptStorageError{Key: "snapshotMeta", Err: err}
+		}
+	}
+	if _, ok := cm.storage.(LogStorage); ok {
+		// The snapshot is persisted before the log is compacted, so the stored
+		// log may still hold entries the snapshot covers.
+		if logFirstIndex > cm.lastIncludedIndex+1 {
+			return &CorruptStorageError{Key: "log", Err: fmt.Errorf("log starts at index %d, after snapshot at index %d", logFirstIndex, cm.lastIncludedIndex)}
+		}
+		skip := intMin(cm.lastIncludedIndex+1-logFirstIndex, len(cm.log))
+		cm.log = cm.newLog(cm.log[skip:])
+	}
+	if cm.lastIncludedIndex >= 0 {
+		snapshot, found := cm.storage.Get("snapshot")
+		if !found {
+			return &CorruptStorageError{Key: "snapshot", Err: errNotFound}
+		}
+		data, err := cm.decodeSnapshot(snapshot)
+		if err != nil {
+			return &CorruptStorageError{Key: "snapshot", Err: err}
+		}
+		// Everything in the snapshot is committed; hand it to the client
+		// before any entry that follows it.
+		cm.snapshot = snapshot
+		cm.commitIndex = cm.lastIncludedIndex
+		cm.pendingSnapshot = true
+		cm.pendingSnapshotData = data
+		cm.signalCommitReady()
+	}
+	return nil
+}
+
+// callPeer sends an RPC to a peer, giving up on the reply after
+// Config.RPCTimeout.
+func (cm *ConsensusModule) callPeer(peerId int, serviceMethod string, args interface{}, reply interface{}) error {
+	return cm.callPeerTimeout(peerId, serviceMethod, args, reply, cm.config.RPCTimeout)
+}
+
+// callPeerTimeout is like callPeer, with the given timeout; it returns an
+// error matching ErrTimeout when the timeout expires.
+func (cm *ConsensusModule) callPeerTimeout(peerId int, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	// The timeout is measured on cm.clock rather than with a context deadline,
+	// so it follows a fake clock.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timedOut := make(chan struct{})
+	go func() {
+		select {
+		case <-cm.clock.After(timeout):
+			close(timedOut)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := cm.server.CallContext(ctx, peerId, serviceMethod, args, reply)
+	if errors.Is(err, context.Canceled) {
+		select {
+		case <-timedOut:
+			return fmt.Errorf("%s to peer %d: %w", serviceMethod, peerId, ErrTimeout)
+		default:
+		}
+	}
+	return err
+}
+
+// recordAck notes that peerId acknowledged this CM's leadership in response
+// to an RPC sent at sentAt, and calls onAck with peerId if it's not nil.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordAck(peerId int, sentAt time.Time, onAck func(peerId int)) {
+	cm.assertLocked()
+	if sentAt.After(cm.peerAckTime[peerId]) {
+		cm.peerAckTime[peerId] = sentAt
+	}
+	if onAck != nil {
+		onAck(peerId)
+	}
+}
+
+// persistTermAndVote saves currentTerm and votedFor in cm.storage. It must be
+// called after any change to either.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistTermAndVote() {
+	cm.assertLocked()
+	var termData bytes.Buffer
+	if err := gob.NewEncoder(&termData).Encode(cm.getTerm()); err != nil {
+		log.Fatal(err)
+	}
+	cm.storage.Set("currentTerm", termData.Bytes())
+
+	var votedData bytes.Buffer
+	if err := gob.NewEncoder(&votedData).Encode(cm.votedFor); err != nil {
+		log.Fatal(err)
+	}
+	cm.storage.Set("votedFor", votedData.Bytes())
+}
+
+// persistLog saves the log in cm.storage. It must be called after any change
+// to the log, and after persistSnapshot when the log was compacted.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistLog() {
+	cm.assertLocked()
+	if ls, ok := cm.storage.(LogStorage); ok {
+		ls.StoreLog(cm.lastIncludedIndex+1, cm.log)
+		return
+	}
+	var logData bytes.Buffer
+	if err := gob.NewEncoder(&logData).Encode(cm.log); err != nil {
+		log.Fatal(err)
+	}
+	cm.storage.Set("log", logData.Bytes())
+}
+
+// persistSnapshot saves the snapshot and its metadata in cm.storage. It must
+// be called whenever the snapshot changes, before the compacted log is
+// persisted: with a LogStorage, compacting the stored log before the snapshot
+// that replaces it is stored would lose entries on a crash.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) persistSnapshot() {
+	cm.assertLocked()
+	var snapshotMetaData bytes.Buffer
+	enc := gob.NewEncoder(&snapshotMetaData)
+	if err := enc.Encode(cm.lastIncludedIndex); err != nil {
+		log.Fatal(err)
+	}
+	if err := enc.Encode(cm.lastIncludedTerm); err != nil {
+		log.Fatal(err)
+	}
+	if err := enc.Encode(cm.snapshotConfig); err != nil {
+		log.Fatal(err)
+	}
+	cm.storage.Set("snapshotMeta", snapshotMetaData.Bytes())
+	cm.storage.Set("snapshot", cm.snapshot)
+}
+
+// newLog returns a copy of entries to use as cm.log, in a new backing array
+// with room for LogCapacity more entries. It's used whenever entries are
+// dropped from the front of the log, so the memory they hold can be garbage
+// collected.
+func (cm *ConsensusModule) newLog(entries []LogEntry) []LogEntry {
+	newEntries := make([]LogEntry, len(entries), len(entries)+cm.config.LogCapacity)
+	copy(newEntries, entries)
+	return newEntries
+}
+
+// logIndexToSlice translates a global log index into a position in cm.log,
+// accounting for the entries compacted into the snapshot.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) logIndexToSlice(index int) int {
+	cm.assertLocked()
+	return index - cm.lastIncludedIndex - 1
+}
+
+// lastLogIndexAndTerm returns the last log index and the last log entry's term
+// (or -1 if there's no log) for this server. Entries covered by the snapshot
+// count as part of the log.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) lastLogIndexAndTerm() (int, int) {
+	cm.assertLocked()
+	if len(cm.log) > 0 {
+		return cm.lastIncludedIndex + len(cm.log), cm.log[len(cm.log)-1].Term
+	}
+	return cm.lastIncludedIndex, cm.lastIncludedTerm
+}
+
+// entryAt returns the log entry at the given global index, which must be in
+// the range [lastIncludedIndex, lastLogIndex]. For index == lastIncludedIndex
+// (including -1 on an empty log) it returns an entry carrying only the
+// snapshot's term, since the entry itself was compacted away.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) entryAt(index int) LogEntry {
+	cm.assertLocked()
+	if index == cm.lastIncludedIndex {
+		return LogEntry{Term: cm.lastIncludedTerm}
+	}
+	return cm.log[cm.logIndexToSlice(index)]
+}
+
+// signalCommitReady notifies commitChanSender that commitIndex may have
+// advanced. It never blocks: a pending notification already covers every entry
+// committed up to the point commitChanSender wakes up.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) signalCommitReady() {
+	cm.assertLocked()
+	if cm.getState() == Dead {
+		return
+	}
+	cm.notifyCommitWaiters()
+	select {
+	case cm.newCommitReadyChan <- struct{}{}:
+	default:
+	}
+}
+
+// getState, getTerm and getCommitIndex return cm.state, cm.currentTerm and
+// cm.commitIndex; setState, setTerm and setCommitIndex set them. setTerm also
+// updates logTerm.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) getState() CMState {
+	cm.assertLocked()
+	return cm.state
+}
+
+func (cm *ConsensusModule) setState(state CMState) {
+	cm.assertLocked()
+	cm.state = state
+}
+
+func (cm *ConsensusModule) getTerm() int {
+	cm.assertLocked()
+	return cm.currentTerm
+}
+
+func (cm *ConsensusModule) setTerm(term int) {
+	cm.assertLocked()
+	cm.currentTerm = term
+	cm.logTerm.Store(int64(term))
+}
+
+func (cm *ConsensusModule) getCommitIndex() int {
+	cm.assertLocked()
+	return cm.commitIndex
+}
+
+func (cm *ConsensusModule) setCommitIndex(index int) {
+	cm.assertLocked()
+	cm.commitIndex = index
+}
+
+// setLeaderId records leaderId as the known leader and, if it changed,
+// announces it on leaderChanges. If the consumer hasn't received the previous
+// announcement yet, it's replaced, so the channel always holds the latest
+// leader.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) setLeaderId(leaderId int) {
+	cm.assertLocked()
+	if cm.getState() == Dead || leaderId == cm.leaderId {
+		return
+	}
+	cm.leaderId = leaderId
+	select {
+	case cm.leaderChanges <- leaderId:
+	default:
+		select {
+		case <-cm.leaderChanges:
+		default:
+		}
+		cm.leaderChanges <- leaderId
+	}
+}
+
+// notifyCommitWaiters wakes up all WaitForCommit and waitForApplied calls so
+// they re-check their condition.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) notifyCommitWaiters() {
+	cm.assertLocked()
+	close(cm.commitWaitChan)
+	cm.commitWaitChan = make(chan struct{})
+}
+
+// triggerAE wakes up the leader's replication loop to send new entries to
+// followers without waiting for the next heartbeat. It never blocks: a
+// pending trigger already covers all entries appended before the loop wakes.
+func (cm *ConsensusModule) triggerAE() {
+	select {
+	case cm.triggerAEChan <- struct{}{}:
+	default:
+	}
+}
+
+// commitChanSender is responsible for sending committed entries on
+// cm.commitChan. It watches newCommitReadyChan for notifications and calculates
+// which new entries are ready to be sent. Entries are sent exactly once, in
+// index order. This function should run in a separate background goroutine;
+// cm.commitChan may be buffered and will limit how fast the client consumes
+// new committed entries. The entries to send are collected under cm.mu, and
+// sent after releasing it, so a client that's slow to consume them doesn't
+// hold up elections and replication.
+func (cm *ConsensusModule) commitChanSender() {
+	for range cm.newCommitReadyChan {
+		// Find which entries we have to apply.
+		cm.mu.Lock()
+		var snapshotEntry *CommitEntry
+		if cm.pendingSnapshot {
+			snapshotEntry = &CommitEntry{
+				Index:      cm.lastIncludedIndex,
+				Term:       cm.lastIncludedTerm,
+				IsSnapshot: true,
+				Snapshot:   cm.pendingSnapshotData,
+			}
+			cm.pendingSnapshot = false
+			cm.pendingSnapshotData = nil
+			cm.lastApplied = cm.lastIncludedIndex
+			for index := range cm.traces {
+				if index <= cm.lastIncludedIndex {
+					delete(cm.traces, index)
+				}
+			}
+		}
+		savedLastApplied := cm.lastApplied
+		var entries []LogEntry
+		if cm.getCommitIndex() > cm.lastApplied {
+			entries = append([]LogEntry(nil), cm.log[cm.logIndexToSlice(cm.lastApplied+1):cm.logIndexToSlice(cm.getCommitIndex()+1)]...)
+			cm.lastApplied = cm.getCommitIndex()
+			cm.config.Metrics.EntriesCommitted(len(entries))
+		}
+		var traceCtxs map[int]context.Context
+		if cm.tracing {
+			traceCtxs = make(map[int]context.Context)
+			for i := range entries {
+				index := savedLastApplied + i + 1
+				if ctx, ok := cm.traces[index]; ok {
+					traceCtxs[index] = ctx
+					delete(cm.traces, index)
+				}
+			}
+		}
+		cm.mu.Unlock()
+		cm.dlog("commitChanSender entries=%v, savedLastApplied=%d", entries, savedLastApplied)
+
+		if snapshotEntry != nil {
+			cm.sendCommit(*snapshotEntry)
+		}
+		for i, entry := range entries {
+			if isInternalCommand(entry.Command) {
+				continue
+			}
+			index := savedLastApplied + i + 1
+			command, err := cm.decodeCommand(entry.Command)
+			if err != nil {
+				// The command was committed, so skipping it would make this
+				// server's state machine diverge from the others'.
+				log.Fatalf("decoding command at index %d: %v", index, err)
+			}
+			var span Span
+			if ctx, ok := traceCtxs[index]; ok {
+				_, span = cm.config.Tracer.Start(ctx, "commit")
+			}
+			cm.sendCommit(CommitEntry{
+				Command: command,
+				Index:   index,
+				Term:    entry.Term,
+			})
+			if span != nil {
+				span.End()
+			}
+		}
+
+		if snapshotEntry != nil || len(entries) > 0 {
+			cm.mu.Lock()
+			cm.deliveredIndex = savedLastApplied + len(entries)
+			cm.notifyCommitWaiters()
+			cm.mu.Unlock()
+			cm.maybeSnapshot()
+		}
+	}
+	cm.dlog("commitChanSender done")
+}
+
+// sendCommit sends entry on cm.commitChan, reporting the channel's depth to
+// the metrics first. With CommitStallWarning, it logs a warning every
+// CommitStallWarning for as long as the channel stays full.
+// Must be called without cm.mu held.
+func (cm *ConsensusModule) sendCommit(entry CommitEntry) {
+	cm.config.Metrics.SetCommitChanDepth(len(cm.commitChan), cap(cm.commitChan))
+	if cm.config.CommitStallWarning == 0 {
+		cm.commitChan <- entry
+		return
+	}
+
+	select {
+	case cm.commitChan <- entry:
+		return
+	default:
+	}
+	stalledSince := cm.clock.Now()
+	ticker := cm.clock.NewTicker(cm.config.CommitStallWarning)
+	defer ticker.Stop()
+	for {
+		select {
+		case cm.commitChan <- entry:
+			return
+		case <-ticker.C():
+			cm.mu.Lock()
+			dead := cm.getState() == Dead
+			cm.mu.Unlock()
+			if dead {
+				// No more warnings once the CM stopped; the client may
+				// have stopped consuming on purpose.
+				cm.commitChan <- entry
+				return
+			}
+			cm.wlog("commit channel full for %v, the client isn't consuming committed entries (next index=%d)", cm.clock.Now().Sub(stalledSince), entry.Index)
+		}
+	}
+}
+
+// isolatedElections is the number of consecutive elections no peer answers
+// after which the CM considers itself isolated, see Isolated.
+// maxIsolatedElectionTimeout caps the election timeout of an isolated CM.
+const (
+	isolatedElections          = 3
+	maxIsolatedElectionTimeout = 5 * time.Second
+)
+
+// Isolated reports whether this CM seems cut off from all its peers: none of
+// them answered its last few elections. This usually means the server is
+// misconfigured, or on its own side of a network partition. An isolated CM
+// backs off, waiting longer and longer between elections, so it doesn't spam
+// the log or inflate its term needlessly; it stops being isolated as soon as
+// it hears from a peer.
+func (cm *ConsensusModule) Isolated() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.unansweredElections >= isolatedElections
+}
+
+// beginElectionRound is called whenever this CM starts an election or a
+// pre-vote; it counts the previous one as unanswered unless a peer answered
+// it.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) beginElectionRound() {
+	cm.assertLocked()
+	if len(cm.peerIds) > 0 && !cm.electionAnswered {
+		cm.unansweredElections++
+		if cm.unansweredElections == isolatedElections {
+			cm.wlog("isolated: no peers reachable in %d elections, backing off", isolatedElections)
+		}
+	}
+	cm.electionAnswered = false
+}
+
+// peerAnswered is called whenever this CM hears from a peer in an election,
+// or from a leader.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) peerAnswered() {
+	cm.assertLocked()
+	if cm.unansweredElections >= isolatedElections {
+		cm.ilog("no longer isolated")
+	}
+	cm.unansweredElections = 0
+	cm.electionAnswered = true
+}
+
+// isolationBackoff returns the election timeout to use instead of timeout:
+// timeout itself, unless this CM is isolated, in which case it doubles for
+// every further unanswered election, up to maxIsolatedElectionTimeout.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) isolationBackoff(timeout time.Duration) time.Duration {
+	cm.assertLocked()
+	for i := isolatedElections; i <= cm.unansweredElections && timeout < maxIsolatedElectionTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > maxIsolatedElectionTimeout {
+		timeout = maxIsolatedElectionTimeout
+	}
+	return timeout
+}
+
+// electionTimeout generates a pseudo-random election timeout duration in the
+// configured [ElectionTimeoutMin, ElectionTimeoutMax) range, widened for large
+// clusters with ScaleElectionTimeout, and delayed for servers of lower
+// priority, see Config.Priorities.
+// Expects cm.mu to be locked.
 func (cm *ConsensusModule) electionTimeout() time.Duration {
-	return time.Duration(150+rand.Intn(150)) * time.Millisecond
+	cm.assertLocked()
+	spread := cm.config.ElectionTimeoutMax - cm.config.ElectionTimeoutMin
+	if servers := len(cm.peerIds) + 1; cm.config.ScaleElectionTimeout && servers > 3 {
+		// The expected gap between the two earliest of n timeouts drawn
+		// from the spread is spread/(n+1); scale the spread so the gap stays
+		// what it is in a 3-server cluster.
+		spread = spread * time.Duration(servers+1) / 4
+	}
+	cm.randMu.Lock()
+	defer cm.randMu.Unlock()
+	timeout := cm.config.ElectionTimeoutMin + time.Duration(cm.rand.Int63n(int64(spread)))
+	return timeout + time.Duration(cm.priorityRank())*spread
 }
 
+// priorityRank returns how far this CM's priority is below the highest one
+// in Config.Priorities.
+func (cm *ConsensusModule) priorityRank() int {
+	if len(cm.config.Priorities) == 0 {
+		return 0
+	}
+	highest := 0
+	for _, priority := range cm.config.Priorities {
+		if priority > highest {
+			highest = priority
+		}
+	}
+	return highest - cm.config.Priorities[cm.id]
+}
+
+// assertLocked panics if cm.mu isn't locked. Every method documented with
+// "Expects cm.mu to be locked." calls it first, so in builds with the
+// raftdebug tag a call that doesn't hold the lock fails loudly instead of
+// racing on the CM's state; otherwise it compiles to nothing. It can only
+// tell that some goroutine holds cm.mu, not which.
+func (cm *ConsensusModule) assertLocked() {
+	if lockChecks && cm.mu.TryLock() {
+		cm.mu.Unlock()
+		panic(fmt.Sprintf("server %d: cm.mu is not locked", cm.id))
+	}
+}
+
+// dlog, ilog and wlog log a message at the debug, info and warning level,
+// respectively. They may be called with or without cm.mu held.
 func (cm *ConsensusModule) dlog(format string, args ...interface{}) {
-	if DebugCM > 0 {
-		format = fmt.Sprintf("[%d] ", cm.id) + format
-		log.Printf(format, args...)
+	cm.config.Logger.Debugf(cm.logFields(), format, args...)
+}
+
+func (cm *ConsensusModule) ilog(format string, args ...interface{}) {
+	cm.config.Logger.Infof(cm.logFields(), format, args...)
+}
+
+func (cm *ConsensusModule) wlog(format string, args ...interface{}) {
+	cm.config.Logger.Warnf(cm.logFields(), format, args...)
+}
+
+func (cm *ConsensusModule) logFields() LogFields {
+	return LogFields{Id: cm.id, Term: int(cm.logTerm.Load())}
+}
+
+func intMin(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
 }
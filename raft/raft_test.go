@@ -0,0 +1,1716 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestElectionBasic(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+}
+
+func TestElectionLeaderDisconnect(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(350)
+
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == origLeaderId {
+		t.Errorf("want new leader to be different from orig leader")
+	}
+	if newTerm <= origTerm {
+		t.Errorf("want newTerm > origTerm, got %d and %d", newTerm, origTerm)
+	}
+}
+
+func TestElectionLeaderAndAnotherDisconnect(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+
+	h.DisconnectPeer(origLeaderId)
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+
+	// No quorum.
+	sleepMs(450)
+	h.CheckNoLeader()
+
+	// Reconnect one other server; now we'll have quorum.
+	h.ReconnectPeer(otherId)
+	h.CheckSingleLeader()
+}
+
+func TestDisconnectAllThenRestore(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	sleepMs(100)
+	// Disconnect all servers from the start. There will be no leader.
+	for i := 0; i < 3; i++ {
+		h.DisconnectPeer(i)
+	}
+	sleepMs(450)
+	h.CheckNoLeader()
+
+	// Reconnect all servers. A leader will be found.
+	for i := 0; i < 3; i++ {
+		h.ReconnectPeer(i)
+	}
+	h.CheckSingleLeader()
+}
+
+func TestElectionLeaderDisconnectThenReconnect(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	origLeaderId, _ := h.CheckSingleLeader()
+
+	h.DisconnectPeer(origLeaderId)
+
+	sleepMs(350)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+
+	h.ReconnectPeer(origLeaderId)
+	sleepMs(150)
+
+	againLeaderId, againTerm := h.CheckSingleLeader()
+
+	if newLeaderId != againLeaderId {
+		t.Errorf("again leader id got %d; want %d", againLeaderId, newLeaderId)
+	}
+	if againTerm != newTerm {
+		t.Errorf("again term got %d; want %d", againTerm, newTerm)
+	}
+}
+
+func TestElectionFollowerComesBack(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(650)
+	h.ReconnectPeer(otherId)
+	sleepMs(150)
+
+	// The follower that came back may have bumped its term while it was
+	// partitioned; either way, there's a single leader again.
+	_, newTerm := h.CheckSingleLeader()
+	if newTerm < origTerm {
+		t.Errorf("newTerm=%d, origTerm=%d", newTerm, origTerm)
+	}
+}
+
+func TestCommitOneCommand(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+
+	t.Logf("submitting 42 to %d", origLeaderId)
+	isLeader := h.cluster[origLeaderId].IsLeader()
+	if !isLeader {
+		t.Errorf("want id=%d leader, but it's not", origLeaderId)
+	}
+	h.SubmitToLeader(42)
+
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+}
+
+func TestSubmitNonLeaderFails(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	sid := (origLeaderId + 1) % 3
+	if _, _, isLeader := h.cluster[sid].Submit(42); isLeader {
+		t.Errorf("want id=%d !leader, but it is", sid)
+	}
+	sleepMs(10)
+}
+
+func TestCommitMultipleCommands(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+
+	values := []int{42, 55, 81}
+	for _, v := range values {
+		h.SubmitToLeader(v)
+		sleepMs(100)
+	}
+
+	sleepMs(250)
+	nc, i1 := h.CheckCommitted(42)
+	_, i2 := h.CheckCommitted(55)
+	if nc != 3 {
+		t.Errorf("want nc=3, got %d", nc)
+	}
+	if i1 >= i2 {
+		t.Errorf("want i1<i2, got i1=%d i2=%d", i1, i2)
+	}
+
+	_, i3 := h.CheckCommitted(81)
+	if i2 >= i3 {
+		t.Errorf("want i2<i3, got i2=%d i3=%d", i2, i3)
+	}
+}
+
+func TestCommitWithDisconnectionAndRecover(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Submit a couple of values to a fully connected cluster.
+	h.SubmitToLeader(5)
+	h.SubmitToLeader(6)
+
+	sleepMs(250)
+	h.CheckCommittedN(6, 3)
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	dPeerId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(dPeerId)
+	sleepMs(250)
+
+	// Submit a new command; it will be committed but only to two servers.
+	h.SubmitToLeader(7)
+	sleepMs(250)
+	h.CheckCommittedN(7, 2)
+
+	// Now reconnect dPeerId and wait a bit; it should find the new command too.
+	h.ReconnectPeer(dPeerId)
+	sleepMs(250)
+	h.CheckSingleLeader()
+
+	sleepMs(150)
+	h.CheckCommittedN(7, 3)
+}
+
+func TestNoCommitWithNoQuorum(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Submit a couple of values to a fully connected cluster.
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	h.SubmitToLeader(5)
+	h.SubmitToLeader(6)
+
+	sleepMs(250)
+	h.CheckCommittedN(6, 3)
+
+	// Disconnect both followers.
+	dPeer1 := (origLeaderId + 1) % 3
+	dPeer2 := (origLeaderId + 2) % 3
+	h.DisconnectPeer(dPeer1)
+	h.DisconnectPeer(dPeer2)
+	sleepMs(250)
+
+	h.cluster[origLeaderId].Submit(8)
+	sleepMs(250)
+	h.CheckNotCommitted(8)
+
+	// Reconnect both other servers, we'll have quorum now.
+	h.ReconnectPeer(dPeer1)
+	h.ReconnectPeer(dPeer2)
+	sleepMs(600)
+
+	// A new leader will be elected. It could be a different leader, even
+	// though the original's log is longer, because the two reconnected peers
+	// can elect each other; then 8 is overwritten, and never committed. If
+	// the original leader wins again, the no-op of its new term commits 8.
+	newLeaderId, againTerm := h.CheckSingleLeader()
+	if origTerm == againTerm {
+		t.Errorf("got origTerm==againTerm==%d; want them different", origTerm)
+	}
+	if newLeaderId == origLeaderId {
+		h.CheckCommittedN(8, 3)
+	} else {
+		h.CheckNotCommitted(8)
+	}
+
+	// But new values will be committed for sure...
+	h.cluster[newLeaderId].Submit(9)
+	h.cluster[newLeaderId].Submit(10)
+	h.cluster[newLeaderId].Submit(11)
+	sleepMs(350)
+
+	for _, v := range []int{9, 10, 11} {
+		h.CheckCommittedN(v, 3)
+	}
+}
+
+func TestCrashFollower(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToLeader(5)
+
+	sleepMs(350)
+	h.CheckCommittedN(5, 3)
+
+	h.CrashPeer((origLeaderId + 1) % 3)
+	sleepMs(350)
+	h.CheckCommittedN(5, 2)
+}
+
+func TestCrashThenRestartFollower(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToLeader(5)
+	h.SubmitToLeader(6)
+	h.SubmitToLeader(7)
+
+	vals := []int{5, 6, 7}
+
+	sleepMs(350)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 3)
+	}
+
+	h.CrashPeer((origLeaderId + 1) % 3)
+	sleepMs(300)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 2)
+	}
+
+	// Restart the crashed follower and give it some time to come up-to-date.
+	h.RestartPeer((origLeaderId + 1) % 3)
+	sleepMs(650)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 3)
+	}
+}
+
+func TestCrashThenRestartLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToLeader(5)
+	h.SubmitToLeader(6)
+	h.SubmitToLeader(7)
+
+	vals := []int{5, 6, 7}
+
+	sleepMs(350)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 3)
+	}
+
+	h.CrashPeer(origLeaderId)
+	sleepMs(350)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 2)
+	}
+
+	h.RestartPeer(origLeaderId)
+	sleepMs(550)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 3)
+	}
+}
+
+func TestCrashThenRestartAll(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+	h.SubmitToLeader(6)
+	h.SubmitToLeader(7)
+	sleepMs(350)
+	h.CheckCommittedN(7, 3)
+
+	for i := 0; i < 3; i++ {
+		h.CrashPeer(i)
+	}
+	sleepMs(350)
+	for i := 0; i < 3; i++ {
+		h.RestartPeer(i)
+	}
+
+	// The restarted servers recover their logs from storage, but only commit
+	// them again once a leader commits an entry of its own term.
+	sleepMs(650)
+	h.CheckSingleLeader()
+	h.CheckCommittedN(7, 3)
+}
+
+// newIdleCM creates a CM with peers 1 and 2 whose ready channel is never
+// closed, so it never starts an election; tests call its RPC handlers
+// directly. It's stopped when the test ends.
+func newIdleCM(t *testing.T, config *Config) *ConsensusModule {
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cm.Stop)
+	return cm
+}
+
+// setLog replaces the log of cm with entries of the given terms, and makes
+// term the current one.
+func setLog(cm *ConsensusModule, term int, terms ...int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.log = nil
+	for i, term := range terms {
+		cm.log = append(cm.log, LogEntry{Command: i, Term: term})
+	}
+	cm.currentTerm = term
+	cm.persistTermAndVote()
+	cm.persistLog()
+}
+
+func TestAppendEntriesConflictHints(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	setLog(cm, 3, 1, 1, 2, 2, 2)
+
+	var tests = []struct {
+		prevLogIndex      int
+		prevLogTerm       int
+		wantConflictIndex int
+		wantConflictTerm  int
+	}{
+		// The follower has term 2 at index 4: the leader can skip all of it.
+		{4, 3, 2, 2},
+		// The follower's log is too short.
+		{7, 3, 5, -1},
+		{1, 2, 0, 1},
+	}
+	for _, tt := range tests {
+		var reply AppendEntriesReply
+		args := AppendEntriesArgs{Term: 3, LeaderId: 1, PrevLogIndex: tt.prevLogIndex, PrevLogTerm: tt.prevLogTerm, LeaderCommit: -1}
+		if err := cm.AppendEntries(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Success || reply.ConflictIndex != tt.wantConflictIndex || reply.ConflictTerm != tt.wantConflictTerm {
+			t.Errorf("PrevLogIndex=%d PrevLogTerm=%d: got %+v; want ConflictIndex=%d ConflictTerm=%d", tt.prevLogIndex, tt.prevLogTerm, reply, tt.wantConflictIndex, tt.wantConflictTerm)
+		}
+	}
+}
+
+func TestDivergentLogIsOverwritten(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	h.SubmitToLeader(1)
+	sleepMs(250)
+	h.CheckCommittedN(1, 3)
+
+	// The partitioned leader appends entries of its term that never commit.
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.DisconnectPeer(origLeaderId)
+	for v := 100; v < 110; v++ {
+		h.cluster[origLeaderId].Submit(v)
+	}
+
+	sleepMs(350)
+	for v := 2; v <= 4; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+
+	// Back in the cluster, the old leader drops its conflicting entries and
+	// takes those of the new leader.
+	h.ReconnectPeer(origLeaderId)
+	sleepMs(400)
+	for v := 2; v <= 4; v++ {
+		h.CheckCommittedN(v, 3)
+	}
+	for v := 100; v < 110; v++ {
+		h.CheckNotCommitted(v)
+	}
+}
+
+func TestLeaderCommitsNoOp(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, term := h.CheckSingleLeader()
+	sleepMs(150)
+
+	// Without any client command, the new leader commits a no-op of its term.
+	cm := h.cluster[leaderId].cm
+	commitIndex := cm.CommitIndex()
+	entries := cm.LogSlice(0, commitIndex+1)
+	if len(entries) == 0 {
+		t.Fatalf("nothing committed by leader %d", leaderId)
+	}
+	if last := entries[len(entries)-1]; last.Command != (NoOpEntry{}) || last.Term != term {
+		t.Errorf("last committed entry %+v; want a no-op of term %d", last, term)
+	}
+
+	// The no-op is internal, and never delivered to clients.
+	for i := 0; i < 3; i++ {
+		if commits := h.Commits(i); len(commits) != 0 {
+			t.Errorf("server %d committed %v; want nothing", i, commits)
+		}
+	}
+	h.SubmitToLeader(42)
+	sleepMs(150)
+	nc, index := h.CheckCommitted(42)
+	if nc != 3 || index != commitIndex+1 {
+		t.Errorf("42 committed on %d servers at index %d; want 3 at %d", nc, index, commitIndex+1)
+	}
+}
+
+// TestFigure8 replays figure 8 of the paper on CMs driven by hand: an entry
+// from an earlier term that reached a majority isn't committed by counting
+// replicas, since a later leader may still overwrite it. It is committed along
+// with an entry of the leader's own term, which no such leader can overwrite.
+func TestFigure8(t *testing.T) {
+	config := DefaultConfig()
+	config.ElectionTimeoutMin = time.Hour
+	config.ElectionTimeoutMax = 2 * time.Hour
+	config.Logger = NopLogger{}
+	newCluster := func() []*ConsensusModule {
+		var cms []*ConsensusModule
+		for id := 0; id < 5; id++ {
+			var peerIds []int
+			for p := 0; p < 5; p++ {
+				if p != id {
+					peerIds = append(peerIds, p)
+				}
+			}
+			cm, err := NewConsensusModule(id, peerIds, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(cm.Stop)
+			cms = append(cms, cm)
+		}
+		return cms
+	}
+	appendEntries := func(leader, follower *ConsensusModule) {
+		leader.mu.Lock()
+		args := AppendEntriesArgs{
+			Term:         leader.currentTerm,
+			LeaderId:     leader.id,
+			PrevLogIndex: 0,
+			PrevLogTerm:  leader.log[0].Term,
+			Entries:      append([]LogEntry(nil), leader.log[1:]...),
+			LeaderCommit: leader.commitIndex,
+		}
+		leader.mu.Unlock()
+		var reply AppendEntriesReply
+		follower.AppendEntries(args, &reply)
+		if !reply.Success {
+			t.Fatalf("AppendEntries %+v from %d to %d failed", args, leader.id, follower.id)
+		}
+	}
+	// lead makes cm the leader of its current term, with the given
+	// matchIndex, and returns its commitIndex once it counted replicas.
+	lead := func(cm *ConsensusModule, matchIndex map[int]int) int {
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		cm.state = Leader
+		cm.matchIndex = matchIndex
+		cm.advanceCommitIndex()
+		return cm.commitIndex
+	}
+	votes := func(candidate *ConsensusModule, term int, voters ...*ConsensusModule) int {
+		candidate.mu.Lock()
+		lastLogIndex, lastLogTerm := candidate.lastLogIndexAndTerm()
+		candidate.mu.Unlock()
+		args := RequestVoteArgs{Term: term, CandidateId: candidate.id, LastLogIndex: lastLogIndex, LastLogTerm: lastLogTerm, Force: true}
+		granted := 1
+		for _, voter := range voters {
+			var reply RequestVoteReply
+			voter.RequestVote(args, &reply)
+			if reply.VoteGranted {
+				granted++
+			}
+		}
+		return granted
+	}
+
+	// (a)-(b): S0 led term 2 and replicated its entry at index 1 to S1 only;
+	// S4 led term 3 and appended an entry at index 1 that nobody has.
+	// (c): S0, leader again in term 4, replicates its term-2 entry to S2. It's
+	// now stored on a majority, but isn't committed.
+	s := newCluster()
+	setLog(s[0], 4, 1, 2)
+	setLog(s[1], 2, 1, 2)
+	setLog(s[2], 3, 1)
+	setLog(s[3], 3, 1)
+	setLog(s[4], 3, 1, 3)
+	appendEntries(s[0], s[2])
+	if commitIndex := lead(s[0], map[int]int{1: 1, 2: 1, 3: 0, 4: 0}); commitIndex != -1 {
+		t.Fatalf("commitIndex=%d after replicating a term-2 entry to a majority in term 4; want -1", commitIndex)
+	}
+
+	// (d): S0 crashes, and S4 is elected in term 5 with the votes of S1-S3:
+	// its last entry has a later term than theirs. Its AppendEntries then
+	// replaces the term-2 entry everywhere, so committing it would have lost
+	// a committed entry.
+	if granted := votes(s[4], 5, s[1], s[2], s[3]); granted < 3 {
+		t.Fatalf("S4 got %d votes in term 5; want a majority", granted)
+	}
+	setLog(s[4], 5, 1, 3)
+	for _, follower := range s[1:4] {
+		appendEntries(s[4], follower)
+		if entry := follower.LogSlice(1, 2)[0]; entry.Term != 3 {
+			t.Errorf("S%d has %+v at index 1; want S4's term-3 entry", follower.id, entry)
+		}
+	}
+
+	// (e): had S0 replicated an entry of term 4 along with it, both would be
+	// committed, and S4 could no longer win an election.
+	s = newCluster()
+	setLog(s[0], 4, 1, 2, 4)
+	setLog(s[1], 2, 1, 2)
+	setLog(s[2], 3, 1)
+	setLog(s[3], 3, 1)
+	setLog(s[4], 3, 1, 3)
+	appendEntries(s[0], s[1])
+	appendEntries(s[0], s[2])
+	if commitIndex := lead(s[0], map[int]int{1: 2, 2: 2, 3: 0, 4: 0}); commitIndex != 2 {
+		t.Fatalf("commitIndex=%d after replicating a term-4 entry to a majority in term 4; want 2", commitIndex)
+	}
+	if granted := votes(s[4], 5, s[1], s[2], s[3]); granted >= 3 {
+		t.Errorf("S4 got %d votes in term 5; want no majority", granted)
+	}
+}
+
+func TestAppendEntriesBatching(t *testing.T) {
+	var mu sync.Mutex
+	maxBatch := 0
+	config := DefaultConfig()
+	config.MaxEntriesPerAppend = 4
+	config.OnRPCSend = func(peerId int, serviceMethod string, args interface{}) {
+		if args, ok := args.(AppendEntriesArgs); ok {
+			mu.Lock()
+			if len(args.Entries) > maxBatch {
+				maxBatch = len(args.Entries)
+			}
+			mu.Unlock()
+		}
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	// A follower that was away gets the entries it missed in batches of at
+	// most MaxEntriesPerAppend.
+	leaderId, _ := h.CheckSingleLeader()
+	h.DisconnectPeer((leaderId + 1) % 3)
+	h.DisconnectPeer((leaderId + 2) % 3)
+	for v := 1; v <= 10; v++ {
+		h.cluster[leaderId].Submit(v)
+	}
+	h.ReconnectPeer((leaderId + 1) % 3)
+	h.ReconnectPeer((leaderId + 2) % 3)
+	sleepMs(400)
+
+	for v := 1; v <= 10; v++ {
+		h.CheckCommittedN(v, 3)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxBatch != 4 {
+		t.Errorf("largest batch had %d entries; want 4", maxBatch)
+	}
+}
+
+// BenchmarkSubmitBurst measures the commit throughput of a burst of b.N
+// commands, as replication batches them or not. MapStorage encodes the whole
+// log on every Submit, so ns/op grows with b.N: compare the sub-benchmarks at
+// the same -benchtime, e.g. -benchtime=2000x.
+func BenchmarkSubmitBurst(b *testing.B) {
+	for _, maxEntries := range []int{1, 256} {
+		b.Run(fmt.Sprintf("MaxEntriesPerAppend=%d", maxEntries), func(b *testing.B) {
+			config := DefaultConfig()
+			config.MaxEntriesPerAppend = maxEntries
+			config.Logger = NopLogger{}
+			h := NewHarnessWithConfig(b, 3, config)
+			defer h.Shutdown()
+			leaderId, _ := h.CheckSingleLeader()
+
+			b.ResetTimer()
+			lastIndex := -1
+			for i := 0; i < b.N; i++ {
+				index, _, isLeader := h.cluster[leaderId].Submit(i)
+				if !isLeader {
+					b.Fatalf("server %d lost leadership", leaderId)
+				}
+				lastIndex = index
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := h.cluster[leaderId].cm.WaitForCommit(ctx, lastIndex); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "commits/s")
+		})
+	}
+}
+
+func TestAdvanceCommitIndex(t *testing.T) {
+	cm, err := NewConsensusModule(0, []int{1, 2, 3}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	setLog(cm, 2, 1, 1, 2, 2, 2, 2)
+
+	// The leader has all 6 entries; a majority of the four voters is three.
+	var tests = []struct {
+		matchIndex map[int]int
+		want       int
+	}{
+		{map[int]int{1: -1, 2: -1, 3: -1}, -1},
+		{map[int]int{1: 5, 2: -1, 3: -1}, -1},
+		{map[int]int{1: 5, 2: 3, 3: -1}, 3},
+		{map[int]int{1: 4, 2: 3, 3: 2}, 3},
+		{map[int]int{1: 5, 2: 5, 3: 0}, 5},
+		// Entry 1 is from an earlier term, so it's only committed along with
+		// one from the current term.
+		{map[int]int{1: 1, 2: 1, 3: 0}, -1},
+	}
+	for i, tt := range tests {
+		cm.mu.Lock()
+		cm.state = Leader
+		cm.commitIndex = -1
+		cm.matchIndex = tt.matchIndex
+		cm.advanceCommitIndex()
+		got := cm.commitIndex
+		cm.state = Follower
+		cm.mu.Unlock()
+		if got != tt.want {
+			t.Errorf("%d: match indices %v: commitIndex = %d; want %d", i, tt.matchIndex, got, tt.want)
+		}
+	}
+
+	// In a cluster, two of four servers with the entries don't commit them,
+	// a third one does.
+	config := DefaultConfig()
+	config.PreVote = true
+	h := NewHarnessWithConfig(t, 4, config)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	h.SubmitToLeader(1)
+	sleepMs(150)
+	h.CheckCommittedN(1, 4)
+	h.DisconnectPeer((leaderId + 1) % 4)
+	h.DisconnectPeer((leaderId + 2) % 4)
+	h.SubmitToLeader(2)
+	sleepMs(250)
+	h.CheckNotCommitted(2)
+	h.ReconnectPeer((leaderId + 1) % 4)
+	sleepMs(250)
+	h.CheckCommittedN(2, 3)
+}
+
+func TestPipelineCommitsInOrder(t *testing.T) {
+	config := DefaultConfig()
+	config.Pipeline = true
+	config.MaxEntriesPerAppend = 4
+	// The lagging follower's elections while it's cut off mustn't depose the
+	// leader when it comes back.
+	config.PreVote = true
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	for v := 1; v <= 10; v++ {
+		h.SubmitToLeader(v)
+	}
+
+	// A follower that misses pipelined entries makes the leader move its
+	// nextIndex back, and catches up.
+	lagging := (leaderId + 1) % 3
+	h.DisconnectPeer(lagging)
+	for v := 11; v <= 20; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(150)
+	h.ReconnectPeer(lagging)
+	sleepMs(800)
+
+	prevIndex := -1
+	for v := 1; v <= 20; v++ {
+		nc, index := h.CheckCommitted(v)
+		if nc != 3 {
+			t.Errorf("%d committed on %d servers; want 3", v, nc)
+		}
+		if index <= prevIndex {
+			t.Errorf("%d committed at index %d, after index %d", v, index, prevIndex)
+		}
+		prevIndex = index
+	}
+}
+
+// BenchmarkCommitLatency measures the latency from Submit to commit on the
+// leader, reported as ns/commit, with clients submitting in parallel, with
+// pipelining and without it. As with BenchmarkSubmitBurst, compare at the same
+// -benchtime.
+func BenchmarkCommitLatency(b *testing.B) {
+	for _, pipeline := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Pipeline=%v", pipeline), func(b *testing.B) {
+			config := DefaultConfig()
+			config.Pipeline = pipeline
+			config.Logger = NopLogger{}
+			h := NewHarnessWithConfig(b, 3, config)
+			defer h.Shutdown()
+			leaderId, _ := h.CheckSingleLeader()
+			cm := h.cluster[leaderId].cm
+
+			var latency atomic.Int64
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				for pb.Next() {
+					submitted := time.Now()
+					index, _, isLeader := cm.Submit(42)
+					if !isLeader {
+						b.Errorf("server %d lost leadership", leaderId)
+						return
+					}
+					if err := cm.WaitForCommit(ctx, index); err != nil {
+						b.Error(err)
+						return
+					}
+					latency.Add(int64(time.Since(submitted)))
+				}
+			})
+			b.ReportMetric(float64(latency.Load())/float64(b.N), "ns/commit")
+		})
+	}
+}
+
+func TestElectionDoesNotWaitForSlowVoters(t *testing.T) {
+	// RequestVotes to servers 3 and 4 take long to send.
+	config := DefaultConfig()
+	config.OnRPCSend = func(peerId int, serviceMethod string, args interface{}) {
+		if serviceMethod == "ConsensusModule.RequestVote" && peerId >= 3 {
+			sleepMs(500)
+		}
+	}
+	h := NewHarnessWithConfig(t, 5, config)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	candidateId := 0
+	for candidateId == leaderId {
+		candidateId++
+	}
+
+	// The votes of 0, 1 and 2 are a majority; the candidate wins as soon as
+	// they're in.
+	start := time.Now()
+	h.ElectLeader(candidateId)
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Errorf("election took %v; want it won before the slow votes arrive", elapsed)
+	}
+}
+
+func TestRPCsAnsweredWhileCommitsStall(t *testing.T) {
+	// Nobody reads commitChan until the end of the test.
+	commitChan := make(chan CommitEntry)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	args := AppendEntriesArgs{
+		Term:         1,
+		LeaderId:     1,
+		PrevLogIndex: -1,
+		PrevLogTerm:  -1,
+		Entries:      []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}},
+		LeaderCommit: 1,
+	}
+	var aeReply AppendEntriesReply
+	if err := cm.AppendEntries(args, &aeReply); err != nil || !aeReply.Success {
+		t.Fatalf("AppendEntries: %v, %+v", err, aeReply)
+	}
+	sleepMs(50)
+
+	// The commit sender is stuck sending the first entry; that mustn't keep
+	// the CM from serving RPCs.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		args.PrevLogIndex, args.PrevLogTerm = 1, 1
+		args.Entries = []LogEntry{{Command: 3, Term: 1}}
+		args.LeaderCommit = 2
+		var aeReply AppendEntriesReply
+		if err := cm.AppendEntries(args, &aeReply); err != nil || !aeReply.Success {
+			t.Errorf("AppendEntries while commits stall: %v, %+v", err, aeReply)
+		}
+		// The follower just heard from its leader, so it refuses the vote;
+		// what matters is that it answers.
+		var voteReply RequestVoteReply
+		if err := cm.RequestVote(RequestVoteArgs{Term: 2, CandidateId: 2, LastLogIndex: 2, LastLogTerm: 1}, &voteReply); err != nil || voteReply.Term != 1 {
+			t.Errorf("RequestVote while commits stall: %v, %+v", err, voteReply)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("RPCs blocked behind the stalled commit channel")
+	}
+
+	for want := 1; want <= 3; want++ {
+		if entry := <-commitChan; entry.Command != want {
+			t.Errorf("committed %v; want %d", entry.Command, want)
+		}
+	}
+}
+
+func TestIsLogUpToDate(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	setLog(cm, 3, 1, 1, 2)
+
+	var tests = []struct {
+		candLastIndex int
+		candLastTerm  int
+		want          bool
+	}{
+		{2, 2, true},
+		{5, 2, true},
+		{1, 2, false},
+		{0, 3, true},
+		{9, 1, false},
+		{-1, -1, false},
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, tt := range tests {
+		if got := cm.isLogUpToDate(tt.candLastIndex, tt.candLastTerm); got != tt.want {
+			t.Errorf("isLogUpToDate(%d, %d) = %v; want %v", tt.candLastIndex, tt.candLastTerm, got, tt.want)
+		}
+	}
+}
+
+func TestVoteDeniedToLaggingCandidate(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	setLog(cm, 2, 1, 1, 2)
+
+	// A candidate in a later term, but missing the last entry, doesn't get
+	// the vote; the term is still adopted.
+	var reply RequestVoteReply
+	if err := cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: 1, LastLogIndex: 1, LastLogTerm: 1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.VoteGranted || reply.Term != 3 {
+		t.Errorf("lagging candidate got %+v; want the vote denied in term 3", reply)
+	}
+
+	// The vote is still free for a candidate with the whole log.
+	if err := cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: 2, LastLogIndex: 2, LastLogTerm: 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.VoteGranted {
+		t.Errorf("up-to-date candidate got %+v; want the vote", reply)
+	}
+}
+
+// inflightMetrics is a Metrics that records the highest number of in-flight
+// AppendEntries reported for every peer.
+type inflightMetrics struct {
+	NopMetrics
+
+	mu  sync.Mutex
+	max map[int]int
+}
+
+func (m *inflightMetrics) SetInflightAppends(peerId int, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > m.max[peerId] {
+		m.max[peerId] = n
+	}
+}
+
+func TestStalledFollowerBoundsInflightAppends(t *testing.T) {
+	var stalled atomic.Int64
+	stalled.Store(-1)
+	var blocked, maxBlocked atomic.Int64
+	release := make(chan struct{})
+	metrics := &inflightMetrics{max: make(map[int]int)}
+	config := DefaultConfig()
+	config.MaxInflightAppends = 2
+	config.Metrics = metrics
+	// Without heartbeats getting through, the stalled follower campaigns; with
+	// PreVote, it can't depose the leader, whose count would start over.
+	config.PreVote = true
+	config.OnRPCSend = func(peerId int, serviceMethod string, args interface{}) {
+		if serviceMethod != "ConsensusModule.AppendEntries" || int64(peerId) != stalled.Load() {
+			return
+		}
+		n := blocked.Add(1)
+		for {
+			max := maxBlocked.Load()
+			if n <= max || maxBlocked.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		<-release
+		blocked.Add(-1)
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+	defer close(release)
+
+	leaderId, _ := h.CheckSingleLeader()
+	stalledId := (leaderId + 1) % 3
+	stalled.Store(int64(stalledId))
+	goroutines := runtime.NumGoroutine()
+
+	// Many heartbeat rounds and submissions go by while the follower doesn't
+	// answer; the other follower keeps the cluster committing.
+	for v := 1; v <= 20; v++ {
+		h.SubmitToLeader(v)
+		sleepMs(25)
+	}
+	sleepMs(250)
+	if id, _ := h.CheckSingleLeader(); id != leaderId {
+		t.Fatalf("leader is %d; want %d", id, leaderId)
+	}
+	for _, id := range []int{leaderId, (leaderId + 2) % 3} {
+		if commits := h.Commits(id); len(commits) != 20 {
+			t.Errorf("server %d committed %d entries; want 20", id, len(commits))
+		}
+	}
+
+	if n := maxBlocked.Load(); n > 2 {
+		t.Errorf("%d AppendEntries in flight to the stalled follower; want at most 2", n)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines+10 {
+		t.Errorf("%d goroutines, up from %d before the follower stalled", n, goroutines)
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if n := metrics.max[stalledId]; n != 2 {
+		t.Errorf("in-flight gauge for the stalled follower peaked at %d; want 2", n)
+	}
+}
+
+// voteArgs returns the RequestVoteArgs server id of h would campaign with in
+// the term after its current one.
+func voteArgs(h *Harness, id int) RequestVoteArgs {
+	cm := h.cluster[id].cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
+	return RequestVoteArgs{Term: cm.currentTerm + 1, CandidateId: id, LastLogIndex: lastLogIndex, LastLogTerm: lastLogTerm}
+}
+
+func TestJitteryFollowerDoesNotUnseatLeader(t *testing.T) {
+	config := DefaultConfig()
+	config.CheckQuorum = true
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, term := h.CheckSingleLeader()
+	sleepMs(100)
+
+	// A follower whose timer fired early campaigns while the leader is
+	// healthy. Neither the other follower, which just heard from the leader,
+	// nor the leader, which just heard from a majority, goes along.
+	jitteryId := (leaderId + 1) % 3
+	args := voteArgs(h, jitteryId)
+	for _, id := range []int{leaderId, (leaderId + 2) % 3} {
+		var reply RequestVoteReply
+		if err := h.cluster[id].cm.RequestVote(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.VoteGranted || reply.Term != term {
+			t.Errorf("server %d replied %+v; want the vote denied in term %d", id, reply, term)
+		}
+	}
+
+	if newLeaderId, newTerm := h.CheckSingleLeader(); newLeaderId != leaderId || newTerm != term {
+		t.Errorf("leader %d in term %d; want %d in term %d", newLeaderId, newTerm, leaderId, term)
+	}
+}
+
+func TestLeaderWithoutCheckQuorumGrantsVote(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Without CheckQuorum, a leader can't tell whether it's still heard by the
+	// cluster, so being leader doesn't make it refuse votes.
+	leaderId, term := h.CheckSingleLeader()
+	sleepMs(100)
+	args := voteArgs(h, (leaderId+1)%3)
+	var reply RequestVoteReply
+	if err := h.cluster[leaderId].cm.RequestVote(args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.VoteGranted || reply.Term != term+1 {
+		t.Errorf("leader replied %+v; want the vote granted in term %d", reply, term+1)
+	}
+}
+
+func TestForcedVoteIgnoresActiveLeader(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	args := AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1}
+	var aeReply AppendEntriesReply
+	if err := cm.AppendEntries(args, &aeReply); err != nil || !aeReply.Success {
+		t.Fatalf("AppendEntries: %v, %+v", err, aeReply)
+	}
+
+	voteArgs := RequestVoteArgs{Term: 2, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}
+	var reply RequestVoteReply
+	if err := cm.RequestVote(voteArgs, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.VoteGranted || reply.Term != 1 {
+		t.Errorf("vote while the leader is active: %+v; want it denied in term 1", reply)
+	}
+
+	// A leadership transfer forces the vote.
+	voteArgs.Force = true
+	if err := cm.RequestVote(voteArgs, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.VoteGranted || reply.Term != 2 {
+		t.Errorf("forced vote: %+v; want it granted in term 2", reply)
+	}
+}
+
+func TestPreVoteRejoiningFollowerDoesNotDisrupt(t *testing.T) {
+	config := DefaultConfig()
+	config.PreVote = true
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, term := h.CheckSingleLeader()
+	otherId := (leaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(800)
+
+	// Cut off from the cluster, the follower's pre-votes fail, so it never
+	// starts a real election.
+	cm := h.cluster[otherId].cm
+	cm.mu.Lock()
+	otherTerm := cm.currentTerm
+	cm.mu.Unlock()
+	if otherTerm != term {
+		t.Errorf("isolated follower in term %d; want %d", otherTerm, term)
+	}
+
+	h.ReconnectPeer(otherId)
+	sleepMs(250)
+	if newLeaderId, newTerm := h.CheckSingleLeader(); newLeaderId != leaderId || newTerm != term {
+		t.Errorf("leader %d in term %d; want %d in term %d", newLeaderId, newTerm, leaderId, term)
+	}
+}
+
+func TestIsolatedFollowerBacksOff(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	otherId := (leaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(1500)
+	cm := h.cluster[otherId].cm
+	if !cm.Isolated() {
+		t.Fatalf("server %d not isolated after its elections went unanswered", otherId)
+	}
+
+	// Backed off, it starts only a few elections where it would otherwise
+	// start one every election timeout.
+	term1, _ := h.cluster[otherId].GetState()
+	sleepMs(2000)
+	term2, _ := h.cluster[otherId].GetState()
+	if term2-term1 > 4 {
+		t.Errorf("isolated server went from term %d to %d in 2s; want at most 4 elections", term1, term2)
+	}
+
+	h.ReconnectPeer(otherId)
+	sleepMs(1000)
+	if cm.Isolated() {
+		t.Errorf("server %d still isolated after reconnecting", otherId)
+	}
+	h.CheckSingleLeader()
+}
+
+func TestLeadershipFlapsDontLeakGoroutines(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	sleepMs(300)
+	baseline := runtime.NumGoroutine()
+
+	// Every change of leader stops the old leader's goroutines and starts
+	// the new one's.
+	for i := 0; i < 10; i++ {
+		leaderId = (leaderId + 1) % 3
+		h.ElectLeader(leaderId)
+	}
+	sleepMs(500)
+	if n := runtime.NumGoroutine(); n > baseline+5 {
+		t.Errorf("%d goroutines after 10 changes of leader; want about %d", n, baseline)
+	}
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		cm.mu.Lock()
+		if i != leaderId && cm.leaderStop != nil {
+			t.Errorf("follower %d still has its leader goroutines running", i)
+		}
+		cm.mu.Unlock()
+	}
+}
+
+func TestScaleElectionTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.ScaleElectionTimeout = true
+	cm, err := NewConsensusModule(0, []int{1, 2, 3, 4, 5, 6}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// With 7 servers, the spread doubles.
+	spread := config.ElectionTimeoutMax - config.ElectionTimeoutMin
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var beyondMax int
+	for i := 0; i < 1000; i++ {
+		timeout := cm.electionTimeout()
+		if timeout < config.ElectionTimeoutMin || timeout >= config.ElectionTimeoutMin+2*spread {
+			t.Fatalf("election timeout %v out of [%v, %v)", timeout, config.ElectionTimeoutMin, config.ElectionTimeoutMin+2*spread)
+		}
+		if timeout >= config.ElectionTimeoutMax {
+			beyondMax++
+		}
+	}
+	if beyondMax < 300 || beyondMax > 700 {
+		t.Errorf("%d of 1000 election timeouts beyond ElectionTimeoutMax; want about half", beyondMax)
+	}
+}
+
+func TestRandSeed(t *testing.T) {
+	timeouts := func(id int, seed int64) []time.Duration {
+		config := DefaultConfig()
+		config.RandSeed = seed
+		cm, err := NewConsensusModule(id, []int{(id + 1) % 3, (id + 2) % 3}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cm.Stop()
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		var timeouts []time.Duration
+		for i := 0; i < 10; i++ {
+			timeouts = append(timeouts, cm.electionTimeout())
+		}
+		return timeouts
+	}
+	equal := func(a, b []time.Duration) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// The same seed gives a server the same timeouts every time; other
+	// servers and other seeds get different ones.
+	if a, b := timeouts(0, 42), timeouts(0, 42); !equal(a, b) {
+		t.Errorf("timeouts with the same seed differ: %v, %v", a, b)
+	}
+	if a, b := timeouts(0, 42), timeouts(1, 42); equal(a, b) {
+		t.Errorf("servers 0 and 1 share timeouts %v", a)
+	}
+	if a, b := timeouts(0, 42), timeouts(0, 43); equal(a, b) {
+		t.Errorf("seeds 42 and 43 give the same timeouts %v", a)
+	}
+
+	// A cluster sharing a seeded Config elects a leader as usual.
+	config := DefaultConfig()
+	config.RandSeed = 42
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+}
+
+func TestFakeClockElection(t *testing.T) {
+	// firstTimeout is the first election timeout server id draws with seed.
+	firstTimeout := func(id int, seed int64) time.Duration {
+		config := DefaultConfig()
+		config.RandSeed = seed
+		cm, err := NewConsensusModule(id, nil, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cm.Stop()
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		return cm.electionTimeout()
+	}
+
+	// Find a seed with which one server times out well before the others.
+	var seed int64
+	var first int
+	var timeouts []time.Duration
+	for seed = 1; ; seed++ {
+		timeouts = []time.Duration{firstTimeout(0, seed), firstTimeout(1, seed), firstTimeout(2, seed)}
+		first = 0
+		for id, timeout := range timeouts {
+			if timeout < timeouts[first] {
+				first = id
+			}
+		}
+		apart := true
+		for id, timeout := range timeouts {
+			if id != first && timeout < timeouts[first]+50*time.Millisecond {
+				apart = false
+			}
+		}
+		if apart {
+			break
+		}
+	}
+
+	config := DefaultConfig()
+	config.RandSeed = seed
+	clock := NewFakeClock(time.Now())
+	config.Clock = clock
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+	advance := func(d time.Duration) {
+		for ; d > 0; d -= 5 * time.Millisecond {
+			clock.Advance(5 * time.Millisecond)
+			sleepMs(2)
+		}
+	}
+	checkTerms := func(want int) {
+		for i := 0; i < 3; i++ {
+			if _, term, _ := h.cluster[i].cm.Report(); term != want {
+				t.Fatalf("server %d is in term %d; want %d", i, term, want)
+			}
+		}
+	}
+
+	// Until the clock moves, nothing happens; just before the first timeout,
+	// still nothing.
+	sleepMs(400)
+	checkTerms(0)
+	advance(timeouts[first] - 10*time.Millisecond)
+	h.CheckNoLeader()
+	checkTerms(0)
+
+	// Server first times out, and wins the election before anyone else.
+	advance(20 * time.Millisecond)
+	leaderId, term := h.CheckSingleLeader()
+	if leaderId != first || term != 1 {
+		t.Errorf("leader is %d in term %d; want %d in term 1", leaderId, term, first)
+	}
+}
+
+func TestSevenServersFailOverQuickly(t *testing.T) {
+	config := DefaultConfig()
+	config.ScaleElectionTimeout = true
+	h := NewHarnessWithConfig(t, 7, config)
+	defer h.Shutdown()
+
+	// The followers all time out after the leader crashes; one of them wins
+	// within a few election rounds, without a string of split votes.
+	for i := 0; i < 3; i++ {
+		leaderId, term := h.CheckSingleLeader()
+		h.CrashPeer(leaderId)
+		start := time.Now()
+		newLeaderId, newTerm := h.CheckSingleLeader()
+		if newTerm-term > 3 {
+			t.Errorf("leader %d elected in term %d, %d terms after %d crashed", newLeaderId, newTerm, newTerm-term, leaderId)
+		}
+		if d := time.Since(start); d > 1500*time.Millisecond {
+			t.Errorf("failover took %v", d)
+		}
+		h.RestartPeer(leaderId)
+	}
+}
+
+func TestPrioritiesPreferLeader(t *testing.T) {
+	for round := 0; round < 3; round++ {
+		config := DefaultConfig()
+		config.Priorities = map[int]int{1: 1, 2: 2}
+		h := NewHarnessWithConfig(t, 3, config)
+
+		// The highest priority server wins whenever it's up; once it's down,
+		// the next one takes over.
+		if leaderId, _ := h.CheckSingleLeader(); leaderId != 2 {
+			t.Errorf("round %d: leader is %d; want 2", round, leaderId)
+		}
+		h.CrashPeer(2)
+		if leaderId, _ := h.CheckSingleLeader(); leaderId != 1 {
+			t.Errorf("round %d: leader is %d after 2 crashed; want 1", round, leaderId)
+		}
+		h.Shutdown()
+	}
+}
+
+func TestSplitVoteResolves(t *testing.T) {
+	h := NewHarness(t, 4)
+	defer h.Shutdown()
+
+	// Before the first election, split the cluster in two pairs: a candidate
+	// gets at most 2 of the 4 votes, and the candidates keep retrying.
+	for _, i := range []int{0, 1} {
+		for _, j := range []int{2, 3} {
+			h.cluster[i].DisconnectPeer(j)
+			h.cluster[j].DisconnectPeer(i)
+		}
+	}
+	sleepMs(450)
+	h.CheckNoLeader()
+	terms := make([]int, 4)
+	for i := range terms {
+		_, terms[i], _ = h.cluster[i].cm.Report()
+	}
+	sleepMs(650)
+	h.CheckNoLeader()
+	for _, pair := range [][]int{{0, 1}, {2, 3}} {
+		_, term0, _ := h.cluster[pair[0]].cm.Report()
+		_, term1, _ := h.cluster[pair[1]].cm.Report()
+		if term0 <= terms[pair[0]] && term1 <= terms[pair[1]] {
+			t.Errorf("servers %v stayed in terms %d and %d; want another election", pair, term0, term1)
+		}
+	}
+
+	// Once the halves can talk again, the candidates' random timeouts break
+	// the tie.
+	for _, i := range []int{0, 1} {
+		for _, j := range []int{2, 3} {
+			if err := h.cluster[i].ReconnectPeer(j); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.cluster[j].ReconnectPeer(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	h.CheckSingleLeader()
+}
+
+func TestSingleServerCluster(t *testing.T) {
+	for _, preVote := range []bool{false, true} {
+		config := DefaultConfig()
+		config.PreVote = preVote
+		h := NewHarnessWithConfig(t, 1, config)
+
+		// The server is its own majority: it elects itself as soon as its
+		// election timer fires, and commits entries as soon as they're in its
+		// log, without waiting for a heartbeat.
+		start := time.Now()
+		h.CheckSingleLeader()
+		if d := time.Since(start); d > 2*config.ElectionTimeoutMax {
+			t.Errorf("PreVote=%v: election took %v", preVote, d)
+		}
+		h.SubmitToLeader(1)
+		h.SubmitToLeader(2)
+		sleepMs(20)
+		h.CheckCommittedN(1, 1)
+		h.CheckCommittedN(2, 1)
+		h.Shutdown()
+	}
+}
+
+func TestBecomeFollowerKeepsNewerTerm(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	setLog(cm, 5)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.votedFor = 1
+
+	// A late reply from term 3 makes the CM step down, but neither its term
+	// nor its vote in term 5 go back.
+	cm.becomeFollower(3)
+	if cm.currentTerm != 5 || cm.votedFor != 1 {
+		t.Errorf("after becomeFollower(3): term %d, votedFor %d; want 5 and 1", cm.currentTerm, cm.votedFor)
+	}
+	cm.becomeFollower(6)
+	if cm.currentTerm != 6 || cm.votedFor != -1 {
+		t.Errorf("after becomeFollower(6): term %d, votedFor %d; want 6 and -1", cm.currentTerm, cm.votedFor)
+	}
+}
+
+func TestAppendEntriesIdempotent(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	args := AppendEntriesArgs{
+		Term:         1,
+		LeaderId:     1,
+		PrevLogIndex: -1,
+		PrevLogTerm:  -1,
+		Entries:      []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}},
+		LeaderCommit: 0,
+	}
+	checkLog := func(what string, wantCommitIndex int) {
+		t.Helper()
+		entries := cm.LogSlice(0, 10)
+		if len(entries) != 3 || entries[0].Command != 1 || entries[2].Command != 3 {
+			t.Errorf("%s: log %v; want 1, 2, 3", what, entries)
+		}
+		if commitIndex := cm.CommitIndex(); commitIndex != wantCommitIndex {
+			t.Errorf("%s: commitIndex=%d; want %d", what, commitIndex, wantCommitIndex)
+		}
+	}
+
+	var reply AppendEntriesReply
+	for i := 0; i < 2; i++ {
+		if err := cm.AppendEntries(args, &reply); err != nil || !reply.Success {
+			t.Fatalf("AppendEntries #%d: %v, %+v", i+1, err, reply)
+		}
+	}
+	checkLog("retried AppendEntries", 0)
+
+	// A delayed retry of an earlier RPC, with fewer entries, must not cut off
+	// the entries that followed; its commit index is applied as far as it
+	// goes.
+	args.Entries = args.Entries[:1]
+	args.LeaderCommit = 1
+	if err := cm.AppendEntries(args, &reply); err != nil || !reply.Success {
+		t.Fatalf("AppendEntries: %v, %+v", err, reply)
+	}
+	checkLog("delayed AppendEntries", 0)
+
+	// LeaderCommit only covers the entries the RPC vouches for.
+	args.LeaderCommit = 2
+	if err := cm.AppendEntries(args, &reply); err != nil || !reply.Success {
+		t.Fatalf("AppendEntries: %v, %+v", err, reply)
+	}
+	checkLog("AppendEntries with a later LeaderCommit", 0)
+	args.Entries = []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}}
+	if err := cm.AppendEntries(args, &reply); err != nil || !reply.Success {
+		t.Fatalf("AppendEntries: %v, %+v", err, reply)
+	}
+	checkLog("AppendEntries of the whole log", 2)
+}
+
+func TestOnStateChange(t *testing.T) {
+	type change struct {
+		from, to CMState
+		term     int
+	}
+	var mu sync.Mutex
+	var changes []change
+	var harness atomic.Pointer[Harness]
+	config := DefaultConfig()
+	config.OnStateChange = func(old, new CMState, term int) {
+		// Calling back into the CMs mustn't deadlock.
+		if h := harness.Load(); h != nil {
+			for _, s := range h.cluster {
+				s.cm.Report()
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, change{old, new, term})
+	}
+	h := NewHarnessWithConfig(t, 1, config)
+	defer h.Shutdown()
+	harness.Store(h)
+
+	// A single server goes through every state once.
+	h.CheckSingleLeader()
+	h.CrashPeer(0)
+	sleepMs(50)
+	want := []change{{Follower, Candidate, 1}, {Candidate, Leader, 1}, {Leader, Dead, 1}}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(changes) != len(want) {
+		t.Fatalf("state changes %v; want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("state change %d is %v; want %v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	var tests = []struct {
+		value interface{}
+		want  string
+	}{
+		{Follower, "Follower"},
+		{Candidate, "Candidate"},
+		{Leader, "Leader"},
+		{Dead, "Dead"},
+		{CMState(7), "CMState(7)"},
+		{RequestVoteArgs{Term: 2, CandidateId: 1, LastLogIndex: 4, LastLogTerm: 1}, "{Term:2 CandidateId:1 LastLogIndex:4 LastLogTerm:1 Force:false}"},
+		{AppendEntriesArgs{Term: 2, LeaderId: 1, PrevLogIndex: 3, PrevLogTerm: 1, Entries: []LogEntry{{Command: 5, Term: 2}}, LeaderCommit: 3}, "{Term:2 LeaderId:1 PrevLogIndex:3 PrevLogTerm:1 Entries:[{5 2}] LeaderCommit:3}"},
+		{AppendEntriesArgs{Term: 2, Entries: make([]LogEntry, 10)}, "{Term:2 LeaderId:0 PrevLogIndex:0 PrevLogTerm:0 Entries:[{<nil> 0} {<nil> 0} {<nil> 0}]... (10 entries) LeaderCommit:0}"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.value); got != tt.want {
+			t.Errorf("got %s; want %s", got, tt.want)
+		}
+	}
+
+	// The states of a running cluster format the same.
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		cm.mu.Lock()
+		got := fmt.Sprintf("%v", cm.state)
+		cm.mu.Unlock()
+		want := "Follower"
+		if i == leaderId {
+			want = "Leader"
+		}
+		if got != want {
+			t.Errorf("server %d is %s; want %s", i, got, want)
+		}
+	}
+}
+
+func TestRepliesAfterStopIgnored(t *testing.T) {
+	// While slow is set, servers take a while to handle RPCs, so the replies
+	// to those sent just before a CM stops arrive after it's Dead.
+	var slow atomic.Bool
+	var started, handled atomic.Int32
+	config := DefaultConfig()
+	config.OnRPCRecv = func(serviceMethod string, args interface{}) {
+		if slow.Load() {
+			started.Add(1)
+			sleepMs(40)
+			handled.Add(1)
+		}
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	type cmState struct {
+		state                     CMState
+		term, votedFor, commitIdx int
+		leaderId                  int
+	}
+	stateOf := func(cm *ConsensusModule) cmState {
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		return cmState{cm.state, cm.currentTerm, cm.votedFor, cm.commitIndex, cm.leaderId}
+	}
+	// checkStopped stops cm while RPCs are in flight, calls during, and checks
+	// that the replies don't change cm.
+	checkStopped := func(name string, cm *ConsensusModule, during func()) {
+		for started.Load() == handled.Load() {
+			sleepMs(1)
+		}
+		before := handled.Load()
+		cm.Stop()
+		stopped := stateOf(cm)
+		during()
+		sleepMs(150)
+		if handled.Load() == before {
+			t.Fatalf("%s: no RPC was answered after Stop", name)
+		}
+		if after := stateOf(cm); after != stopped {
+			t.Errorf("%s: state changed from %+v to %+v after Stop", name, stopped, after)
+		}
+	}
+
+	// A candidate stopped right after it asked for votes, which it gets.
+	leaderId, _ := h.CheckSingleLeader()
+	candidateId := (leaderId + 1) % 3
+	slow.Store(true)
+	if err := h.cluster[candidateId].CampaignNow(); err != nil {
+		t.Fatal(err)
+	}
+	checkStopped("candidate", h.cluster[candidateId].cm, func() {})
+	slow.Store(false)
+
+	// A leader stopped with heartbeats in flight, whose followers move on to
+	// a later term before they reply: the replies would make a live leader
+	// step down.
+	leaderId, _ = h.CheckSingleLeader()
+	slow.Store(true)
+	checkStopped("leader", h.cluster[leaderId].cm, func() {
+		for i := 0; i < 3; i++ {
+			if i != leaderId && i != candidateId {
+				h.cluster[i].CampaignNow()
+			}
+		}
+	})
+}
+
+// Run with go test -race ./raft: every public accessor runs concurrently with
+// elections and replication, so one that touches the CM's state without
+// cm.mu fails the race detector. Each runs in a goroutine of its own, so
+// another accessor's locking doesn't order its accesses after the CM's.
+func TestConcurrentAccess(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		server := h.cluster[i]
+		accessors := []func(){
+			func() { cm.Report() },
+			func() { cm.GetState() },
+			func() { cm.LeaderId() },
+			func() { cm.CommitIndex() },
+			func() { cm.LastApplied() },
+			func() { cm.Isolated() },
+			func() { cm.PeerProgress() },
+			func() { cm.Events() },
+			func() { cm.ReadIndex() },
+			func() { cm.LeaseRead() },
+			func() { server.Health() },
+		}
+		for _, access := range accessors {
+			wg.Add(1)
+			go func(access func()) {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+						access()
+					}
+				}
+			}(access)
+		}
+	}
+
+	// Leadership moves while the accessors run.
+	for v := 1; v <= 3; v++ {
+		leaderId, _ := h.CheckSingleLeader()
+		h.SubmitToLeader(v)
+		sleepMs(100)
+		h.DisconnectPeer(leaderId)
+		h.CheckSingleLeader()
+		h.ReconnectPeer(leaderId)
+		sleepMs(150)
+	}
+	h.SubmitToLeader(4)
+	sleepMs(250)
+	close(stop)
+	wg.Wait()
+	h.CheckCommittedN(4, 3)
+}
@@ -0,0 +1,217 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ReadIndex implements the ReadIndex protocol for linearizable reads that
+// don't write to the log. It's only valid on the leader: it records the
+// current commit index, confirms with a round of heartbeats that a majority
+// still accepts this CM as leader for the current term, and then returns the
+// recorded index. Once the client's state machine has applied all entries up
+// to the returned index, it can serve a read from its local state.
+//
+// An error matching ErrNotLeader is returned if this CM isn't the leader or
+// loses leadership, and one matching ErrTimeout if it can't confirm its
+// leadership within the maximal election timeout (by then it has likely been
+// deposed). One matching ErrLeaderNotReady is returned if it hasn't yet
+// committed the no-op entry of its current term, in which case its commit
+// index may be stale; the latter is temporary, and resolves within a
+// heartbeat or two of taking office.
+func (cm *ConsensusModule) ReadIndex() (int, error) {
+	cm.mu.Lock()
+	if cm.getState() != Leader {
+		cm.mu.Unlock()
+		return -1, fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	if cm.getCommitIndex() < 0 || cm.entryAt(cm.getCommitIndex()).Term != cm.getTerm() {
+		term := cm.getTerm()
+		cm.mu.Unlock()
+		return -1, fmt.Errorf("leader %d in term %d: %w", cm.id, term, ErrLeaderNotReady)
+	}
+	readIndex := cm.getCommitIndex()
+	savedCurrentTerm := cm.getTerm()
+
+	// acks and confirmed are protected by cm.mu, which is held when onAck is
+	// called.
+	acks := map[int]bool{cm.id: true}
+	acked := func(id int) bool { return acks[id] }
+	confirmed := make(chan struct{})
+	closed := false
+	onAck := func(peerId int) {
+		acks[peerId] = true
+		if !closed && cm.hasQuorum(acked) {
+			closed = true
+			close(confirmed)
+		}
+	}
+	if cm.hasQuorum(acked) {
+		closed = true
+		close(confirmed)
+	}
+	cm.mu.Unlock()
+	cm.leaderSendHeartbeats(onAck)
+
+	select {
+	case <-confirmed:
+	case <-cm.clock.After(cm.config.ElectionTimeoutMax):
+		return -1, fmt.Errorf("leader %d confirming leadership: %w", cm.id, ErrTimeout)
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() != Leader || cm.getTerm() != savedCurrentTerm {
+		return -1, fmt.Errorf("server %d lost leadership: %w", cm.id, ErrNotLeader)
+	}
+	return readIndex, nil
+}
+
+// leaseClockDriftMargin is subtracted from the minimum election timeout to
+// obtain the lease duration, to tolerate clocks that run at slightly
+// different rates on different servers.
+const leaseClockDriftMargin = 30 * time.Millisecond
+
+// LeaseRead is a faster alternative to ReadIndex that doesn't need a round of
+// heartbeats. It returns the commit index if this CM is the leader and holds a
+// valid lease; the client can serve a read once its state machine applied
+// entries up to that index.
+//
+// The lease starts when a majority of peers acknowledged a heartbeat (at the
+// time it was sent) and lasts for the minimum election timeout minus
+// leaseClockDriftMargin; followers don't start an election before their
+// election timeout elapses after hearing from the leader, so no other leader
+// can be elected while the lease holds (CampaignNow doesn't force elections
+// past that with CheckQuorum, and no lease is served while a leadership
+// transfer forces one). This relies on the assumption that
+// clock rates on all servers differ by less than the drift margin over one
+// election timeout; unlike ReadIndex, it isn't safe when clocks can jump or
+// drift arbitrarily.
+//
+// As with ReadIndex, the read may be served once LastApplied reaches the
+// returned index. When the lease has expired, or during a leadership transfer,
+// an error matching ErrLeaseExpired is returned, and the caller may retry with
+// ReadIndex; the other errors are those of ReadIndex.
+func (cm *ConsensusModule) LeaseRead() (int, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.getState() != Leader {
+		return -1, fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	if cm.getCommitIndex() < 0 || cm.entryAt(cm.getCommitIndex()).Term != cm.getTerm() {
+		return -1, fmt.Errorf("leader %d in term %d: %w", cm.id, cm.getTerm(), ErrLeaderNotReady)
+	}
+	if cm.clock.Now().After(cm.leaseStart().Add(cm.leaseDuration())) {
+		return -1, fmt.Errorf("leader %d: %w", cm.id, ErrLeaseExpired)
+	}
+	if cm.transferTarget != -1 {
+		// The target's election is forced past its voters' leader
+		// stickiness, so it may win before the lease runs out.
+		return -1, fmt.Errorf("leader %d is transferring leadership to %d: %w", cm.id, cm.transferTarget, ErrLeaseExpired)
+	}
+	return cm.getCommitIndex(), nil
+}
+
+// leaseStart returns the latest time by which a majority of the cluster
+// (counting this CM itself as of now) acknowledged this CM's leadership.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) leaseStart() time.Time {
+	cm.assertLocked()
+	now := cm.clock.Now()
+	ackTimeOf := func(id int) time.Time {
+		if id == cm.id {
+			return now
+		}
+		return cm.peerAckTime[id]
+	}
+	ackTimes := []time.Time{now}
+	for _, peerId := range cm.peerIds {
+		ackTimes = append(ackTimes, cm.peerAckTime[peerId])
+	}
+	sort.Slice(ackTimes, func(i, j int) bool {
+		return ackTimes[i].After(ackTimes[j])
+	})
+	for _, t := range ackTimes {
+		if cm.hasQuorum(func(id int) bool { return !ackTimeOf(id).Before(t) }) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// leaseDuration returns how long a leader lease lasts after leaseStart.
+func (cm *ConsensusModule) leaseDuration() time.Duration {
+	return cm.config.ElectionTimeoutMin - leaseClockDriftMargin
+}
+
+// LinearizableRead runs fn to serve a linearizable read from the client's
+// state machine: it obtains a read index with ReadIndex, waits until the
+// client applied all entries up to it (see Config.AckApplied), and then calls fn,
+// returning its error. It returns an error matching ErrNotLeader if this
+// server isn't the leader, and ctx.Err() if ctx is done before fn is called.
+//
+// fn can read the state machine right away if the client applies every entry
+// before it receives the next one from the commit channel, or reports what it
+// applied with SetLastApplied; a client that applies entries asynchronously
+// without reporting them has to wait in fn until it applied the latest entry
+// it received.
+func (s *Server) LinearizableRead(ctx context.Context, fn func() error) error {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return fmt.Errorf("server %d is not serving: %w", s.serverId, ErrShutdown)
+	}
+
+	// ReadIndex waits up to an election timeout, so it's run in its own
+	// goroutine to respect ctx; see CallContext.
+	type result struct {
+		index int
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		index, err := cm.ReadIndex()
+		done <- result{index, err}
+	}()
+	var readIndex int
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		readIndex = r.index
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := cm.waitForApplied(ctx, readIndex); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// waitForApplied blocks until the client applied the entry at index, see
+// appliedIndex, or ctx is done.
+func (cm *ConsensusModule) waitForApplied(ctx context.Context, index int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for cm.appliedIndex() < index {
+		if cm.getState() == Dead {
+			return fmt.Errorf("server %d: %w", cm.id, ErrShutdown)
+		}
+		waitChan := cm.commitWaitChan
+		cm.mu.Unlock()
+		select {
+		case <-waitChan:
+		case <-ctx.Done():
+			cm.mu.Lock()
+			return ctx.Err()
+		}
+		cm.mu.Lock()
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadErrors(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	setLog(cm, 2, 1)
+	cm.mu.Lock()
+	cm.state = Leader
+	cm.commitIndex = 0
+	cm.mu.Unlock()
+
+	// Until it commits an entry of its own term, a leader's commit index may
+	// be stale.
+	if _, err := cm.ReadIndex(); !errors.Is(err, ErrLeaderNotReady) {
+		t.Errorf("ReadIndex: got %v; want ErrLeaderNotReady", err)
+	}
+	if _, err := cm.LeaseRead(); !errors.Is(err, ErrLeaderNotReady) {
+		t.Errorf("LeaseRead: got %v; want ErrLeaderNotReady", err)
+	}
+
+	// Then it has no lease until its peers acknowledge it.
+	setLog(cm, 2, 1, 2)
+	cm.mu.Lock()
+	cm.commitIndex = 1
+	cm.mu.Unlock()
+	if _, err := cm.LeaseRead(); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("LeaseRead without acknowledgements: got %v; want ErrLeaseExpired", err)
+	}
+
+	cm.mu.Lock()
+	cm.state = Follower
+	cm.mu.Unlock()
+	if _, err := cm.LeaseRead(); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("LeaseRead on a follower: got %v; want ErrNotLeader", err)
+	}
+}
@@ -1,9 +1,15 @@
 package raft
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log"
+	"math/rand"
+	"net"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
 // Server wraps a raft.ConsensusModule along with a rpc.Server that exposes its
@@ -18,21 +24,546 @@ type Server struct {
 	serverId int
 	peerIds  []int
 
-	cm *ConsensusModule
+	cm       *ConsensusModule
+	storage  Storage
+	config   *Config
+	rpcProxy *RPCProxy
+
+	rpcServer *rpc.Server
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	commitChan chan<- CommitEntry
+
+	// transport is used to send RPCs to peers.
+	transport Transport
 
 	// Requires mutex to access
-	peerClients map[int]*rpc.Client
+	conns    map[net.Conn]struct{}
+	shutdown bool
+
+	// peerAddrs has the address of every peer this server connected to with
+	// ConnectToPeer, for ReconnectPeer and ReconnectAll. isolated is set between DisconnectAll
+	// and ReconnectAll, while RPCs from peers are refused. Require mutex to
+	// access.
+	peerAddrs map[int]net.Addr
+	isolated  bool
+
+	ready <-chan interface{}
+	quit  chan interface{}
+	wg    sync.WaitGroup
 }
 
-func (s *Server) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+// NewServer creates a Server that talks to its peers over net/rpc; see
+// NewConsensusModule for the meaning of the arguments passed to the
+// ConsensusModule it creates in Serve.
+func NewServer(serverId int, peerIds []int, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry, config *Config) *Server {
+	return NewServerWithTransport(serverId, peerIds, storage, ready, commitChan, config, NewRPCTransport())
+}
+
+// NewServerWithTransport is like NewServer, but sends RPCs to peers through
+// the given transport.
+func NewServerWithTransport(serverId int, peerIds []int, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry, config *Config, transport Transport) *Server {
+	s := new(Server)
+	s.serverId = serverId
+	s.peerIds = peerIds
+	s.transport = transport
+	s.conns = make(map[net.Conn]struct{})
+	s.peerAddrs = make(map[int]net.Addr)
+	s.storage = storage
+	s.config = config
+	s.ready = ready
+	s.commitChan = commitChan
+	s.quit = make(chan interface{})
+	return s
+}
+
+// Serve creates the ConsensusModule, registers it with an RPC server and
+// starts accepting connections from peers on a TCP listener. It returns once
+// the listener is set up; connections are served in the background. If the
+// server's transport delivers incoming RPCs itself (like InmemTransport), the
+// ConsensusModule is registered with the transport and no listener is opened.
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	cm, err := NewConsensusModule(s.serverId, s.peerIds, s, s.storage, s.ready, s.commitChan, s.config)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.cm = cm
+
+	s.rpcProxy = &RPCProxy{cm: s.cm, server: s}
+	if r, ok := s.transport.(handlerRegistrar); ok {
+		r.RegisterHandler(s.rpcProxy)
+		s.mu.Unlock()
+		return nil
+	}
+
+	// Create a new RPC server and register the RPCProxy that forwards all
+	// methods to s.cm
+	s.rpcServer = rpc.NewServer()
+	if err := s.rpcServer.RegisterName("ConsensusModule", s.rpcProxy); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.listener, err = net.Listen("tcp", ":0")
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if s.tlsConfig != nil {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+	}
+	log.Printf("[%v] listening at %s", s.serverId, s.listener.Addr())
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				select {
+				case <-s.quit:
+					return
+				default:
+					log.Fatal("accept error:", err)
+				}
+			}
+			s.mu.Lock()
+			if s.shutdown {
+				s.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go func() {
+				s.rpcServer.ServeConn(conn)
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				s.wg.Done()
+			}()
+		}
+	}()
+	return nil
+}
+
+// SetTLSConfig makes the server use TLS with config for its RPC traffic: the
+// listener opened by Serve accepts TLS connections only, and, with the default
+// RPCTransport, connections to peers are made over TLS too. It must be called
+// before Serve.
+//
+// The same config is used for both ends of a connection, so it needs
+// Certificates with the server's own certificate, RootCAs to verify the
+// peers' certificates when dialing, and a ServerName (or certificates valid
+// for the peers' IP addresses) for that verification. For mutual TLS, where
+// peers authenticate each other, also set ClientAuth to
+// tls.RequireAndVerifyClientCert and ClientCAs to the CA that signs the peers'
+// certificates.
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tlsConfig = config
+	if t, ok := s.transport.(*RPCTransport); ok {
+		t.SetTLSConfig(config)
+	}
+}
+
+// Shutdown stops the server: the ConsensusModule becomes Dead, the listener
+// and all connections - both incoming and to peers - are closed, and Shutdown
+// waits for the goroutines serving them to exit. Calls made after Shutdown
+// fail with an error. It's safe to call Shutdown more than once. With
+// Config.GracefulShutdown, a leader first commits and delivers the entries
+// submitted to it, and then transfers its leadership.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.shutdown = true
+	cm := s.cm
+	s.mu.Unlock()
+
+	if cm != nil {
+		if _, isLeader := cm.GetState(); isLeader && cm.config.GracefulShutdown {
+			ctx, cancel := context.WithTimeout(context.Background(), cm.config.ElectionTimeoutMax)
+			if err := cm.Barrier(ctx); err != nil {
+				log.Printf("[%v] committing entries before shutdown: %v", s.serverId, err)
+			}
+			cancel()
+			if err := cm.StepDown(); err != nil {
+				log.Printf("[%v] stepping down before shutdown: %v", s.serverId, err)
+			}
+		}
+		cm.Stop()
+	}
+	close(s.quit)
+
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.transport.Close()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// GetListenAddr returns the address this server listens on; it's only valid
+// once Serve returned successfully, and is nil if the server's transport
+// doesn't use a listener.
+func (s *Server) GetListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// GetState reports the current term and whether this server is the leader.
+// Before Serve it reports term 0 and false.
+func (s *Server) GetState() (term int, isLeader bool) {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return 0, false
+	}
+	return cm.GetState()
+}
+
+// IsLeader reports whether this server is currently the leader; an
+// application should check it before accepting writes.
+func (s *Server) IsLeader() bool {
+	_, isLeader := s.GetState()
+	return isLeader
+}
+
+// Submit submits command to this server's ConsensusModule, see
+// ConsensusModule.Submit. Before Serve it reports isLeader=false.
+func (s *Server) Submit(command interface{}) (index int, term int, isLeader bool) {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return -1, 0, false
+	}
+	return cm.Submit(command)
+}
+
+// SubmitContext is like Submit, but traces the command as a child of the span
+// in ctx; see ConsensusModule.SubmitContext.
+func (s *Server) SubmitContext(ctx context.Context, command interface{}) (index int, term int, isLeader bool) {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return -1, 0, false
+	}
+	return cm.SubmitContext(ctx, command)
+}
+
+// ReadIndex returns a commit index that's safe to serve linearizable reads
+// at, see ConsensusModule.ReadIndex.
+func (s *Server) ReadIndex() (int, error) {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return -1, fmt.Errorf("server %d is not serving: %w", s.serverId, ErrShutdown)
+	}
+	return cm.ReadIndex()
+}
+
+// Barrier waits until all entries submitted to this server, which must be the
+// leader, are committed and applied, see ConsensusModule.Barrier.
+func (s *Server) Barrier(ctx context.Context) error {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return fmt.Errorf("server %d is not serving: %w", s.serverId, ErrShutdown)
+	}
+	return cm.Barrier(ctx)
+}
+
+// Snapshot hands a state machine snapshot covering all entries up to index to
+// this server's ConsensusModule, see ConsensusModule.Snapshot.
+func (s *Server) Snapshot(index int, snapshot []byte) {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm != nil {
+		cm.Snapshot(index, snapshot)
+	}
+}
+
+// Events returns this server's event log, see ConsensusModule.Events. Before
+// Serve it returns nil.
+func (s *Server) Events() []Event {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return nil
+	}
+	return cm.Events()
+}
+
+// CampaignNow makes this server start an election right away, see
+// ConsensusModule.CampaignNow.
+func (s *Server) CampaignNow() error {
+	s.mu.Lock()
+	cm := s.cm
+	s.mu.Unlock()
+	if cm == nil {
+		return fmt.Errorf("server %d is not serving: %w", s.serverId, ErrShutdown)
+	}
+	return cm.CampaignNow()
+}
+
+// ConnectToPeer connects this server to the peer identified by peerId at
+// addr. It's supported only by transports that connect by address, such as
+// the default RPCTransport.
+func (s *Server) ConnectToPeer(peerId int, addr net.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return fmt.Errorf("connect to peer %d: %w", peerId, ErrShutdown)
+	}
+	pc, ok := s.transport.(peerConnector)
+	if !ok {
+		return fmt.Errorf("transport %T doesn't support connecting to peers", s.transport)
+	}
+	if err := pc.ConnectToPeer(peerId, addr); err != nil {
+		return err
+	}
+	s.peerAddrs[peerId] = addr
+	return nil
+}
+
+// maxConnectBackoff caps the delay between two attempts of
+// ConnectToPeerWithRetry.
+const maxConnectBackoff = 10 * time.Second
+
+// ConnectToPeerWithRetry is like ConnectToPeer, but retries up to maxRetries
+// times when connecting fails, e.g. because the peer hasn't started yet. The
+// delay before the first retry is about backoff, and doubles with every retry
+// up to maxConnectBackoff; each delay is randomized so that servers started
+// together don't retry in lockstep. It gives up early, returning ctx.Err(),
+// when ctx is done, and when the server is shut down.
+func (s *Server) ConnectToPeerWithRetry(ctx context.Context, peerId int, addr net.Addr, maxRetries int, backoff time.Duration) error {
 	s.mu.Lock()
-	peer := s.peerClients[id]
+	quit := s.quit
+	_, ok := s.transport.(peerConnector)
 	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("transport %T doesn't support connecting to peers", s.transport)
+	}
+
+	delay := backoff
+	for retry := 0; ; retry++ {
+		err := s.ConnectToPeer(peerId, addr)
+		if err == nil {
+			return nil
+		}
+		if retry >= maxRetries {
+			return fmt.Errorf("connect to peer %d: giving up after %d retries: %w", peerId, retry, err)
+		}
+		log.Printf("[%v] connecting to peer %d failed (retry %d/%d): %v", s.serverId, peerId, retry+1, maxRetries, err)
+
+		// Wait between delay/2 and delay.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-quit:
+			return fmt.Errorf("connect to peer %d: %w", peerId, ErrShutdown)
+		}
+		if delay *= 2; delay > maxConnectBackoff {
+			delay = maxConnectBackoff
+		}
+	}
+}
+
+// DisconnectPeer disconnects this server from the peer identified by peerId.
+func (s *Server) DisconnectPeer(peerId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc, ok := s.transport.(peerConnector)
+	if !ok {
+		return fmt.Errorf("transport %T doesn't support disconnecting peers", s.transport)
+	}
+	return pc.DisconnectPeer(peerId)
+}
+
+// ReconnectPeer connects this server again to the peer identified by peerId,
+// at the address it was last given in ConnectToPeer, e.g. after
+// DisconnectPeer. An error is returned if it never connected to that peer.
+func (s *Server) ReconnectPeer(peerId int) error {
+	s.mu.Lock()
+	addr, ok := s.peerAddrs[peerId]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("reconnect to peer %d: address unknown", peerId)
+	}
+	return s.ConnectToPeer(peerId, addr)
+}
+
+// DisconnectAll cuts this server off from all its peers, like a network
+// partition would: the connections to the peers are closed, and the RPCs the
+// peers send to this server fail until ReconnectAll is called. The server
+// keeps running meanwhile, as a minority of one; a leader keeps thinking it
+// leads unless CheckQuorum is enabled. It's supported only by transports that
+// connect by address, such as the default RPCTransport.
+func (s *Server) DisconnectAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc, ok := s.transport.(peerConnector)
+	if !ok {
+		return fmt.Errorf("transport %T doesn't support disconnecting peers", s.transport)
+	}
+	s.isolated = true
+	for peerId := range s.peerAddrs {
+		if err := pc.DisconnectPeer(peerId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReconnectAll undoes DisconnectAll: it accepts RPCs from peers again, and
+// redials every peer this server ever connected to at the address it was
+// given in ConnectToPeer. It tries all peers even if some fail, and returns
+// the first error.
+func (s *Server) ReconnectAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return fmt.Errorf("reconnect: %w", ErrShutdown)
+	}
+	pc, ok := s.transport.(peerConnector)
+	if !ok {
+		return fmt.Errorf("transport %T doesn't support connecting to peers", s.transport)
+	}
+	s.isolated = false
+	var firstErr error
+	for peerId, addr := range s.peerAddrs {
+		if err := pc.ConnectToPeer(peerId, addr); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("connect to peer %d: %w", peerId, err)
+		}
+	}
+	return firstErr
+}
+
+// Call sends an RPC to the peer identified by id through the server's
+// transport.
+func (s *Server) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	s.onRPCSend(id, serviceMethod, args)
+	return s.transport.Call(id, serviceMethod, args, reply)
+}
+
+// CallContext is like Call, but gives up waiting for the reply when ctx is
+// cancelled or its deadline expires, returning ctx.Err(). The RPC itself
+// isn't aborted; it completes in the background and its result is discarded,
+// so reply must not be used after CallContext returns an error.
+func (s *Server) CallContext(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	// The result channel is buffered, so the goroutine running the call never
+	// blocks on it even if nobody is waiting anymore.
+	result := make(chan error, 1)
+	s.onRPCSend(id, serviceMethod, args)
+	go func() {
+		result <- s.transport.Call(id, serviceMethod, args, reply)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// onRPCSend reports an RPC about to be sent to Config.OnRPCSend.
+func (s *Server) onRPCSend(id int, serviceMethod string, args interface{}) {
+	if s.config != nil && s.config.OnRPCSend != nil {
+		s.config.OnRPCSend(id, serviceMethod, args)
+	}
+}
+
+// RPCProxy is a trivial pass-thru proxy type for ConsensusModule's RPC methods.
+// It's registered with the RPC server instead of the ConsensusModule itself,
+// so that only the RPC methods are exposed and net/rpc doesn't complain about
+// the CM's other exported methods.
+type RPCProxy struct {
+	cm     *ConsensusModule
+	server *Server
+}
+
+// receive is called first by every RPC handler: it reports the RPC to
+// Config.OnRPCRecv, and fails RPCs arriving while the server is cut off from
+// its peers by DisconnectAll.
+func (rpp *RPCProxy) receive(serviceMethod string, args interface{}) error {
+	if hook := rpp.cm.config.OnRPCRecv; hook != nil {
+		hook(serviceMethod, args)
+	}
+	rpp.server.mu.Lock()
+	defer rpp.server.mu.Unlock()
+	if rpp.server.isolated {
+		return fmt.Errorf("server %d is disconnected: %w", rpp.server.serverId, ErrPeerClosed)
+	}
+	return nil
+}
+
+func (rpp *RPCProxy) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	if err := rpp.receive("ConsensusModule.RequestVote", args); err != nil {
+		return err
+	}
+	return rpp.cm.RequestVote(args, reply)
+}
+
+func (rpp *RPCProxy) RequestPreVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	if err := rpp.receive("ConsensusModule.RequestPreVote", args); err != nil {
+		return err
+	}
+	return rpp.cm.RequestPreVote(args, reply)
+}
+
+func (rpp *RPCProxy) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if err := rpp.receive("ConsensusModule.AppendEntries", args); err != nil {
+		return err
+	}
+	return rpp.cm.AppendEntries(args, reply)
+}
+
+func (rpp *RPCProxy) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if err := rpp.receive("ConsensusModule.InstallSnapshot", args); err != nil {
+		return err
+	}
+	return rpp.cm.InstallSnapshot(args, reply)
+}
+
+func (rpp *RPCProxy) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	if err := rpp.receive("ConsensusModule.TimeoutNow", args); err != nil {
+		return err
+	}
+	return rpp.cm.TimeoutNow(args, reply)
+}
 
-	if peer == nil {
-		// Return an error if this function is called after shutdown
-		return fmt.Errorf("call client %d after it's closed", id)
-	} else {
-		return peer.Call(serviceMethod, args, reply)
+func (rpp *RPCProxy) ProposeForward(args ProposeForwardArgs, reply *ProposeForwardReply) error {
+	if err := rpp.receive("ConsensusModule.ProposeForward", args); err != nil {
+		return err
 	}
+	return rpp.cm.ProposeForward(args, reply)
 }
@@ -0,0 +1,417 @@
+package raft
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCA creates a self-signed CA certificate for tests.
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// newTestCert creates a certificate for the server name "raft" signed by ca,
+// usable on both ends of a connection.
+func newTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "raft"},
+		DNSNames:     []string{"raft"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestTLSConfig returns a mutual TLS config with a certificate signed by
+// ca, that trusts ca only.
+func newTestTLSConfig(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, ca, caKey)},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ServerName:   "raft",
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca, caKey := newTestCA(t, "raft CA")
+	h := NewHarnessWithTLS(t, 3, func(id int) *tls.Config {
+		return newTestTLSConfig(t, ca, caKey)
+	})
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+
+	// A peer with a certificate from another CA can't connect.
+	rogueCA, rogueKey := newTestCA(t, "rogue CA")
+	transport := NewRPCTransport()
+	transport.SetTLSConfig(newTestTLSConfig(t, rogueCA, rogueKey))
+	if err := transport.ConnectToPeer(0, h.cluster[0].GetListenAddr()); err == nil {
+		transport.Close()
+		t.Errorf("peer with an untrusted certificate connected")
+	}
+
+	// Nor can one without TLS.
+	plain := NewRPCTransport()
+	defer plain.Close()
+	if err := plain.ConnectToPeer(0, h.cluster[0].GetListenAddr()); err == nil {
+		var reply RequestVoteReply
+		if err := plain.Call(0, "ConsensusModule.RequestVote", RequestVoteArgs{Term: 100, CandidateId: 1}, &reply); err == nil {
+			t.Errorf("RPC without TLS succeeded: %+v", reply)
+		}
+	}
+}
+
+func TestServerDisconnectAll(t *testing.T) {
+	// With PreVote, the old leader's elections while it's cut off don't
+	// raise its term, so it rejoins without deposing the new leader.
+	config := DefaultConfig()
+	config.CheckQuorum = true
+	config.PreVote = true
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	// The leader is partitioned off on its own; the harness mustn't count it
+	// in the checks.
+	origLeaderId, _ := h.CheckSingleLeader()
+	if err := h.cluster[origLeaderId].DisconnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	h.connected[origLeaderId] = false
+
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId == origLeaderId {
+		t.Fatalf("isolated leader %d is still the majority's leader", origLeaderId)
+	}
+	sleepMs(400)
+	if _, isLeader := h.cluster[origLeaderId].GetState(); isLeader {
+		t.Errorf("isolated leader %d didn't step down", origLeaderId)
+	}
+
+	// Back in the cluster, it follows the new leader.
+	if err := h.cluster[origLeaderId].ReconnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	h.connected[origLeaderId] = true
+	sleepMs(250)
+	if id, _ := h.CheckSingleLeader(); id != newLeaderId {
+		t.Errorf("leader is %d after the partition healed; want %d", id, newLeaderId)
+	}
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+}
+
+func TestRPCHooks(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[string]int)
+	received := make(map[string]int)
+	config := DefaultConfig()
+	config.OnRPCSend = func(peerId int, serviceMethod string, args interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args.(type) {
+		case RequestVoteArgs, AppendEntriesArgs:
+			sent[serviceMethod]++
+		default:
+			t.Errorf("%s sent to %d with args %#v", serviceMethod, peerId, args)
+		}
+	}
+	config.OnRPCRecv = func(serviceMethod string, args interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[serviceMethod]++
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, method := range []string{"ConsensusModule.RequestVote", "ConsensusModule.AppendEntries"} {
+		if sent[method] == 0 || received[method] == 0 {
+			t.Errorf("%s: hooks saw %d sent and %d received; want both", method, sent[method], received[method])
+		}
+	}
+}
+
+func TestProposeBackpressure(t *testing.T) {
+	// The followers mustn't time out while they're cut off from the leader.
+	config := DefaultConfig()
+	config.ElectionTimeoutMin = 3 * time.Second
+	config.ElectionTimeoutMax = 4 * time.Second
+	config.MaxLogEntries = 20
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	h.ElectLeader(0)
+	sleepMs(150)
+	leader := h.cluster[0]
+
+	// Nothing commits while the followers are partitioned, so the leader
+	// takes MaxLogEntries commands and rejects the rest.
+	h.DisconnectPeer(1)
+	h.DisconnectPeer(2)
+	accepted := 0
+	for v := 1; v <= 100; v++ {
+		_, _, err := leader.Propose(v)
+		if err == nil {
+			accepted++
+		} else if !errors.Is(err, ErrLogFull) {
+			t.Fatalf("Propose(%d): got %v; want ErrLogFull", v, err)
+		}
+	}
+	if accepted != config.MaxLogEntries {
+		t.Errorf("leader accepted %d commands; want %d", accepted, config.MaxLogEntries)
+	}
+	leader.cm.mu.Lock()
+	logLen := len(leader.cm.log)
+	leader.cm.mu.Unlock()
+	if logLen > config.MaxLogEntries+1 {
+		t.Errorf("leader's log has %d entries", logLen)
+	}
+
+	// Once the entries commit, there's room again.
+	h.ReconnectPeer(1)
+	h.ReconnectPeer(2)
+	sleepMs(250)
+	h.CheckCommittedN(config.MaxLogEntries, 3)
+	h.CheckNotCommitted(config.MaxLogEntries + 1)
+	if _, _, err := leader.Propose(101); err != nil {
+		t.Errorf("Propose after the log drained: %v", err)
+	}
+}
+
+func TestServerReconnectPeer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	// The server remembers the address ConnectToPeer was given, so the peer
+	// can be redialed by its id alone.
+	s := h.cluster[0]
+	if err := s.DisconnectPeer(1); err != nil {
+		t.Fatal(err)
+	}
+	var reply RequestVoteReply
+	if err := s.Call(1, "ConsensusModule.RequestVote", RequestVoteArgs{}, &reply); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("Call after DisconnectPeer: got %v; want ErrPeerClosed", err)
+	}
+	if err := s.ReconnectPeer(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Call(1, "ConsensusModule.RequestVote", RequestVoteArgs{}, &reply); err != nil {
+		t.Errorf("Call after ReconnectPeer: %v", err)
+	}
+	if err := s.ReconnectPeer(7); err == nil {
+		t.Errorf("ReconnectPeer to a peer it never connected to succeeded")
+	}
+
+	// The cluster keeps working over the new connection.
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+}
+
+func TestRPCTimeoutConfig(t *testing.T) {
+	// The default follows HeartbeatInterval, so it stays below the election
+	// timeout, whichever way that's tuned.
+	config := &Config{ElectionTimeoutMin: 60 * time.Millisecond, ElectionTimeoutMax: 120 * time.Millisecond, HeartbeatInterval: 20 * time.Millisecond}
+	if c := config.withDefaults(); c.RPCTimeout != 40*time.Millisecond || c.validate() != nil {
+		t.Errorf("default RPC timeout for a 20ms heartbeat: got %v (%v); want 40ms", c.RPCTimeout, c.validate())
+	}
+	if c := DefaultConfig(); c.withDefaults().RPCTimeout != c.RPCTimeout {
+		t.Errorf("withDefaults changed DefaultConfig's RPC timeout %v", c.RPCTimeout)
+	}
+
+	// A candidate that waits for votes past its election timeout never
+	// counts them.
+	config.RPCTimeout = config.ElectionTimeoutMin
+	if _, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config); err == nil {
+		t.Errorf("NewConsensusModule accepted an RPC timeout of the minimal election timeout")
+	}
+}
+
+func TestRPCTimeoutOnHungPeer(t *testing.T) {
+	h := NewHarness(t, 5)
+	defer h.Shutdown()
+
+	// Server 4 is replaced by a peer that takes RPCs, but never replies.
+	h.CrashPeer(4)
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+	go func() {
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		if err := h.cluster[i].ConnectToPeer(4, hung.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	cm := h.cluster[origLeaderId].cm
+	start := time.Now()
+	var reply RequestVoteReply
+	if err := cm.callPeer(4, "ConsensusModule.RequestVote", RequestVoteArgs{}, &reply); !errors.Is(err, ErrTimeout) {
+		t.Errorf("RPC to the hung peer: got %v; want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*cm.config.RPCTimeout {
+		t.Errorf("RPC to the hung peer gave up after %v; want about %v", elapsed, cm.config.RPCTimeout)
+	}
+
+	// The three servers left elect a leader without the hung peer's vote.
+	h.DisconnectPeer(origLeaderId)
+	if newLeaderId, _ := h.CheckSingleLeader(); newLeaderId == origLeaderId {
+		t.Errorf("leader is still %d after it was disconnected", newLeaderId)
+	}
+	h.SubmitToLeader(42)
+	sleepMs(250)
+	h.CheckCommittedN(42, 3)
+}
+
+func TestServerErrors(t *testing.T) {
+	// Before Serve, a server has no CM to do anything with.
+	s := NewServer(0, []int{1, 2}, NewMapStorage(), make(chan interface{}), make(chan CommitEntry), nil)
+	if _, err := s.ReadIndex(); !errors.Is(err, ErrShutdown) {
+		t.Errorf("ReadIndex before Serve: got %v; want ErrShutdown", err)
+	}
+	if err := s.Barrier(context.Background()); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Barrier before Serve: got %v; want ErrShutdown", err)
+	}
+	if err := s.CampaignNow(); !errors.Is(err, ErrShutdown) {
+		t.Errorf("CampaignNow before Serve: got %v; want ErrShutdown", err)
+	}
+	if _, _, err := s.Propose(1); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Propose before Serve: got %v; want ErrShutdown", err)
+	}
+	if err := s.LinearizableRead(context.Background(), func() error { return nil }); !errors.Is(err, ErrShutdown) {
+		t.Errorf("LinearizableRead before Serve: got %v; want ErrShutdown", err)
+	}
+
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+	if _, err := h.cluster[followerId].ReadIndex(); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("ReadIndex on a follower: got %v; want ErrNotLeader", err)
+	}
+	h.cluster[followerId].DisconnectPeer(leaderId)
+	var reply RequestVoteReply
+	if err := h.cluster[followerId].Call(leaderId, "ConsensusModule.RequestVote", RequestVoteArgs{}, &reply); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("Call to a disconnected peer: got %v; want ErrPeerClosed", err)
+	}
+}
+
+// slowCodec is a jsonCodec that takes a while to decode every command, and
+// so to deliver it.
+type slowCodec struct {
+	jsonCodec
+}
+
+func (c slowCodec) Decode(data []byte) (interface{}, error) {
+	time.Sleep(5 * time.Millisecond)
+	return c.jsonCodec.Decode(data)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	config := DefaultConfig()
+	config.GracefulShutdown = true
+	config.Codec = slowCodec{}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	// The leader is shut down with entries still being replicated and
+	// delivered. They're committed and delivered before Shutdown returns.
+	leaderId, term := h.CheckSingleLeader()
+	cm := h.cluster[leaderId].cm
+	lastIndex := -1
+	for v := 1; v <= 20; v++ {
+		index, _, isLeader := h.cluster[leaderId].Submit(v)
+		if !isLeader {
+			t.Fatalf("server %d lost leadership", leaderId)
+		}
+		lastIndex = index
+	}
+	h.cluster[leaderId].Shutdown()
+	cm.mu.Lock()
+	deliveredIndex := cm.deliveredIndex
+	cm.mu.Unlock()
+	if deliveredIndex < lastIndex {
+		t.Errorf("leader %d delivered up to index %d before shutting down; want %d", leaderId, deliveredIndex, lastIndex)
+	}
+	h.DisconnectPeer(leaderId)
+	h.alive[leaderId] = false
+
+	// Its leadership was handed over, and the others have all the entries.
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == leaderId || newTerm <= term {
+		t.Errorf("leader %d in term %d; want another leader than %d after term %d", newLeaderId, newTerm, leaderId, term)
+	}
+	sleepMs(150)
+	for v := 1; v <= 20; v++ {
+		h.CheckCommittedN(float64(v), 2)
+	}
+}
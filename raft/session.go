@@ -0,0 +1,80 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+)
+
+// Sessions makes client commands idempotent for a state machine. A client
+// that retries a command, e.g. after a leader change, may get it committed
+// more than once; if every command carries the id of the client that issued
+// it and a sequence number the client increments for every new command, the
+// state machine can skip the duplicates: it checks each committed command
+// with IsDuplicate before applying it, and then records it with Applied.
+//
+// The session table is part of the state machine's state, and has to be
+// included in its snapshots: a server that restores a snapshot would
+// otherwise apply again commands the snapshot already covers. Sessions
+// implements gob.GobEncoder and gob.GobDecoder for that purpose.
+type Sessions struct {
+	mu sync.Mutex
+
+	// lastSeq maps every client id to the sequence number of the last command
+	// of the client that was applied.
+	lastSeq map[int64]int64
+}
+
+// NewSessions creates an empty session table.
+func NewSessions() *Sessions {
+	return &Sessions{lastSeq: make(map[int64]int64)}
+}
+
+// Register starts a session for clientId, with no commands applied yet. It's
+// optional: a session is also started by the client's first Applied command.
+func (s *Sessions) Register(clientId int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lastSeq[clientId]; !ok {
+		s.lastSeq[clientId] = 0
+	}
+}
+
+// IsDuplicate reports whether the command with sequence number seq of
+// clientId was already applied. Sequence numbers start at 1.
+func (s *Sessions) IsDuplicate(clientId int64, seq int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return seq <= s.lastSeq[clientId]
+}
+
+// Applied records that the command with sequence number seq of clientId was
+// applied.
+func (s *Sessions) Applied(clientId int64, seq int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.lastSeq[clientId] {
+		s.lastSeq[clientId] = seq
+	}
+}
+
+func (s *Sessions) GobEncode() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.lastSeq); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Sessions) GobDecode(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lastSeq := make(map[int64]int64)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&lastSeq); err != nil {
+		return err
+	}
+	s.lastSeq = lastSeq
+	return nil
+}
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+type sessionCommand struct {
+	ClientId int64
+	Seq      int64
+}
+
+func init() {
+	gob.Register(sessionCommand{})
+}
+
+func TestSessions(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	// Client 1 retries its second command, which then commits twice; client
+	// 2's first command has the same sequence number as one of client 1's.
+	commands := []sessionCommand{{1, 1}, {1, 2}, {1, 2}, {2, 1}, {1, 3}}
+	for _, cmd := range commands {
+		h.SubmitToLeader(cmd)
+		sleepMs(50)
+	}
+	sleepMs(250)
+
+	// Every server applies the retried command once.
+	for i := 0; i < 3; i++ {
+		commits := h.Commits(i)
+		if len(commits) != len(commands) {
+			t.Fatalf("server %d committed %v; want %d entries", i, commits, len(commands))
+		}
+		sessions := NewSessions()
+		var applied []sessionCommand
+		for _, entry := range commits {
+			cmd := entry.Command.(sessionCommand)
+			if sessions.IsDuplicate(cmd.ClientId, cmd.Seq) {
+				continue
+			}
+			sessions.Applied(cmd.ClientId, cmd.Seq)
+			applied = append(applied, cmd)
+		}
+		want := []sessionCommand{{1, 1}, {1, 2}, {2, 1}, {1, 3}}
+		if len(applied) != len(want) {
+			t.Fatalf("server %d applied %v; want %v", i, applied, want)
+		}
+		for j := range want {
+			if applied[j] != want[j] {
+				t.Errorf("server %d applied %v; want %v", i, applied, want)
+				break
+			}
+		}
+	}
+
+	// A restored session table still detects the duplicates.
+	sessions := NewSessions()
+	sessions.Applied(1, 2)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sessions); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewSessions()
+	if err := gob.NewDecoder(&buf).Decode(restored); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.IsDuplicate(1, 2) || !restored.IsDuplicate(1, 1) || restored.IsDuplicate(1, 3) || restored.IsDuplicate(2, 1) {
+		t.Errorf("restored sessions %v; want client 1 at sequence number 2", restored.lastSeq)
+	}
+}
@@ -0,0 +1,330 @@
+package raft
+
+import (
+	"os"
+)
+
+// maxSnapshotRestarts caps how many times leaderSendSnapshot starts a transfer
+// over when the follower rejects a chunk; the transfer is retried with the
+// next heartbeat after that.
+const maxSnapshotRestarts = 3
+
+// See figure 13 in the paper. The snapshot is sent in chunks of at most
+// SnapshotChunkSize bytes: Data is the chunk starting at byte Offset of the
+// snapshot, and Done is set on the last chunk.
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Configuration     ConfigEntry
+	Offset            int
+	Data              []byte
+	Done              bool
+}
+
+type InstallSnapshotReply struct {
+	Term int
+
+	// Restart is set when the chunk doesn't follow the ones received so far,
+	// e.g. after a chunk was lost, or when the received snapshot fails its
+	// checksum; the leader then starts over from the first chunk.
+	Restart bool
+}
+
+// snapshotTransfer is a snapshot being received in chunks. The chunks are
+// written to a temporary file, and the snapshot is only installed once the
+// last one arrived.
+type snapshotTransfer struct {
+	term              int
+	lastIncludedIndex int
+	lastIncludedTerm  int
+	file              *os.File
+
+	// offset is the number of bytes received so far.
+	offset int
+}
+
+// Snapshot is called by the client to report that its state machine snapshot
+// covers all entries up to and including index. The CM keeps the snapshot and
+// discards those entries from its log. index must not exceed the index of the
+// latest applied entry (see LastApplied); stale or out-of-range calls are
+// ignored.
+func (cm *ConsensusModule) Snapshot(index int, snapshot []byte) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.getState() == Dead {
+		return
+	}
+	if index <= cm.lastIncludedIndex || index > cm.appliedIndex() {
+		cm.dlog("Snapshot at %d ignored: lastIncludedIndex=%d, appliedIndex=%d", index, cm.lastIncludedIndex, cm.appliedIndex())
+		return
+	}
+
+	sliceIndex := cm.logIndexToSlice(index)
+	cm.snapshotConfig = cm.configurationAt(index)
+	cm.lastIncludedTerm = cm.log[sliceIndex].Term
+	cm.log = cm.newLog(cm.log[sliceIndex+1:])
+	cm.lastIncludedIndex = index
+	cm.snapshot = cm.encodeSnapshot(snapshot)
+	cm.persistSnapshot()
+	cm.persistLog()
+	cm.dlog("Snapshot at %d, term=%d; log=%v", index, cm.lastIncludedTerm, cm.log)
+}
+
+// maybeSnapshot implements Config.SnapshotThreshold: it takes a snapshot with
+// SnapshotFunc if enough entries were delivered since the latest one. It's
+// called by commitChanSender after every delivery.
+// Must be called without cm.mu held.
+func (cm *ConsensusModule) maybeSnapshot() {
+	if cm.config.SnapshotThreshold == 0 || cm.config.SnapshotFunc == nil {
+		return
+	}
+	cm.mu.Lock()
+	index := cm.appliedIndex()
+	due := cm.getState() != Dead && index-cm.lastIncludedIndex > cm.config.SnapshotThreshold
+	cm.mu.Unlock()
+	if !due {
+		return
+	}
+
+	snapshot, err := cm.config.SnapshotFunc(index)
+	if err != nil {
+		cm.wlog("SnapshotFunc at index %d: %v", index, err)
+		return
+	}
+	cm.dlog("taking snapshot at %d, over SnapshotThreshold", index)
+	cm.Snapshot(index, snapshot)
+}
+
+// InstallSnapshot RPC.
+func (cm *ConsensusModule) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Dead {
+		reply.Term = cm.getTerm()
+		return nil
+	}
+	cm.dlog("InstallSnapshot: term=%d leader=%d lastIncludedIndex=%d lastIncludedTerm=%d", args.Term, args.LeaderId, args.LastIncludedIndex, args.LastIncludedTerm)
+
+	if args.Term > cm.getTerm() {
+		cm.dlog("... term out of date in InstallSnapshot")
+		cm.becomeFollower(args.Term)
+	}
+
+	reply.Term = cm.getTerm()
+	if args.Term < cm.getTerm() {
+		return nil
+	}
+	if cm.getState() != Follower {
+		cm.becomeFollower(args.Term)
+	}
+	cm.electionResetEvent = cm.clock.Now()
+	cm.lastLeaderContact = cm.electionResetEvent
+	cm.setLeaderId(args.LeaderId)
+	cm.peerAnswered()
+
+	if args.LastIncludedIndex <= cm.lastIncludedIndex {
+		cm.dlog("... stale snapshot, already have lastIncludedIndex=%d", cm.lastIncludedIndex)
+		return nil
+	}
+
+	data, ok := cm.receiveSnapshotChunk(args)
+	if !ok {
+		cm.dlog("... snapshot chunk at offset %d out of order, restarting transfer", args.Offset)
+		reply.Restart = true
+		return nil
+	}
+	if !args.Done {
+		return nil
+	}
+	snapshot, err := cm.decodeSnapshot(data)
+	if err != nil {
+		cm.wlog("decoding snapshot from leader %d: %v", args.LeaderId, err)
+		reply.Restart = true
+		return nil
+	}
+
+	// If our log has the entry the snapshot ends with, the entries following
+	// it are retained; otherwise the whole log is discarded.
+	sliceIndex := cm.logIndexToSlice(args.LastIncludedIndex)
+	if sliceIndex < len(cm.log) && cm.log[sliceIndex].Term == args.LastIncludedTerm {
+		cm.log = cm.newLog(cm.log[sliceIndex+1:])
+	} else {
+		cm.log = cm.newLog(nil)
+	}
+	cm.lastIncludedIndex = args.LastIncludedIndex
+	cm.lastIncludedTerm = args.LastIncludedTerm
+	cm.snapshotConfig = args.Configuration
+	cm.snapshot = data
+	cm.persistSnapshot()
+	cm.persistLog()
+	cm.applyConfiguration()
+
+	if args.LastIncludedIndex > cm.getCommitIndex() {
+		cm.setCommitIndex(args.LastIncludedIndex)
+	}
+	if args.LastIncludedIndex > cm.lastApplied {
+		cm.pendingSnapshot = true
+		cm.pendingSnapshotData = snapshot
+		cm.signalCommitReady()
+	}
+	cm.dlog("... installed snapshot; log=%v", cm.log)
+	return nil
+}
+
+// receiveSnapshotChunk adds the chunk args carries to the snapshot being
+// received. It returns the whole snapshot once args carries the last chunk.
+// ok is false if the chunk doesn't follow the ones received so far: it's
+// stale, out of order, or from another snapshot; the transfer then has to
+// start over.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) receiveSnapshotChunk(args InstallSnapshotArgs) (data []byte, ok bool) {
+	cm.assertLocked()
+	if args.Offset == 0 {
+		cm.discardSnapshotTransfer()
+		if args.Done {
+			// The snapshot fits in a single chunk.
+			return args.Data, true
+		}
+		file, err := os.CreateTemp("", "raft-snapshot-*")
+		if err != nil {
+			cm.wlog("creating file for snapshot transfer: %v", err)
+			return nil, false
+		}
+		cm.incomingSnapshot = &snapshotTransfer{
+			term:              args.Term,
+			lastIncludedIndex: args.LastIncludedIndex,
+			lastIncludedTerm:  args.LastIncludedTerm,
+			file:              file,
+		}
+	}
+
+	t := cm.incomingSnapshot
+	if t == nil || t.term != args.Term || t.lastIncludedIndex != args.LastIncludedIndex ||
+		t.lastIncludedTerm != args.LastIncludedTerm || t.offset != args.Offset {
+		cm.discardSnapshotTransfer()
+		return nil, false
+	}
+	if _, err := t.file.Write(args.Data); err != nil {
+		cm.wlog("writing snapshot chunk: %v", err)
+		cm.discardSnapshotTransfer()
+		return nil, false
+	}
+	t.offset += len(args.Data)
+	if !args.Done {
+		return nil, true
+	}
+
+	data, err := os.ReadFile(t.file.Name())
+	cm.discardSnapshotTransfer()
+	if err != nil {
+		cm.wlog("reading received snapshot: %v", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// discardSnapshotTransfer drops the snapshot being received, if any, and
+// removes its temporary file.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) discardSnapshotTransfer() {
+	cm.assertLocked()
+	if t := cm.incomingSnapshot; t != nil {
+		t.file.Close()
+		os.Remove(t.file.Name())
+		cm.incomingSnapshot = nil
+	}
+}
+
+// leaderSendSnapshot sends the leader's snapshot to a peer that's too far
+// behind to be caught up with AppendEntries, and adjusts the peer's indices
+// when it succeeds. The snapshot is sent in chunks of SnapshotChunkSize, one
+// at a time; only one transfer to a peer runs at a time, so heartbeat rounds
+// that overlap with a long transfer don't start another one. onAck is as for
+// leaderSendHeartbeats.
+func (cm *ConsensusModule) leaderSendSnapshot(peerId int, savedCurrentTerm int, onAck func(peerId int)) {
+	cm.mu.Lock()
+	if cm.sendingSnapshot[peerId] {
+		cm.mu.Unlock()
+		return
+	}
+	cm.sendingSnapshot[peerId] = true
+	snapshot := cm.snapshot
+	args := InstallSnapshotArgs{
+		Term:              savedCurrentTerm,
+		LeaderId:          cm.id,
+		LastIncludedIndex: cm.lastIncludedIndex,
+		LastIncludedTerm:  cm.lastIncludedTerm,
+		Configuration:     cm.snapshotConfig,
+	}
+	chunkSize := cm.config.SnapshotChunkSize
+	cm.mu.Unlock()
+
+	defer func() {
+		cm.mu.Lock()
+		delete(cm.sendingSnapshot, peerId)
+		cm.mu.Unlock()
+	}()
+
+	cm.dlog("sending InstallSnapshot to %v: lastIncludedIndex=%d, size=%d", peerId, args.LastIncludedIndex, len(snapshot))
+	restarts := 0
+	for args.Offset = 0; ; {
+		end := args.Offset + chunkSize
+		if end > len(snapshot) {
+			end = len(snapshot)
+		}
+		args.Data = snapshot[args.Offset:end]
+		args.Done = end == len(snapshot)
+
+		sentAt := cm.clock.Now()
+		var reply InstallSnapshotReply
+		if err := cm.callPeerTimeout(peerId, "ConsensusModule.InstallSnapshot", args, &reply, cm.config.SnapshotRPCTimeout); err != nil {
+			return
+		}
+
+		cm.mu.Lock()
+		if cm.getState() == Dead {
+			cm.mu.Unlock()
+			return
+		}
+		if reply.Term > cm.getTerm() {
+			cm.dlog("term out of date in InstallSnapshot reply")
+			cm.becomeFollower(reply.Term)
+			cm.mu.Unlock()
+			return
+		}
+		if cm.getState() != Leader || savedCurrentTerm != reply.Term {
+			cm.mu.Unlock()
+			return
+		}
+		cm.recordAck(peerId, sentAt, onAck)
+
+		if reply.Restart {
+			cm.mu.Unlock()
+			if restarts++; restarts > maxSnapshotRestarts {
+				cm.dlog("InstallSnapshot to %d restarted too often, giving up for now", peerId)
+				return
+			}
+			cm.dlog("InstallSnapshot to %d restarting", peerId)
+			args.Offset = 0
+			continue
+		}
+		if !args.Done {
+			cm.mu.Unlock()
+			args.Offset = end
+			continue
+		}
+
+		if args.LastIncludedIndex > cm.matchIndex[peerId] {
+			cm.matchIndex[peerId] = args.LastIncludedIndex
+		}
+		if args.LastIncludedIndex+1 > cm.nextIndex[peerId] {
+			cm.nextIndex[peerId] = args.LastIncludedIndex + 1
+		}
+		cm.dlog("InstallSnapshot reply from %d: nextIndex := %d", peerId, cm.nextIndex[peerId])
+		cm.mu.Unlock()
+		return
+	}
+}
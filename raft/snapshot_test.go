@@ -0,0 +1,400 @@
+package raft
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// snapshotAll makes every live server of h take a snapshot at index, with
+// data as the state machine's snapshot.
+func snapshotAll(h *Harness, index int, data []byte) {
+	for i := 0; i < h.n; i++ {
+		if h.alive[i] {
+			h.cluster[i].Snapshot(index, data)
+		}
+	}
+}
+
+func TestSnapshotThenReplicate(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+	for v := 1; v <= 5; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(3)
+	snapshotAll(h, index, []byte("1,2,3"))
+
+	// Entries appended after the compaction are replicated and committed at
+	// the right indices.
+	h.SubmitToLeader(6)
+	h.SubmitToLeader(7)
+	sleepMs(250)
+	_, index5 := h.CheckCommitted(5)
+	nc, index7 := h.CheckCommitted(7)
+	if nc != 3 {
+		t.Errorf("7 committed on %d servers; want 3", nc)
+	}
+	if index7 != index5+2 {
+		t.Errorf("7 committed at index %d; want %d", index7, index5+2)
+	}
+	for i := 0; i < 3; i++ {
+		entries := h.cluster[i].cm.LogSlice(0, index7+1)
+		if len(entries) != index7-index {
+			t.Errorf("server %d: log has %d entries after the snapshot; want %d", i, len(entries), index7-index)
+		}
+		if last := entries[len(entries)-1].Command; last != 7 {
+			t.Errorf("server %d: last entry %v; want 7", i, last)
+		}
+	}
+}
+
+func TestSnapshotLaggingFollowerCatchesUp(t *testing.T) {
+	// With PreVote, the follower doesn't come back with a term that deposes
+	// the leader.
+	config := DefaultConfig()
+	config.PreVote = true
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	lagging := (leaderId + 1) % 3
+	h.DisconnectPeer(lagging)
+
+	for v := 1; v <= 5; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(5)
+	snapshotAll(h, index, []byte("1,2,3,4,5"))
+	h.SubmitToLeader(6)
+	sleepMs(150)
+
+	// The entries the follower misses were compacted away, so the leader has
+	// to send it the snapshot.
+	h.ReconnectPeer(lagging)
+	sleepMs(500)
+
+	commits := h.Commits(lagging)
+	if len(commits) != 2 {
+		t.Fatalf("lagging follower committed %v; want the snapshot and 6", commits)
+	}
+	if !commits[0].IsSnapshot || commits[0].Index != index || !bytes.Equal(commits[0].Snapshot, []byte("1,2,3,4,5")) {
+		t.Errorf("first commit %+v; want the snapshot at %d", commits[0], index)
+	}
+	if commits[1].Command != 6 || commits[1].Index != index+1 {
+		t.Errorf("second commit %+v; want 6 at %d", commits[1], index+1)
+	}
+}
+
+func TestSnapshotRestart(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+	for v := 1; v <= 3; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(3)
+	snapshotAll(h, index, []byte("1,2,3"))
+	h.SubmitToLeader(4)
+	sleepMs(250)
+	h.CheckCommittedN(4, 3)
+
+	// A restarted server restores its snapshot, and the entries following it,
+	// from storage.
+	for i := 0; i < 3; i++ {
+		h.CrashPeer(i)
+	}
+	for i := 0; i < 3; i++ {
+		h.RestartPeer(i)
+	}
+	h.CheckSingleLeader()
+	h.SubmitToLeader(5)
+	sleepMs(350)
+
+	for i := 0; i < 3; i++ {
+		commits := h.Commits(i)
+		if len(commits) != 3 {
+			t.Fatalf("server %d committed %v; want the snapshot, 4 and 5", i, commits)
+		}
+		if !commits[0].IsSnapshot || commits[0].Index != index || !bytes.Equal(commits[0].Snapshot, []byte("1,2,3")) {
+			t.Errorf("server %d: first commit %+v; want the snapshot at %d", i, commits[0], index)
+		}
+		if commits[1].Command != 4 || commits[2].Command != 5 {
+			t.Errorf("server %d: commits %v; want 4 and 5 after the snapshot", i, commits[1:])
+		}
+	}
+}
+
+// installLagging disconnects a follower, commits entries without it and
+// makes every other server snapshot them with data, then reconnects the
+// follower so the leader sends it the snapshot. It returns the follower's id
+// and the snapshot's index. h should run with PreVote, or the follower's
+// elections while it's away may depose the leader when it comes back.
+func installLagging(h *Harness, data []byte) (int, int) {
+	leaderId, _ := h.CheckSingleLeader()
+	lagging := (leaderId + 1) % h.n
+	h.DisconnectPeer(lagging)
+	for v := 1; v <= 5; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(5)
+	snapshotAll(h, index, data)
+	h.ReconnectPeer(lagging)
+	return lagging, index
+}
+
+func TestSnapshotSentInChunks(t *testing.T) {
+	var chunks atomic.Int64
+	config := DefaultConfig()
+	config.SnapshotChunkSize = 1 << 10
+	config.PreVote = true
+	config.OnRPCSend = func(peerId int, serviceMethod string, args interface{}) {
+		if serviceMethod == "ConsensusModule.InstallSnapshot" {
+			chunks.Add(1)
+		}
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	lagging, index := installLagging(h, data)
+	sleepMs(1000)
+
+	commits := h.Commits(lagging)
+	if len(commits) != 1 || !commits[0].IsSnapshot || commits[0].Index != index {
+		t.Fatalf("lagging follower committed %v; want the snapshot at %d", commits, index)
+	}
+	if !bytes.Equal(commits[0].Snapshot, data) {
+		t.Errorf("received snapshot differs from the one taken")
+	}
+	if n := chunks.Load(); n < 64 {
+		t.Errorf("snapshot sent in %d chunks; want at least 64", n)
+	}
+}
+
+func TestInstallSnapshotChunkOutOfOrder(t *testing.T) {
+	cm := newIdleCM(t, nil)
+	args := InstallSnapshotArgs{
+		Term:              1,
+		LeaderId:          1,
+		LastIncludedIndex: 4,
+		LastIncludedTerm:  1,
+		Offset:            0,
+		Data:              []byte("abc"),
+	}
+	var reply InstallSnapshotReply
+	if err := cm.InstallSnapshot(args, &reply); err != nil || reply.Restart {
+		t.Fatalf("first chunk: %v, %+v", err, reply)
+	}
+
+	// A chunk after a lost one makes the follower ask for a restart.
+	args.Offset = 6
+	if err := cm.InstallSnapshot(args, &reply); err != nil || !reply.Restart {
+		t.Fatalf("chunk at offset 6: %v, %+v; want a restart", err, reply)
+	}
+	// The transfer was dropped, so a chunk that would have followed the first
+	// one doesn't fit anymore either.
+	reply = InstallSnapshotReply{}
+	args.Offset = 3
+	if err := cm.InstallSnapshot(args, &reply); err != nil || !reply.Restart {
+		t.Fatalf("chunk at offset 3: %v, %+v; want a restart", err, reply)
+	}
+}
+
+func TestOneSnapshotInFlightPerPeer(t *testing.T) {
+	var blocked, maxBlocked atomic.Int64
+	release := make(chan struct{})
+	config := DefaultConfig()
+	config.PreVote = true
+	config.OnRPCSend = func(peerId int, serviceMethod string, args interface{}) {
+		if serviceMethod != "ConsensusModule.InstallSnapshot" {
+			return
+		}
+		n := blocked.Add(1)
+		for {
+			max := maxBlocked.Load()
+			if n <= max || maxBlocked.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		<-release
+		blocked.Add(-1)
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	// The leader starts sending the snapshot, which gets stuck; the heartbeat
+	// rounds that go by meanwhile don't start more transfers.
+	lagging, index := installLagging(h, []byte("1,2,3,4,5"))
+	sleepMs(500)
+	if n := maxBlocked.Load(); n != 1 {
+		t.Errorf("%d snapshot transfers in flight; want 1", n)
+	}
+
+	close(release)
+	sleepMs(500)
+	commits := h.Commits(lagging)
+	if len(commits) != 1 || !commits[0].IsSnapshot || commits[0].Index != index {
+		t.Errorf("lagging follower committed %v; want the snapshot at %d", commits, index)
+	}
+}
+
+func TestSnapshotThreshold(t *testing.T) {
+	config := DefaultConfig()
+	config.PreVote = true
+	config.SnapshotThreshold = 5
+	config.SnapshotFunc = func(appliedIndex int) ([]byte, error) {
+		return []byte(strconv.Itoa(appliedIndex)), nil
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	lagging := (leaderId + 1) % 3
+	h.DisconnectPeer(lagging)
+	for v := 1; v <= 20; v++ {
+		h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(20)
+
+	// The servers compacted their logs by themselves along the way.
+	for _, id := range []int{leaderId, (leaderId + 2) % 3} {
+		cm := h.cluster[id].cm
+		cm.mu.Lock()
+		if cm.lastIncludedIndex < 15 || len(cm.log) > 6 {
+			t.Errorf("server %d: snapshot at %d, %d entries in the log; want no more than 6 entries left", id, cm.lastIncludedIndex, len(cm.log))
+		}
+		cm.mu.Unlock()
+	}
+
+	// The entries the lagging follower misses are gone, so it gets a snapshot.
+	h.ReconnectPeer(lagging)
+	sleepMs(500)
+	commits := h.Commits(lagging)
+	if len(commits) == 0 || !commits[0].IsSnapshot {
+		t.Fatalf("lagging follower committed %v; want a snapshot first", commits)
+	}
+	if string(commits[0].Snapshot) != strconv.Itoa(commits[0].Index) {
+		t.Errorf("snapshot %q at %d; want the one SnapshotFunc made", commits[0].Snapshot, commits[0].Index)
+	}
+	if last := commits[len(commits)-1]; last.Index != index {
+		t.Errorf("lagging follower's last commit %+v; want it at %d, where 20 is", last, index)
+	}
+}
+
+func TestSnapshotGoesByAppliedIndex(t *testing.T) {
+	config := DefaultConfig()
+	config.AckApplied = true
+	config.SnapshotThreshold = 5
+	config.SnapshotFunc = func(appliedIndex int) ([]byte, error) {
+		return []byte(strconv.Itoa(appliedIndex)), nil
+	}
+	h := NewHarnessWithConfig(t, 3, config)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	var index int
+	for v := 1; v <= 10; v++ {
+		_, index = h.SubmitToLeader(v)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(10, 3)
+
+	// The entries were delivered, but none was reported applied: neither an
+	// automatic snapshot nor one the client asks for may cover them.
+	cm := h.cluster[leaderId].cm
+	cm.Snapshot(index, []byte("early"))
+	cm.mu.Lock()
+	if cm.lastIncludedIndex != -1 {
+		t.Errorf("snapshot at %d before anything was applied", cm.lastIncludedIndex)
+	}
+	cm.mu.Unlock()
+
+	// Once the client reports them applied, the next delivery takes the
+	// snapshot at the applied index, not at the delivered one.
+	cm.SetLastApplied(index)
+	h.SubmitToLeader(11)
+	sleepMs(250)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.lastIncludedIndex != index {
+		t.Errorf("snapshot at %d; want it at the applied index %d", cm.lastIncludedIndex, index)
+	}
+}
+
+// heapInUse returns the bytes of the heap in use after a garbage collection.
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+func TestSnapshotFreesCompactedEntries(t *testing.T) {
+	config := DefaultConfig()
+	config.LogCapacity = 64
+	// The debug log would print every entry in full.
+	config.Logger = NopLogger{}
+	ready := make(chan interface{})
+	close(ready)
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, nil, nil, NewMapStorage(), ready, commitChan, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	go func() {
+		for range commitChan {
+		}
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); sleepMs(10) {
+		if _, _, isLeader := cm.Report(); isLeader {
+			break
+		}
+	}
+
+	// Every round appends 16 entries of 32KiB, 512KiB in all, and compacts
+	// them into a snapshot; the entries must not stay reachable.
+	round := func() {
+		var index int
+		for i := 0; i < 16; i++ {
+			index, _, _ = cm.Submit(make([]byte, 32<<10))
+		}
+		for deadline := time.Now().Add(time.Second); cm.LastApplied() < index && time.Now().Before(deadline); {
+			sleepMs(5)
+		}
+		cm.Snapshot(index, nil)
+	}
+	for i := 0; i < 5; i++ {
+		round()
+	}
+	before := heapInUse()
+	for i := 0; i < 20; i++ {
+		round()
+	}
+	if after := heapInUse(); after > before+4<<20 {
+		t.Errorf("heap grew from %d to %d bytes over 20 rounds of snapshots", before, after)
+	}
+
+	// The compacted log has a backing array of its own, with LogCapacity
+	// entries of room.
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if len(cm.log) != 0 || cap(cm.log) != config.LogCapacity {
+		t.Errorf("log has %d entries, capacity %d after a snapshot; want 0 and %d", len(cm.log), cap(cm.log), config.LogCapacity)
+	}
+}
@@ -0,0 +1,99 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Storage is an interface implemented by stable storage providers.
+type Storage interface {
+	Set(key string, value []byte)
+
+	Get(key string) ([]byte, bool)
+
+	// HasData returns true iff any Sets were made on this Storage.
+	HasData() bool
+}
+
+// syncSetter is implemented by Storage providers that can turn off fsync of
+// their writes; see Config.NoSync.
+type syncSetter interface {
+	SetSync(sync bool)
+}
+
+// ErrCorruptStorage is matched, with errors.Is, by errors reporting that the
+// state in a Storage can't be restored. Retrying won't help: the operator has
+// to repair the storage, or wipe it and let the server catch up from its
+// peers.
+var ErrCorruptStorage = errors.New("corrupt storage")
+
+// CorruptStorageError reports that the value stored under Key is missing or
+// can't be decoded; Err is the underlying error. It matches ErrCorruptStorage.
+type CorruptStorageError struct {
+	Key string
+	Err error
+}
+
+func (e *CorruptStorageError) Error() string {
+	return fmt.Sprintf("corrupt storage: key %q: %v", e.Key, e.Err)
+}
+
+func (e *CorruptStorageError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptStorageError) Is(target error) bool {
+	return target == ErrCorruptStorage
+}
+
+// errNotFound is the underlying error of a CorruptStorageError for a key
+// that should be stored but isn't.
+var errNotFound = errors.New("not found")
+
+// LogStorage is an optional interface for Storage providers that store the
+// log entry by entry. If the CM's storage implements it, the CM passes its log
+// to StoreLog instead of encoding the whole log under the "log" key on every
+// change, so the provider can write just the entries that changed.
+type LogStorage interface {
+	Storage
+
+	// StoreLog makes entries the stored log; entries[0] is the entry at index
+	// firstIndex. entries must not be retained after StoreLog returns.
+	StoreLog(firstIndex int, entries []LogEntry)
+
+	// LoadLog returns the stored log, and the index of its first entry.
+	LoadLog() (firstIndex int, entries []LogEntry)
+}
+
+// MapStorage is a simple in-memory implementation of Storage for testing.
+type MapStorage struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func NewMapStorage() *MapStorage {
+	m := make(map[string][]byte)
+	return &MapStorage{
+		m: m,
+	}
+}
+
+func (ms *MapStorage) Get(key string) ([]byte, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	v, found := ms.m[key]
+	return v, found
+}
+
+func (ms *MapStorage) Set(key string, value []byte) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.m[key] = value
+}
+
+func (ms *MapStorage) HasData() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.m) > 0
+}
@@ -0,0 +1,376 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStorage is a MapStorage that counts the Sets of every key.
+type countingStorage struct {
+	*MapStorage
+
+	mu   sync.Mutex
+	sets map[string]int
+}
+
+func newCountingStorage() *countingStorage {
+	return &countingStorage{MapStorage: NewMapStorage(), sets: make(map[string]int)}
+}
+
+func (cs *countingStorage) Set(key string, value []byte) {
+	cs.mu.Lock()
+	cs.sets[key]++
+	cs.mu.Unlock()
+	cs.MapStorage.Set(key, value)
+}
+
+// takeSets returns the counts of Sets since the last call.
+func (cs *countingStorage) takeSets() map[string]int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sets := cs.sets
+	cs.sets = make(map[string]int)
+	return sets
+}
+
+func TestPersistOnlyWhatChanged(t *testing.T) {
+	storage := newCountingStorage()
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	storage.takeSets()
+
+	// A vote changes the term and the vote, not the log.
+	var voteReply RequestVoteReply
+	if err := cm.RequestVote(RequestVoteArgs{Term: 1, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &voteReply); err != nil {
+		t.Fatal(err)
+	}
+	if !voteReply.VoteGranted {
+		t.Fatalf("vote not granted: %+v", voteReply)
+	}
+	if sets := storage.takeSets(); sets["log"] != 0 || sets["snapshot"] != 0 || sets["votedFor"] == 0 {
+		t.Errorf("granting a vote wrote %v; want votedFor and currentTerm only", sets)
+	}
+
+	// New entries only change the log.
+	args := AppendEntriesArgs{
+		Term:         1,
+		LeaderId:     1,
+		PrevLogIndex: -1,
+		PrevLogTerm:  -1,
+		Entries:      []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}},
+		LeaderCommit: 1,
+	}
+	var aeReply AppendEntriesReply
+	if err := cm.AppendEntries(args, &aeReply); err != nil {
+		t.Fatal(err)
+	}
+	if !aeReply.Success {
+		t.Fatalf("AppendEntries failed: %+v", aeReply)
+	}
+	if sets := storage.takeSets(); sets["log"] != 1 || len(sets) != 1 {
+		t.Errorf("appending entries wrote %v; want the log only", sets)
+	}
+
+	// A heartbeat changes nothing.
+	args.PrevLogIndex, args.PrevLogTerm, args.Entries = 1, 1, nil
+	if err := cm.AppendEntries(args, &aeReply); err != nil {
+		t.Fatal(err)
+	}
+	if sets := storage.takeSets(); len(sets) != 0 {
+		t.Errorf("heartbeat wrote %v; want nothing", sets)
+	}
+
+	// Only a snapshot writes the snapshot, along with the compacted log.
+	for i := 0; i < 2; i++ {
+		<-commitChan
+	}
+	for deadline := time.Now().Add(time.Second); cm.LastApplied() < 1 && time.Now().Before(deadline); {
+		sleepMs(5)
+	}
+	cm.Snapshot(1, []byte("1,2"))
+	if sets := storage.takeSets(); sets["snapshot"] != 1 || sets["snapshotMeta"] != 1 || sets["log"] != 1 {
+		t.Errorf("snapshot wrote %v; want the snapshot, its metadata and the log", sets)
+	}
+}
+
+func TestBoltStorageRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.db")
+	storage, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.HasData() {
+		t.Fatalf("new BoltStorage has data")
+	}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLog(cm, 3, 1, 2, 3)
+	cm.mu.Lock()
+	cm.votedFor = 2
+	cm.persistTermAndVote()
+	cm.mu.Unlock()
+	cm.Stop()
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A CM on the reopened storage picks up where the previous one left off.
+	storage, err = NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.currentTerm != 3 || cm.votedFor != 2 {
+		t.Errorf("restored currentTerm=%d votedFor=%d; want 3 and 2", cm.currentTerm, cm.votedFor)
+	}
+	if len(cm.log) != 3 || cm.log[2].Term != 3 || cm.log[2].Command != 2 {
+		t.Errorf("restored log %v; want 3 entries", cm.log)
+	}
+}
+
+func TestCorruptStorage(t *testing.T) {
+	var tests = []struct {
+		name    string
+		corrupt func(storage *MapStorage)
+		wantKey string
+	}{
+		{"undecodable term", func(storage *MapStorage) { storage.Set("currentTerm", []byte("garbage")) }, "currentTerm"},
+		{"missing log", func(storage *MapStorage) { delete(storage.m, "log") }, "log"},
+		{"undecodable snapshot meta", func(storage *MapStorage) { storage.Set("snapshotMeta", []byte{1}) }, "snapshotMeta"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewMapStorage()
+			cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setLog(cm, 1, 1)
+			cm.Stop()
+			tt.corrupt(storage)
+
+			_, err = NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry), nil)
+			if !errors.Is(err, ErrCorruptStorage) {
+				t.Fatalf("got error %v; want ErrCorruptStorage", err)
+			}
+			var corruptErr *CorruptStorageError
+			if !errors.As(err, &corruptErr) || corruptErr.Key != tt.wantKey {
+				t.Errorf("got error %v; want a CorruptStorageError for key %q", err, tt.wantKey)
+			}
+		})
+	}
+}
+
+// walSegment returns the path of the only segment of the WAL in dir.
+func walSegment(t *testing.T, dir string) string {
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("WAL segments %v, %v; want one", paths, err)
+	}
+	return paths[0]
+}
+
+func TestWALDiscardsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	ws, err := NewWALStorage(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Set("a", []byte("1"))
+	ws.Set("b", []byte("2"))
+	ws.Close()
+
+	// A crash in the middle of the latest write leaves a torn record, which
+	// is dropped on startup.
+	path := walSegment(t, dir)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	ws, err = NewWALStorage(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, found := ws.Get("a"); !found || !bytes.Equal(v, []byte("1")) {
+		t.Errorf("a = %q, %v; want 1", v, found)
+	}
+	if v, found := ws.Get("b"); found {
+		t.Errorf("b = %q from the torn record; want it discarded", v)
+	}
+
+	// The WAL goes on after the discarded record.
+	ws.Set("c", []byte("3"))
+	ws.Close()
+	ws, err = NewWALStorage(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, found := ws.Get("c"); !found {
+		t.Errorf("c not found after reopening")
+	}
+}
+
+func TestWALDetectsCorruptCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	// With a tiny segment size, every write starts a new segment with a
+	// checkpoint, and the segments before it are deleted.
+	ws, err := NewWALStorage(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Set("a", []byte("1"))
+	ws.StoreLog(0, []LogEntry{{Command: 1, Term: 1}})
+	ws.Close()
+
+	path := walSegment(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[walHeaderSize+1] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state the checkpoint replaced is gone, so this can't be repaired by
+	// discarding the record.
+	if _, err := NewWALStorage(dir, 1); !errors.Is(err, ErrCorruptStorage) {
+		t.Errorf("got error %v; want ErrCorruptStorage", err)
+	}
+}
+
+func TestNoSync(t *testing.T) {
+	dir := t.TempDir()
+	ws, err := NewWALStorage(filepath.Join(dir, "wal"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBoltStorage(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	for _, noSync := range []bool{true, false} {
+		config := DefaultConfig()
+		config.NoSync = noSync
+		for _, storage := range []Storage{ws, bs} {
+			cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cm.Stop()
+		}
+		ws.mu.Lock()
+		walSync := ws.sync
+		ws.mu.Unlock()
+		if walSync == noSync || bs.db.NoSync != noSync {
+			t.Errorf("NoSync=%v: WAL syncs %v, bbolt NoSync=%v", noSync, walSync, bs.db.NoSync)
+		}
+	}
+
+	// Unsynced writes are still written, and read back after a clean close.
+	ws.SetSync(false)
+	ws.Set("a", []byte("1"))
+	ws.Close()
+	ws, err = NewWALStorage(filepath.Join(dir, "wal"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, found := ws.Get("a"); !found {
+		t.Errorf("unsynced write lost")
+	}
+}
+
+func BenchmarkBoltStorageSync(b *testing.B) {
+	benchmarkBoltStorage(b, true)
+}
+
+func BenchmarkBoltStorageNoSync(b *testing.B) {
+	benchmarkBoltStorage(b, false)
+}
+
+// benchmarkBoltStorage measures Sets of a 128-byte value, one transaction
+// each like the writes of a CM, with fsync on or off.
+func benchmarkBoltStorage(b *testing.B, sync bool) {
+	bs, err := NewBoltStorage(filepath.Join(b.TempDir(), "raft.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bs.Close()
+	bs.SetSync(sync)
+	value := make([]byte, 128)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bs.Set("currentTerm", value)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+}
+
+func TestVotePersistedBeforeReply(t *testing.T) {
+	storage := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var voteReply RequestVoteReply
+	if err := cm.RequestVote(RequestVoteArgs{Term: 1, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &voteReply); err != nil || !voteReply.VoteGranted {
+		t.Fatalf("RequestVote: %v, %+v", err, voteReply)
+	}
+
+	// The server crashes as soon as the reply is out; Stop doesn't write
+	// anything, so the restarted server only knows what the handler persisted.
+	cm.Stop()
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.RequestVote(RequestVoteArgs{Term: 1, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}, &voteReply); err != nil {
+		t.Fatal(err)
+	}
+	if voteReply.VoteGranted {
+		t.Errorf("restarted server voted twice in term 1")
+	}
+
+	// A higher term in an AppendEntries is persisted before it's acted on too.
+	args := AppendEntriesArgs{Term: 4, LeaderId: 2, PrevLogIndex: -1, PrevLogTerm: -1}
+	var aeReply AppendEntriesReply
+	if err := cm.AppendEntries(args, &aeReply); err != nil || !aeReply.Success {
+		t.Fatalf("AppendEntries: %v, %+v", err, aeReply)
+	}
+	cm.Stop()
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.currentTerm != 4 {
+		t.Errorf("restored currentTerm=%d; want 4", cm.currentTerm)
+	}
+}
@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tracer is the interface a ConsensusModule creates tracing spans through,
+// so the path of a command through the cluster can be followed in a
+// distributed tracing system. An adapter for OpenTelemetry implements Start
+// with a trace.Tracer, and Inject and Extract with a propagator.
+//
+// For every command submitted with SubmitContext, the leader creates a
+// "propose" span, ending when the command commits, with a "replicate to peer
+// N" child for every AppendEntries RPC that carries the command. Followers
+// create an "AppendEntries" span as a child of the latter when they receive
+// the command, and every server creates a "commit" span while it delivers the
+// command on its commit channel.
+type Tracer interface {
+	// Start starts a span called name, as a child of the span in ctx if
+	// there's one, and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+
+	// Inject encodes the span context of ctx, to send it to another server in
+	// an RPC, and Extract decodes it into a context its spans are children
+	// of.
+	Inject(ctx context.Context) []byte
+	Extract(data []byte) context.Context
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	End()
+}
+
+// NopTracer is a Tracer that creates no spans; it's the default. With it, the
+// CM skips all tracing work.
+type NopTracer struct{}
+
+func (NopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (NopTracer) Inject(ctx context.Context) []byte { return nil }
+
+func (NopTracer) Extract(data []byte) context.Context { return context.Background() }
+
+type nopSpan struct{}
+
+func (nopSpan) End() {}
+
+// SubmitContext is like Submit, but traces the command as a child of the span
+// in ctx.
+func (cm *ConsensusModule) SubmitContext(ctx context.Context, command interface{}) (index int, term int, isLeader bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	index, term, err := cm.submit(command)
+	isLeader = err == nil
+	if isLeader && cm.tracing {
+		ctx, span := cm.config.Tracer.Start(ctx, "propose")
+		cm.proposeSpans[index] = span
+		cm.traces[index] = ctx
+	}
+	return index, term, isLeader
+}
+
+// startReplicateSpans starts a "replicate to peer N" span for every traced
+// entry in args, which is about to be sent to peerId, and adds their span
+// contexts to args. It returns the spans.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startReplicateSpans(peerId int, args *AppendEntriesArgs) []Span {
+	cm.assertLocked()
+	var spans []Span
+	for i := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		ctx, ok := cm.traces[index]
+		if !ok {
+			continue
+		}
+		ctx, span := cm.config.Tracer.Start(ctx, fmt.Sprintf("replicate to peer %d", peerId))
+		if args.Traces == nil {
+			args.Traces = make(map[int][]byte)
+		}
+		args.Traces[index] = cm.config.Tracer.Inject(ctx)
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// startAppendEntriesSpans starts an "AppendEntries" span for every traced
+// entry args carries, and returns their contexts by log index.
+func (cm *ConsensusModule) startAppendEntriesSpans(args AppendEntriesArgs) (map[int]context.Context, []Span) {
+	ctxs := make(map[int]context.Context)
+	var spans []Span
+	for index, data := range args.Traces {
+		ctx, span := cm.config.Tracer.Start(cm.config.Tracer.Extract(data), "AppendEntries")
+		ctxs[index] = ctx
+		spans = append(spans, span)
+	}
+	return ctxs, spans
+}
+
+// endProposeSpans ends the "propose" spans of all entries up to index, or of
+// all entries if index is -1.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) endProposeSpans(index int) {
+	cm.assertLocked()
+	for i, span := range cm.proposeSpans {
+		if index == -1 || i <= index {
+			span.End()
+			delete(cm.proposeSpans, i)
+		}
+	}
+}
+
+// dropTraces forgets the traces of entries from index on, which were removed
+// from the log.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) dropTraces(index int) {
+	cm.assertLocked()
+	for i := range cm.traces {
+		if i >= index {
+			delete(cm.traces, i)
+		}
+	}
+}
+
+func endSpans(spans []Span) {
+	for _, span := range spans {
+		span.End()
+	}
+}
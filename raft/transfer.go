@@ -0,0 +1,225 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+// TransferLeadership hands leadership over to targetId, which must be a
+// voting member of the cluster. It can only be called on the leader. It blocks
+// until the transfer completes: first the target is caught up with the
+// leader's log, and then it is told to start an election right away with a
+// TimeoutNow RPC. While the transfer is in progress Submit refuses new
+// commands. If the target doesn't become leader within twice the maximal
+// election timeout, the transfer is abandoned, this CM resumes normal
+// operation as leader and an error matching ErrTimeout is returned.
+func (cm *ConsensusModule) TransferLeadership(targetId int) error {
+	cm.mu.Lock()
+	if cm.getState() != Leader {
+		cm.mu.Unlock()
+		return fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	if cm.transferTarget != -1 {
+		cm.mu.Unlock()
+		return fmt.Errorf("leadership transfer to %d already in progress", cm.transferTarget)
+	}
+	isPeer := false
+	for _, peerId := range cm.peerIds {
+		if peerId == targetId {
+			isPeer = true
+		}
+	}
+	if !isPeer {
+		cm.mu.Unlock()
+		return fmt.Errorf("server %d is not a voting peer", targetId)
+	}
+	cm.transferTarget = targetId
+	savedCurrentTerm := cm.getTerm()
+	cm.dlog("starting leadership transfer to %d", targetId)
+	cm.mu.Unlock()
+
+	defer func() {
+		cm.mu.Lock()
+		cm.transferTarget = -1
+		cm.mu.Unlock()
+	}()
+
+	deadline := cm.clock.Now().Add(2 * cm.config.ElectionTimeoutMax)
+	ticker := cm.clock.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	// Wait for the target to catch up; no new entries are accepted meanwhile,
+	// so the leader's last index is stable.
+	for {
+		cm.mu.Lock()
+		if cm.getState() != Leader || cm.getTerm() != savedCurrentTerm {
+			cm.mu.Unlock()
+			return fmt.Errorf("lost leadership while transferring to %d: %w", targetId, ErrNotLeader)
+		}
+		lastLogIndex, _ := cm.lastLogIndexAndTerm()
+		caughtUp := cm.matchIndex[targetId] == lastLogIndex
+		cm.mu.Unlock()
+
+		if caughtUp {
+			break
+		}
+		if cm.clock.Now().After(deadline) {
+			return fmt.Errorf("waiting for %d to catch up: %w", targetId, ErrTimeout)
+		}
+		<-ticker.C()
+	}
+
+	args := TimeoutNowArgs{
+		Term:     savedCurrentTerm,
+		LeaderId: cm.id,
+	}
+	var reply TimeoutNowReply
+	cm.dlog("sending TimeoutNow to %d", targetId)
+	if err := cm.callPeer(targetId, "ConsensusModule.TimeoutNow", args, &reply); err != nil {
+		return fmt.Errorf("sending TimeoutNow to %d: %w", targetId, err)
+	}
+
+	// The target's election will bump the term and make this CM step down.
+	for {
+		cm.mu.Lock()
+		done := cm.getState() != Leader || cm.getTerm() != savedCurrentTerm
+		cm.mu.Unlock()
+
+		if done {
+			cm.dlog("leadership transfer to %d done", targetId)
+			return nil
+		}
+		if cm.clock.Now().After(deadline) {
+			return fmt.Errorf("waiting for %d to become leader: %w", targetId, ErrTimeout)
+		}
+		<-ticker.C()
+	}
+}
+
+// TimeoutNow RPC. The leader sends it to the target of a leadership transfer,
+// which starts an election immediately instead of waiting for its election
+// timer.
+func (cm *ConsensusModule) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Dead {
+		reply.Term = cm.getTerm()
+		return nil
+	}
+	cm.dlog("TimeoutNow: %+v", args)
+
+	if args.Term > cm.getTerm() {
+		cm.becomeFollower(args.Term)
+	}
+	reply.Term = cm.getTerm()
+	if args.Term == cm.getTerm() && cm.getState() == Follower && cm.isVoter && !cm.electionsPaused {
+		cm.startElection(true)
+	}
+	return nil
+}
+
+// CampaignNow makes this CM start an election right away instead of waiting
+// for its election timer to expire. It's meant for planned failovers, and for
+// tests that need a specific server to become leader. It can only be called
+// on a follower that's a voting member. With PreVote, the election is only
+// started if the pre-vote succeeds, which it doesn't while the peers hear
+// from a healthy leader; without PreVote, the election is forced past the
+// peers' leader stickiness (see RequestVoteArgs.Force). Use it sparingly: the
+// election bumps the term even if it's lost, which makes the current leader
+// step down for nothing.
+//
+// With CheckQuorum and without PreVote, an error is returned instead: a
+// forced election could elect a new leader while the current one still holds
+// a lease, and serves stale reads with LeaseRead. Use TransferLeadership on
+// the leader to hand leadership over safely.
+func (cm *ConsensusModule) CampaignNow() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() != Follower {
+		return fmt.Errorf("server %d is not a follower", cm.id)
+	}
+	if !cm.isVoter {
+		return fmt.Errorf("server %d is not a voting member", cm.id)
+	}
+	if cm.electionsPaused {
+		return fmt.Errorf("server %d has its elections paused", cm.id)
+	}
+	if cm.config.CheckQuorum && !cm.config.PreVote {
+		return fmt.Errorf("server %d can't force an election with CheckQuorum: it would break the leader's lease", cm.id)
+	}
+	cm.dlog("campaigning now")
+	if cm.config.PreVote {
+		cm.startPreVote(false)
+	} else {
+		cm.startElection(true)
+	}
+	return nil
+}
+
+// StepDown makes this CM, which must be the leader, stop leading. It first
+// tries to transfer leadership to the voting peer with the most of the log, so
+// the cluster gets a new leader right away; if that fails, it steps down to
+// follower anyway and the cluster elects a new leader after an election
+// timeout. Unless its elections are paused with PauseElections, this CM may be
+// elected again.
+func (cm *ConsensusModule) StepDown() error {
+	cm.mu.Lock()
+	if cm.getState() != Leader {
+		cm.mu.Unlock()
+		return fmt.Errorf("server %d is %w", cm.id, ErrNotLeader)
+	}
+	savedCurrentTerm := cm.getTerm()
+	targetId := -1
+	for _, peerId := range cm.peerIds {
+		if targetId == -1 || cm.matchIndex[peerId] > cm.matchIndex[targetId] {
+			targetId = peerId
+		}
+	}
+	cm.mu.Unlock()
+
+	if targetId != -1 {
+		err := cm.TransferLeadership(targetId)
+		if err == nil {
+			return nil
+		}
+		cm.wlog("stepping down without transferring leadership: %v", err)
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.getState() == Leader && cm.getTerm() == savedCurrentTerm {
+		cm.ilog("steps down")
+		cm.becomeFollower(cm.getTerm())
+	}
+	return nil
+}
+
+// PauseElections keeps this CM from starting elections, e.g. while its server
+// is under maintenance, until ResumeElections is called. It still replicates
+// the leader's log and votes in other servers' elections, so it doesn't hold
+// up the cluster. It doesn't make a leader step down; use StepDown for that.
+func (cm *ConsensusModule) PauseElections() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.dlog("pausing elections")
+	cm.electionsPaused = true
+}
+
+// ResumeElections undoes PauseElections. The CM waits for a full election
+// timeout before it campaigns.
+func (cm *ConsensusModule) ResumeElections() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.dlog("resuming elections")
+	cm.electionsPaused = false
+	cm.electionResetEvent = cm.clock.Now()
+}
@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCampaignNowKeepsLease(t *testing.T) {
+	for _, preVote := range []bool{false, true} {
+		config := DefaultConfig()
+		config.CheckQuorum = true
+		config.PreVote = preVote
+		h := NewHarnessWithConfig(t, 3, config)
+
+		leaderId, term := h.CheckSingleLeader()
+		sleepMs(100)
+		leader := h.cluster[leaderId].cm
+		if _, err := leader.LeaseRead(); err != nil {
+			t.Errorf("PreVote=%v: LeaseRead on leader %d: %v", preVote, leaderId, err)
+		}
+
+		// A follower can't take over from a leader that holds a lease: without
+		// PreVote CampaignNow refuses to force an election, and with it the
+		// pre-vote fails.
+		err := h.cluster[(leaderId+1)%3].CampaignNow()
+		if preVote && err != nil {
+			t.Errorf("PreVote=%v: CampaignNow: %v", preVote, err)
+		} else if !preVote && err == nil {
+			t.Errorf("PreVote=%v: CampaignNow succeeded with CheckQuorum; want an error", preVote)
+		}
+		sleepMs(100)
+		if newLeaderId, newTerm := h.CheckSingleLeader(); newLeaderId != leaderId || newTerm != term {
+			t.Errorf("PreVote=%v: leader %d in term %d; want %d in term %d", preVote, newLeaderId, newTerm, leaderId, term)
+		}
+
+		// A leadership transfer forces the target's election, so the leader
+		// stops serving lease reads while it's in progress.
+		leader.mu.Lock()
+		leader.transferTarget = (leaderId + 1) % 3
+		leader.mu.Unlock()
+		if _, err := leader.LeaseRead(); !errors.Is(err, ErrLeaseExpired) {
+			t.Errorf("PreVote=%v: LeaseRead during a leadership transfer: got %v; want ErrLeaseExpired", preVote, err)
+		}
+		leader.mu.Lock()
+		leader.transferTarget = -1
+		leader.mu.Unlock()
+		h.Shutdown()
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// The leader hands its leadership over to a peer right away, without
+	// the cluster waiting for an election timeout.
+	leaderId, term := h.CheckSingleLeader()
+	h.SubmitToLeader(42)
+	sleepMs(150)
+	if err := h.cluster[leaderId].cm.StepDown(); err != nil {
+		t.Fatal(err)
+	}
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == leaderId || newTerm <= term {
+		t.Errorf("leader %d in term %d after StepDown; want another leader than %d after term %d", newLeaderId, newTerm, leaderId, term)
+	}
+	if err := h.cluster[leaderId].cm.StepDown(); err == nil {
+		t.Errorf("StepDown on follower %d succeeded", leaderId)
+	}
+	h.SubmitToLeader(43)
+	sleepMs(150)
+	h.CheckCommittedN(43, 3)
+}
+
+func TestPauseElections(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// With the leader gone, a follower whose elections are paused never
+	// campaigns, so the other one becomes leader.
+	leaderId, _ := h.CheckSingleLeader()
+	paused := (leaderId + 1) % 3
+	other := (leaderId + 2) % 3
+	h.cluster[paused].cm.PauseElections()
+	if err := h.cluster[paused].CampaignNow(); err == nil {
+		t.Errorf("CampaignNow with paused elections succeeded")
+	}
+	h.DisconnectPeer(leaderId)
+	if newLeaderId, _ := h.CheckSingleLeader(); newLeaderId != other {
+		t.Errorf("leader %d; want %d", newLeaderId, other)
+	}
+
+	// Left alone, it doesn't campaign either.
+	h.DisconnectPeer(other)
+	_, termBefore, _ := h.cluster[paused].cm.Report()
+	sleepMs(900)
+	if _, term, isLeader := h.cluster[paused].cm.Report(); isLeader || term != termBefore {
+		t.Errorf("paused server %d in term %d (leader %v); want it still in term %d", paused, term, isLeader, termBefore)
+	}
+
+	// Once resumed, it campaigns like any follower.
+	h.cluster[paused].cm.ResumeElections()
+	sleepMs(900)
+	if _, term, _ := h.cluster[paused].cm.Report(); term <= termBefore {
+		t.Errorf("resumed server %d in term %d; want it to campaign past term %d", paused, term, termBefore)
+	}
+}
@@ -0,0 +1,129 @@
+package raft
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// Transport is used by a Server to send RPCs to its peers. serviceMethod has
+// the "ConsensusModule.Method" form used by net/rpc; implementations are
+// responsible for delivering args to the peer's ConsensusModule and filling in
+// reply.
+type Transport interface {
+	Call(id int, serviceMethod string, args interface{}, reply interface{}) error
+
+	// Close releases all resources used by the transport; Call fails after
+	// Close.
+	Close() error
+}
+
+// peerConnector is implemented by transports that connect to peers by
+// network address, such as RPCTransport.
+type peerConnector interface {
+	ConnectToPeer(peerId int, addr net.Addr) error
+	DisconnectPeer(peerId int) error
+}
+
+// handlerRegistrar is implemented by transports that deliver incoming RPCs
+// themselves, such as InmemTransport. A Server using such a transport
+// registers its RPCProxy with it instead of listening for TCP connections.
+type handlerRegistrar interface {
+	RegisterHandler(handler interface{})
+}
+
+// RPCTransport is a Transport that sends RPCs to peers over net/rpc
+// connections.
+type RPCTransport struct {
+	mu sync.Mutex
+
+	// Requires mutex to access
+	peerClients map[int]*rpc.Client
+	closed      bool
+	tlsConfig   *tls.Config
+}
+
+func NewRPCTransport() *RPCTransport {
+	return &RPCTransport{
+		peerClients: make(map[int]*rpc.Client),
+	}
+}
+
+// SetTLSConfig makes the transport connect to peers over TLS with config;
+// see Server.SetTLSConfig. It only affects connections made afterwards.
+func (t *RPCTransport) SetTLSConfig(config *tls.Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tlsConfig = config
+}
+
+// ConnectToPeer dials the peer identified by peerId at addr, so that RPCs
+// can be sent to it. It's a no-op if a client for that peer already exists.
+// With TLS, the TLS handshake is completed before ConnectToPeer returns, so a
+// peer with an unexpected certificate is rejected right away.
+func (t *RPCTransport) ConnectToPeer(peerId int, addr net.Addr) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return fmt.Errorf("connect to peer %d: %w", peerId, ErrShutdown)
+	}
+	if t.peerClients[peerId] == nil {
+		var client *rpc.Client
+		if t.tlsConfig != nil {
+			conn, err := tls.Dial(addr.Network(), addr.String(), t.tlsConfig)
+			if err != nil {
+				return err
+			}
+			client = rpc.NewClient(conn)
+		} else {
+			var err error
+			client, err = rpc.Dial(addr.Network(), addr.String())
+			if err != nil {
+				return err
+			}
+		}
+		t.peerClients[peerId] = client
+	}
+	return nil
+}
+
+// DisconnectPeer closes the connection to the peer identified by peerId.
+func (t *RPCTransport) DisconnectPeer(peerId int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client := t.peerClients[peerId]; client != nil {
+		delete(t.peerClients, peerId)
+		return client.Close()
+	}
+	return nil
+}
+
+func (t *RPCTransport) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	t.mu.Lock()
+	peer := t.peerClients[id]
+	t.mu.Unlock()
+
+	if peer == nil {
+		// Return an error if this function is called after shutdown
+		return fmt.Errorf("call client %d: %w", id, ErrPeerClosed)
+	} else {
+		return peer.Call(serviceMethod, args, reply)
+	}
+}
+
+// Close closes the connections to all peers.
+func (t *RPCTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	var firstErr error
+	for id, client := range t.peerClients {
+		if err := client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(t.peerClients, id)
+	}
+	return firstErr
+}
@@ -0,0 +1,447 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// defaultWALSegmentSize is the segment size used when NewWALStorage is passed
+// zero.
+const defaultWALSegmentSize = 64 << 20
+
+// walRecordKind identifies the change a WAL record makes.
+type walRecordKind int
+
+const (
+	// walSet stores Value under Key.
+	walSet walRecordKind = iota
+
+	// walEntries replaces the stored log entries from Index on with Entries.
+	walEntries
+
+	// walCompact drops the stored log entries before FirstIndex.
+	walCompact
+
+	// walCheckpoint replaces all stored state: State holds every key, and the
+	// log is Entries, starting at FirstIndex.
+	walCheckpoint
+)
+
+// walRecord is a single change written to the WAL. Which fields are used
+// depends on Kind.
+type walRecord struct {
+	Kind walRecordKind
+
+	Key   string
+	Value []byte
+	State map[string][]byte
+
+	Index      int
+	FirstIndex int
+	Entries    []LogEntry
+}
+
+// WALStorage is a file-based Storage that implements LogStorage: it appends
+// every change as a record to a write-ahead log, so storing new log entries
+// costs a write proportional to the new entries only, not to the whole log.
+//
+// The WAL is split into segment files in a directory. Once the current
+// segment grows past the segment size, a new segment is started with a
+// checkpoint of the whole state and the older segments are deleted. Every
+// record carries a CRC, so a record torn by a crash at the end of the WAL is
+// detected on startup and discarded. Every write is fsynced before it returns,
+// unless syncing is turned off with SetSync.
+type WALStorage struct {
+	mu sync.Mutex
+
+	dir            string
+	maxSegmentSize int64
+	sync           bool
+
+	// segment is the file new records are appended to, segmentSeq its
+	// sequence number and segmentSize its current size. checkpointSize is the
+	// size of the checkpoint the segment starts with, which doesn't count
+	// towards the segment size limit; otherwise a state larger than the limit
+	// would be checkpointed on every write.
+	segment        *os.File
+	segmentSeq     int
+	segmentSize    int64
+	checkpointSize int64
+
+	// The state the WAL describes, kept in memory: the stored keys, and the
+	// stored log, whose first entry is at index firstIndex.
+	kv         map[string][]byte
+	firstIndex int
+	entries    []LogEntry
+}
+
+// NewWALStorage opens the WAL in dir, creating dir if it doesn't exist yet,
+// and replays it to recover the stored state. Segments are rotated once they
+// grow past maxSegmentSize bytes; zero selects a default of 64 MiB.
+func NewWALStorage(dir string, maxSegmentSize int64) (*WALStorage, error) {
+	if maxSegmentSize == 0 {
+		maxSegmentSize = defaultWALSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create WAL directory: %w", err)
+	}
+	ws := &WALStorage{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		sync:           true,
+		kv:             make(map[string][]byte),
+	}
+
+	seqs, err := ws.segmentSeqs()
+	if err != nil {
+		return nil, err
+	}
+	for i, seq := range seqs {
+		if err := ws.replaySegment(seq, i == 0, i == len(seqs)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(seqs) == 0 {
+		if err := ws.openSegment(1); err != nil {
+			return nil, err
+		}
+	} else {
+		last := seqs[len(seqs)-1]
+		f, err := os.OpenFile(ws.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("open WAL segment: %w", err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("open WAL segment: %w", err)
+		}
+		ws.segment = f
+		ws.segmentSeq = last
+		ws.segmentSize = fi.Size()
+	}
+	return ws, nil
+}
+
+// Close closes the WAL. The WALStorage can't be used after Close.
+func (ws *WALStorage) Close() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.segment.Close()
+}
+
+// SetSync sets whether writes are fsynced before they return; they are by
+// default. Without syncing, a write that returned stays in the OS page cache
+// until the OS flushes it, usually within 30 seconds on Linux: writes within
+// that window survive a crash of the process, but are lost if the machine
+// crashes or loses power. Checkpoints at segment rotation are always synced,
+// as segments they supersede are deleted.
+func (ws *WALStorage) SetSync(sync bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.sync = sync
+}
+
+func (ws *WALStorage) Get(key string) ([]byte, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	v, found := ws.kv[key]
+	return v, found
+}
+
+// Set stores value under key. Setting a key to the value it already has
+// writes nothing. Storage has no way to report errors, and the CM can't go on
+// safely when its state isn't persisted, so a failed write is fatal.
+func (ws *WALStorage) Set(key string, value []byte) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if old, found := ws.kv[key]; found && bytes.Equal(old, value) {
+		return
+	}
+	ws.write(walRecord{Kind: walSet, Key: key, Value: append([]byte{}, value...)})
+}
+
+func (ws *WALStorage) HasData() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.kv) > 0 || len(ws.entries) > 0
+}
+
+// StoreLog implements LogStorage. It writes only the entries that differ from
+// the stored log: by the Log Matching property, two entries with the same
+// index and term are preceded by identical logs, so the stored log and the
+// new one agree up to the last index at which their terms match.
+func (ws *WALStorage) StoreLog(firstIndex int, entries []LogEntry) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if firstIndex < ws.firstIndex {
+		// The log grew backwards, which compaction never does; start over
+		// from a checkpoint of the new log.
+		ws.firstIndex = firstIndex
+		ws.entries = append([]LogEntry(nil), entries...)
+		ws.rotate()
+		return
+	}
+	if firstIndex > ws.firstIndex {
+		ws.write(walRecord{Kind: walCompact, FirstIndex: firstIndex})
+	}
+
+	i := intMin(len(ws.entries), len(entries))
+	for i > 0 && ws.entries[i-1].Term != entries[i-1].Term {
+		i--
+	}
+	if i == len(ws.entries) && i == len(entries) {
+		return
+	}
+	newEntries := append([]LogEntry(nil), entries[i:]...)
+	ws.write(walRecord{Kind: walEntries, Index: firstIndex + i, Entries: newEntries})
+}
+
+// LoadLog implements LogStorage.
+func (ws *WALStorage) LoadLog() (firstIndex int, entries []LogEntry) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.firstIndex, append([]LogEntry(nil), ws.entries...)
+}
+
+// compact drops the in-memory log entries before firstIndex.
+// Expects ws.mu to be locked.
+func (ws *WALStorage) compact(firstIndex int) {
+	if drop := firstIndex - ws.firstIndex; drop < len(ws.entries) {
+		ws.entries = append([]LogEntry(nil), ws.entries[drop:]...)
+	} else {
+		ws.entries = nil
+	}
+	ws.firstIndex = firstIndex
+}
+
+// apply applies a record to the in-memory state, both when it's written and
+// when it's replayed.
+// Expects ws.mu to be locked.
+func (ws *WALStorage) apply(rec walRecord) error {
+	switch rec.Kind {
+	case walSet:
+		ws.kv[rec.Key] = rec.Value
+	case walEntries:
+		i := rec.Index - ws.firstIndex
+		if i < 0 || i > len(ws.entries) {
+			return fmt.Errorf("WAL entries at index %d don't follow the log [%d, %d)", rec.Index, ws.firstIndex, ws.firstIndex+len(ws.entries))
+		}
+		ws.entries = append(ws.entries[:i], rec.Entries...)
+	case walCompact:
+		ws.compact(rec.FirstIndex)
+	case walCheckpoint:
+		ws.kv = rec.State
+		if ws.kv == nil {
+			ws.kv = make(map[string][]byte)
+		}
+		ws.firstIndex = rec.FirstIndex
+		ws.entries = rec.Entries
+	default:
+		return fmt.Errorf("unknown WAL record kind %d", rec.Kind)
+	}
+	return nil
+}
+
+// write appends rec to the current segment, fsyncs it if syncing is on and
+// applies it to the in-memory state, then rotates the segment if it grew too
+// large. Failures are fatal, see Set.
+// Expects ws.mu to be locked.
+func (ws *WALStorage) write(rec walRecord) {
+	if err := ws.writeRecord(rec, ws.sync); err != nil {
+		log.Fatalf("WAL storage: %v", err)
+	}
+	if err := ws.apply(rec); err != nil {
+		log.Fatalf("WAL storage: %v", err)
+	}
+	if ws.segmentSize-ws.checkpointSize >= ws.maxSegmentSize {
+		ws.rotate()
+	}
+}
+
+// rotate starts a new segment with a checkpoint of the current state, and
+// deletes the older segments, which the checkpoint supersedes. Failures are
+// fatal, see Set.
+// Expects ws.mu to be locked.
+func (ws *WALStorage) rotate() {
+	prev := ws.segment
+	prevSeq := ws.segmentSeq
+	if err := ws.openSegment(prevSeq + 1); err != nil {
+		log.Fatalf("WAL storage: %v", err)
+	}
+	prev.Close()
+
+	err := ws.writeRecord(walRecord{
+		Kind:       walCheckpoint,
+		State:      ws.kv,
+		FirstIndex: ws.firstIndex,
+		Entries:    ws.entries,
+	}, true)
+	if err != nil {
+		log.Fatalf("WAL storage: %v", err)
+	}
+	ws.checkpointSize = ws.segmentSize
+
+	seqs, err := ws.segmentSeqs()
+	if err != nil {
+		log.Fatalf("WAL storage: %v", err)
+	}
+	for _, seq := range seqs {
+		if seq < ws.segmentSeq {
+			if err := os.Remove(ws.segmentPath(seq)); err != nil {
+				log.Fatalf("WAL storage: %v", err)
+			}
+		}
+	}
+}
+
+// Records are framed as a 4-byte length and a 4-byte CRC-32 of the payload,
+// both little-endian, followed by the gob-encoded walRecord payload.
+const walHeaderSize = 8
+
+// writeRecord appends rec to the current segment, and fsyncs it if sync is
+// set.
+// Expects ws.mu to be locked.
+func (ws *WALStorage) writeRecord(rec walRecord, sync bool) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return fmt.Errorf("encode WAL record: %w", err)
+	}
+	buf := make([]byte, walHeaderSize+payload.Len())
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(buf[walHeaderSize:], payload.Bytes())
+
+	if _, err := ws.segment.Write(buf); err != nil {
+		return fmt.Errorf("write WAL record: %w", err)
+	}
+	if sync {
+		if err := ws.segment.Sync(); err != nil {
+			return fmt.Errorf("sync WAL segment: %w", err)
+		}
+	}
+	ws.segmentSize += int64(len(buf))
+	return nil
+}
+
+// replaySegment applies all records of segment seq to the in-memory state;
+// first and last tell whether it's the first and the last segment in the WAL.
+// A torn or corrupt record is where a crash interrupted a write; in the last
+// segment, it and anything after it are discarded. Earlier segments were
+// complete when the next one was started, so there it's an error. So is a
+// torn checkpoint at the start of the first segment if segments before it
+// were deleted already: the state it replaced is gone.
+// Expects ws.mu to be locked, or ws not to be shared yet.
+func (ws *WALStorage) replaySegment(seq int, first, last bool) error {
+	path := ws.segmentPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open WAL segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, n, err := readWALRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !last || (first && seq > 1 && offset == 0) {
+				return fmt.Errorf("WAL segment %s at offset %d: %w", path, offset, err)
+			}
+			log.Printf("WAL segment %s: discarding torn record at offset %d: %v", path, offset, err)
+			return os.Truncate(path, offset)
+		}
+		if err := ws.apply(rec); err != nil {
+			return fmt.Errorf("%w: WAL segment %s at offset %d: %v", ErrCorruptStorage, path, offset, err)
+		}
+		if offset == 0 && rec.Kind == walCheckpoint {
+			ws.checkpointSize = n
+		}
+		offset += n
+	}
+}
+
+// errWALRecordCorrupt is returned by readWALRecord for a record that is
+// truncated or doesn't match its CRC.
+var errWALRecordCorrupt = fmt.Errorf("%w: torn WAL record", ErrCorruptStorage)
+
+// readWALRecord reads a single record from r, and returns it along with its
+// size in bytes. It returns io.EOF if r is at its end.
+func readWALRecord(r io.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return rec, 0, io.EOF
+		}
+		return rec, 0, errWALRecordCorrupt
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, errWALRecordCorrupt
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return rec, 0, errWALRecordCorrupt
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return rec, 0, fmt.Errorf("%w: decode WAL record: %v", ErrCorruptStorage, err)
+	}
+	return rec, int64(walHeaderSize) + int64(size), nil
+}
+
+// openSegment creates segment seq and makes it the current segment.
+// Expects ws.mu to be locked, or ws not to be shared yet.
+func (ws *WALStorage) openSegment(seq int) error {
+	f, err := os.OpenFile(ws.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("create WAL segment: %w", err)
+	}
+	// Sync the directory, so the new segment itself survives a crash.
+	if d, err := os.Open(ws.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	ws.segment = f
+	ws.segmentSeq = seq
+	ws.segmentSize = 0
+	ws.checkpointSize = 0
+	return nil
+}
+
+func (ws *WALStorage) segmentPath(seq int) string {
+	return filepath.Join(ws.dir, fmt.Sprintf("wal-%016d.log", seq))
+}
+
+// segmentSeqs returns the sequence numbers of the segments in the WAL
+// directory, in increasing order.
+func (ws *WALStorage) segmentSeqs() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(ws.dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, path := range paths {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(path), "wal-%d.log", &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}